@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/buildpack/imgutil"
+	"github.com/buildpack/imgutil/remote"
 	"github.com/pkg/errors"
 
 	"github.com/buildpack/lifecycle/metadata"
@@ -18,6 +19,12 @@ type Analyzer struct {
 	LayersDir    string
 	Out, Err     *log.Logger
 	SkipLayers   bool
+	Verifier     ImageVerifier
+}
+
+// ImageVerifier verifies the signature of an image digest.
+type ImageVerifier interface {
+	Verify(repoName, digest string) error
 }
 
 func (a *Analyzer) Analyze(image imgutil.Image) (metadata.AnalyzedMetadata, error) {
@@ -26,8 +33,10 @@ func (a *Analyzer) Analyze(image imgutil.Image) (metadata.AnalyzedMetadata, erro
 		return metadata.AnalyzedMetadata{}, errors.Wrap(err, "retrieve image identifier")
 	}
 
-	data, err := metadata.GetLayersMetdata(image)
-	if err != nil {
+	var data metadata.LayersMetadata
+	if imageID != nil && !a.verified(image) {
+		imageID = nil
+	} else if data, err = metadata.GetLayersMetdata(image); err != nil {
 		return metadata.AnalyzedMetadata{}, err
 	}
 
@@ -109,3 +118,32 @@ func (a *Analyzer) getImageIdentifier(image imgutil.Image) (*metadata.ImageIdent
 		Reference: identifier.String(),
 	}, nil
 }
+
+// verified reports whether the layers of image may be reused. When a verifier is set, images without a valid
+// signature are treated as if they did not exist.
+func (a *Analyzer) verified(image imgutil.Image) bool {
+	return verifyImage(a.Verifier, image, a.Out)
+}
+
+// verifyImage reports whether image has a valid signature, or true when verifier is nil.
+func verifyImage(verifier ImageVerifier, image imgutil.Image, out *log.Logger) bool {
+	if verifier == nil {
+		return true
+	}
+	identifier, err := image.Identifier()
+	if err != nil {
+		out.Printf("Warning: not reusing image '%s', its signature could not be verified: %s", image.Name(), err)
+		return false
+	}
+	digest, ok := identifier.(remote.DigestIdentifier)
+	if !ok {
+		out.Printf("Warning: not reusing image '%s', only images with a digest can be verified", image.Name())
+		return false
+	}
+	if err := verifier.Verify(image.Name(), digest.Digest.DigestStr()); err != nil {
+		out.Printf("Warning: not reusing image '%s', its signature could not be verified: %s", image.Name(), err)
+		return false
+	}
+	out.Printf("Verified signature of image '%s'", identifier.String())
+	return true
+}
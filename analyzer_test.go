@@ -12,7 +12,10 @@ import (
 
 	"github.com/buildpack/imgutil/fakes"
 	"github.com/buildpack/imgutil/local"
+	"github.com/buildpack/imgutil/remote"
 	"github.com/golang/mock/gomock"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 
@@ -497,6 +500,65 @@ func testAnalyzer(t *testing.T, when spec.G, it spec.S) {
 					})
 				})
 
+				when("a signature verifier is set", func() {
+					var (
+						verifier *fakeVerifier
+						digest   = "sha256:c27a27006b74a056bed5d9edcebc394783880abe8691a8c87c78b7cffa6fa5ad"
+					)
+
+					it.Before(func() {
+						verifier = &fakeVerifier{}
+						analyzer.Verifier = verifier
+
+						digestRef, err := name.NewDigest("image-repo-name@" + digest)
+						h.AssertNil(t, err)
+						image.SetIdentifier(remote.DigestIdentifier{Digest: digestRef})
+					})
+
+					it("verifies the image digest before using the metadata", func() {
+						md, err := analyzer.Analyze(image)
+						h.AssertNil(t, err)
+
+						h.AssertEq(t, verifier.verified, []string{"image-repo-name@" + digest})
+						h.AssertEq(t, md.Image.Reference, "index.docker.io/library/image-repo-name@"+digest)
+						h.AssertEq(t, md.Metadata, appImageMetadata)
+					})
+
+					when("the signature is invalid", func() {
+						it.Before(func() {
+							verifier.err = errors.New("invalid signature")
+						})
+
+						it("does not reuse the image", func() {
+							h.RecursiveCopy(t, filepath.Join("testdata", "analyzer", "cached-layers"), layerDir)
+
+							md, err := analyzer.Analyze(image)
+							h.AssertNil(t, err)
+
+							h.AssertNil(t, md.Image)
+							h.AssertEq(t, md.Metadata, metadata.LayersMetadata{})
+							if _, err := ioutil.ReadDir(filepath.Join(layerDir, "metdata.buildpack", "stale-launch-build")); !os.IsNotExist(err) {
+								t.Fatalf("Found stale stale-launch-build cache, it should not exist")
+							}
+							h.AssertStringContains(t, stdout.String(), "Warning: not reusing image 'image-repo-name', its signature could not be verified: invalid signature")
+						})
+					})
+
+					when("the image has no digest", func() {
+						it.Before(func() {
+							image.SetIdentifier(local.IDIdentifier{ImageID: "s0m3D1g3sT"})
+						})
+
+						it("does not reuse the image", func() {
+							md, err := analyzer.Analyze(image)
+							h.AssertNil(t, err)
+
+							h.AssertNil(t, md.Image)
+							h.AssertEq(t, len(verifier.verified), 0)
+						})
+					})
+				})
+
 				when("skip-layers is true", func() {
 					it.Before(func() {
 						analyzer.SkipLayers = true
@@ -610,3 +672,13 @@ func assertNil(t *testing.T, actual interface{}) {
 		t.Fatalf("Expected nil: %s", actual)
 	}
 }
+
+type fakeVerifier struct {
+	verified []string
+	err      error
+}
+
+func (v *fakeVerifier) Verify(repoName, digest string) error {
+	v.verified = append(v.verified, repoName+"@"+digest)
+	return v.err
+}
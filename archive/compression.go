@@ -0,0 +1,88 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression is the algorithm a layer is compressed with.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseCompression returns the compression named by s. An empty name means no compression.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return c, nil
+	default:
+		return "", errors.Errorf("unknown compression '%s', must be one of 'none', 'gzip' or 'zstd'", s)
+	}
+}
+
+// Compress returns a writer that compresses what is written to it into w. Closing the writer flushes the
+// compressed stream but does not close w.
+func Compress(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, errors.Errorf("unknown compression '%s'", c)
+	}
+}
+
+// Decompress returns a reader of the uncompressed contents of r, detecting gzip and zstd compression from the
+// leading bytes of r. Uncompressed input is returned as it is.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, errors.Wrap(err, "detecting compression")
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading gzip stream")
+		}
+		return gr, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading zstd stream")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
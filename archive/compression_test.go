@@ -0,0 +1,90 @@
+package archive_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/archive"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestCompression(t *testing.T) {
+	spec.Run(t, "compression", testCompression, spec.Report(report.Terminal{}))
+}
+
+func testCompression(t *testing.T, when spec.G, it spec.S) {
+	compress := func(data []byte, c archive.Compression) []byte {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		w, err := archive.Compress(buf, c)
+		h.AssertNil(t, err)
+		_, err = w.Write(data)
+		h.AssertNil(t, err)
+		h.AssertNil(t, w.Close())
+		return buf.Bytes()
+	}
+
+	for _, c := range []archive.Compression{archive.CompressionNone, archive.CompressionGzip, archive.CompressionZstd} {
+		c := c
+		when("the input is compressed with "+string(c), func() {
+			it("detects the compression and decompresses it", func() {
+				data := []byte("some-data")
+
+				rc, err := archive.Decompress(bytes.NewReader(compress(data, c)))
+				h.AssertNil(t, err)
+				defer rc.Close()
+
+				out, err := ioutil.ReadAll(rc)
+				h.AssertNil(t, err)
+				h.AssertEq(t, out, data)
+			})
+
+			it("is extracted by Untar", func() {
+				tmpDir, err := ioutil.TempDir("", "compression-test")
+				h.AssertNil(t, err)
+				defer os.RemoveAll(tmpDir)
+
+				layer := &bytes.Buffer{}
+				h.AssertNil(t, archive.WriteTarArchive(layer, filepath.Join("testdata", "dir-to-tar"), os.Getuid(), os.Getgid(), archive.NormalizedDateTime))
+
+				h.AssertNil(t, archive.Untar(bytes.NewReader(compress(layer.Bytes(), c)), tmpDir))
+
+				contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "testdata", "dir-to-tar", "some-file.txt"))
+				h.AssertNil(t, err)
+				expected, err := ioutil.ReadFile(filepath.Join("testdata", "dir-to-tar", "some-file.txt"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, contents, expected)
+			})
+		})
+	}
+
+	when("#Decompress", func() {
+		it("returns short uncompressed input as it is", func() {
+			rc, err := archive.Decompress(bytes.NewReader([]byte{0x1f}))
+			h.AssertNil(t, err)
+
+			out, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, out, []byte{0x1f})
+		})
+	})
+
+	when("#ParseCompression", func() {
+		it("defaults to no compression", func() {
+			c, err := archive.ParseCompression("")
+			h.AssertNil(t, err)
+			h.AssertEq(t, c, archive.CompressionNone)
+		})
+
+		it("fails for unknown compressions", func() {
+			_, err := archive.ParseCompression("bzip2")
+			h.AssertError(t, err, "unknown compression 'bzip2'")
+		})
+	})
+}
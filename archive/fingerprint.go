@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// fingerprintVersion must change whenever the tar format written by WriteTarArchive changes,
+// so that fingerprints recorded by older lifecycles are never mistaken for current ones.
+const fingerprintVersion = "2"
+
+// Fingerprint returns a digest of the tar headers WriteTarArchive would produce for srcDir, combined with the
+// modification time of each regular file. When hashContents is true the contents of each regular file are
+// hashed instead of relying on its modification time. Two equal fingerprints imply equal layer SHAs without
+// needing to write the tar.
+func Fingerprint(srcDir string, uid, gid int, modTime time.Time, hashContents bool) (string, error) {
+	return FilteredFingerprint(srcDir, uid, gid, modTime, hashContents, nil)
+}
+
+// FilteredFingerprint is like Fingerprint but only considers the files accepted by include, matching
+// the tar written by WriteFilteredTarFile.
+func FilteredFingerprint(srcDir string, uid, gid int, modTime time.Time, hashContents bool, include Filter) (string, error) {
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "v%s\n", fingerprintVersion)
+
+	parents, err := parentDirHeaders(srcDir, modTime)
+	if err != nil {
+		return "", err
+	}
+	for _, header := range parents {
+		writeHeaderFingerprint(hasher, header)
+	}
+
+	err = walkHeaders(srcDir, uid, gid, modTime, include, func(file string, fi os.FileInfo, header *tar.Header) error {
+		writeHeaderFingerprint(hasher, header)
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		if !hashContents {
+			fmt.Fprintf(hasher, "mtime=%d\n", fi.ModTime().UnixNano())
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		contentHasher := sha256.New()
+		if _, err := io.Copy(contentHasher, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(hasher, "content=%x\n", contentHasher.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func writeHeaderFingerprint(w io.Writer, header *tar.Header) {
+	fmt.Fprintf(w, "%q %c %o %d %d %d:%d %q %q %q\n",
+		header.Name,
+		header.Typeflag,
+		header.Mode,
+		header.Size,
+		header.ModTime.Unix(),
+		header.Uid,
+		header.Gid,
+		header.Uname,
+		header.Gname,
+		header.Linkname,
+	)
+	keys := make([]string, 0, len(header.PAXRecords))
+	for key := range header.PAXRecords {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %q=%q\n", key, header.PAXRecords[key])
+	}
+}
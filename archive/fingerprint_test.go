@@ -0,0 +1,125 @@
+package archive_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/archive"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestFingerprint(t *testing.T) {
+	spec.Run(t, "fingerprint", testFingerprint, spec.Report(report.Terminal{}))
+}
+
+func testFingerprint(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir, src string
+		uid         = 1234
+		gid         = 2345
+	)
+
+	when("#Fingerprint", func() {
+		it.Before(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "fingerprint-test")
+			h.AssertNil(t, err)
+
+			src = filepath.Join(tmpDir, "layer")
+			h.AssertNil(t, os.MkdirAll(filepath.Join(src, "sub-dir"), 0755))
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(src, "some-file.txt"), []byte("some-content"), 0644))
+			h.AssertNil(t, os.Symlink("../some-file.txt", filepath.Join(src, "sub-dir", "link-file")))
+		})
+
+		it.After(func() {
+			h.AssertNil(t, os.RemoveAll(tmpDir))
+		})
+
+		fingerprint := func(hashContents bool) string {
+			t.Helper()
+			fp, err := archive.Fingerprint(src, uid, gid, archive.NormalizedDateTime, hashContents)
+			h.AssertNil(t, err)
+			return fp
+		}
+
+		it("is stable for an unchanged directory", func() {
+			h.AssertEq(t, fingerprint(false), fingerprint(false))
+			h.AssertEq(t, fingerprint(true), fingerprint(true))
+		})
+
+		it("ignores directory modification times", func() {
+			before := fingerprint(false)
+			h.AssertNil(t, os.Chtimes(filepath.Join(src, "sub-dir"), time.Now(), time.Now().Add(time.Hour)))
+			h.AssertEq(t, fingerprint(false), before)
+		})
+
+		it("changes when the uid or gid changes", func() {
+			other, err := archive.Fingerprint(src, uid+1, gid, archive.NormalizedDateTime, false)
+			h.AssertNil(t, err)
+			if other == fingerprint(false) {
+				t.Fatal("expected fingerprint to change with uid")
+			}
+		})
+
+		it("changes when a file is added", func() {
+			before := fingerprint(false)
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(src, "sub-dir", "new-file"), []byte("new"), 0644))
+			if fingerprint(false) == before {
+				t.Fatal("expected fingerprint to change when a file is added")
+			}
+		})
+
+		it("changes when a file mode changes", func() {
+			before := fingerprint(false)
+			h.AssertNil(t, os.Chmod(filepath.Join(src, "some-file.txt"), 0755))
+			if fingerprint(false) == before {
+				t.Fatal("expected fingerprint to change when a file mode changes")
+			}
+		})
+
+		it("changes when a symlink target changes", func() {
+			before := fingerprint(false)
+			h.AssertNil(t, os.Remove(filepath.Join(src, "sub-dir", "link-file")))
+			h.AssertNil(t, os.Symlink("../other-file.txt", filepath.Join(src, "sub-dir", "link-file")))
+			if fingerprint(false) == before {
+				t.Fatal("expected fingerprint to change when a symlink target changes")
+			}
+		})
+
+		when("a file is rewritten with the same size", func() {
+			var path string
+
+			it.Before(func() {
+				path = filepath.Join(src, "some-file.txt")
+				mtime := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+				h.AssertNil(t, os.Chtimes(path, mtime, mtime))
+			})
+
+			it("changes when the modification time changes", func() {
+				before := fingerprint(false)
+				h.AssertNil(t, ioutil.WriteFile(path, []byte("other-conten"), 0644))
+				if fingerprint(false) == before {
+					t.Fatal("expected fingerprint to change when the modification time changes")
+				}
+			})
+
+			it("detects changed contents with a preserved modification time when hashing contents", func() {
+				before, beforeWithContents := fingerprint(false), fingerprint(true)
+				h.AssertNil(t, ioutil.WriteFile(path, []byte("other-conten"), 0644))
+				mtime := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+				h.AssertNil(t, os.Chtimes(path, mtime, mtime))
+
+				h.AssertEq(t, fingerprint(false), before)
+				if fingerprint(true) == beforeWithContents {
+					t.Fatal("expected content fingerprint to change when contents change")
+				}
+			})
+		})
+	})
+}
@@ -8,38 +8,178 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
-func WriteTarFile(sourceDir, dest string, uid, gid int) (string, error) {
-	hasher := sha256.New()
+// NormalizedDateTime is the modification time given to every tar entry when no other time is requested.
+var NormalizedDateTime = time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC)
+
+// Filter reports whether a file beneath the source directory should be written to a tar.
+// Directories that are not included are skipped along with their contents.
+type Filter func(file string, fi os.FileInfo) bool
+
+func WriteTarFile(sourceDir, dest string, uid, gid int, modTime time.Time) (string, error) {
+	return WriteFilteredTarFile(sourceDir, dest, uid, gid, modTime, nil)
+}
+
+// WriteFilteredTarFile is like WriteTarFile but only writes the files accepted by include.
+func WriteFilteredTarFile(sourceDir, dest string, uid, gid int, modTime time.Time, include Filter) (string, error) {
 	f, err := os.Create(dest)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
-	w := io.MultiWriter(hasher, f)
 
-	if WriteTarArchive(w, sourceDir, uid, gid) != nil {
+	return WriteLayer(f, sourceDir, uid, gid, modTime, include)
+}
+
+// WriteLayer streams the tar of sourceDir to w and returns the digest of the bytes written, so that a layer can
+// be stored or uploaded as it is produced rather than from an intermediate tar file.
+func WriteLayer(w io.Writer, sourceDir string, uid, gid int, modTime time.Time, include Filter) (string, error) {
+	hasher := sha256.New()
+	if err := writeTarArchive(io.MultiWriter(hasher, w), sourceDir, uid, gid, modTime, include); err != nil {
 		return "", err
 	}
-	sha := hex.EncodeToString(hasher.Sum(make([]byte, 0, hasher.Size())))
-	return "sha256:" + sha, nil
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func WriteTarArchive(w io.Writer, srcDir string, uid, gid int, modTime time.Time) error {
+	return writeTarArchive(w, srcDir, uid, gid, modTime, nil)
 }
 
-func WriteTarArchive(w io.Writer, srcDir string, uid, gid int) error {
+func writeTarArchive(w io.Writer, srcDir string, uid, gid int, modTime time.Time, include Filter) error {
 	tw := tar.NewWriter(w)
-	defer tw.Close()
 
-	err := addParentDirs(srcDir, tw, uid, gid)
+	err := addParentDirs(srcDir, tw, modTime)
+	if err != nil {
+		return err
+	}
+
+	err = walkHeaders(srcDir, uid, gid, modTime, include, func(file string, fi os.FileInfo, header *tar.Header) error {
+		return writeEntry(tw, file, header)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteRelativeLayer is like WriteLayer but names entries relative to sourceDir and writes no entries for
+// sourceDir or its parents, so that the layer can be extracted into any directory.
+func WriteRelativeLayer(w io.Writer, sourceDir string, uid, gid int, modTime time.Time) (string, error) {
+	return writeRelativeLayer(w, nil, sourceDir, uid, gid, modTime)
+}
+
+// WriteRelativeLayerAndDigest is like WriteRelativeLayer but also returns the digest WriteLayer would give
+// sourceDir, reading each file only once.
+func WriteRelativeLayerAndDigest(w io.Writer, sourceDir string, uid, gid int, modTime time.Time) (string, string, error) {
+	hasher := sha256.New()
+	sha, err := writeRelativeLayer(w, hasher, sourceDir, uid, gid, modTime)
+	if err != nil {
+		return "", "", err
+	}
+	return sha, "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// writeRelativeLayer writes the relative tar of sourceDir to w and, unless abs is nil, the tar WriteLayer
+// would write to abs.
+func writeRelativeLayer(w, abs io.Writer, sourceDir string, uid, gid int, modTime time.Time) (string, error) {
+	hasher := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(hasher, w))
+
+	sourceDir = filepath.Clean(sourceDir)
+	var absTW *tar.Writer
+	if abs != nil {
+		absTW = tar.NewWriter(abs)
+		if err := addParentDirs(sourceDir, absTW, modTime); err != nil {
+			return "", err
+		}
+	}
+	err := walkHeaders(sourceDir, uid, gid, modTime, nil, func(file string, fi os.FileInfo, header *tar.Header) error {
+		var writers []*tar.Writer
+		if absTW != nil {
+			absHeader := *header
+			if err := absTW.WriteHeader(&absHeader); err != nil {
+				return err
+			}
+			writers = append(writers, absTW)
+		}
+		if file != sourceDir {
+			var err error
+			if header.Name, err = filepath.Rel(sourceDir, header.Name); err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeLink {
+				if header.Linkname, err = filepath.Rel(sourceDir, header.Linkname); err != nil {
+					return err
+				}
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			writers = append(writers, tw)
+		}
+		return writeContents(file, header, writers...)
+	})
+	if err != nil {
+		return "", err
+	}
+	if absTW != nil {
+		if err := absTW.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func writeEntry(tw *tar.Writer, file string, header *tar.Header) error {
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	return writeContents(file, header, tw)
+}
+
+// writeContents copies the contents of a regular file to each tar writer after its header.
+func writeContents(file string, header *tar.Header, tws ...*tar.Writer) error {
+	if header.Typeflag != tar.TypeReg || len(tws) == 0 {
+		return nil
+	}
+	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+	ws := make([]io.Writer, len(tws))
+	for i, tw := range tws {
+		ws[i] = tw
+	}
+	_, err = io.Copy(io.MultiWriter(ws...), f)
+	return err
+}
 
+// walkHeaders calls fn with the tar header of each file beneath srcDir. Files are visited in lexical order so
+// that the same directory always produces the same tar. A regular file sharing an inode with a file visited
+// before it is given a hardlink header, and extended attributes are carried as PAX records.
+func walkHeaders(srcDir string, uid, gid int, modTime time.Time, include Filter, fn func(file string, fi os.FileInfo, header *tar.Header) error) error {
+	links := map[inode]string{}
 	return filepath.Walk(srcDir, func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if include != nil && !include(file, fi) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if fi.Mode()&os.ModeSocket != 0 {
 			return nil
 		}
@@ -56,94 +196,341 @@ func WriteTarArchive(w io.Writer, srcDir string, uid, gid int) error {
 			return err
 		}
 		header.Name = file
-		header.ModTime = time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC)
+		header.ModTime = modTime
 		header.Uid = uid
 		header.Gid = gid
 		header.Uname = ""
 		header.Gname = ""
 
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-		if fi.Mode().IsRegular() {
-			f, err := os.Open(file)
-			if err != nil {
-				return err
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && stat.Nlink > 1 {
+			id := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if first, ok := links[id]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[id] = file
 			}
-			defer f.Close()
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
+		}
+
+		xattrs, err := readXattrs(file)
+		if err != nil {
+			return errors.Wrapf(err, "reading xattrs of '%s'", file)
+		}
+		if len(xattrs) > 0 {
+			header.PAXRecords = map[string]string{}
+			for name, val := range xattrs {
+				header.PAXRecords[xattrPAXPrefix+name] = val
 			}
+			header.Format = tar.FormatPAX
 		}
-		return nil
+
+		return fn(file, fi, header)
 	})
 }
 
-func addParentDirs(tarDir string, tw *tar.Writer, uid, gid int) error {
+type inode struct {
+	dev, ino uint64
+}
+
+// ignoredXattrs are host specific and would make the same files produce different tars on different hosts.
+var ignoredXattrs = map[string]bool{
+	"security.selinux": true,
+}
+
+// readXattrs returns the extended attributes of file, without following symlinks. Filesystems without xattr
+// support are treated as having none.
+func readXattrs(file string) (map[string]string, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(file, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || ignoredXattrs[name] {
+			continue
+		}
+		val, err := getXattr(file, name)
+		if err == unix.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		xattrs[name] = val
+	}
+	return xattrs, nil
+}
+
+func getXattr(file, name string) (string, error) {
+	size, err := unix.Lgetxattr(file, name, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(file, name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+func addParentDirs(tarDir string, tw *tar.Writer, modTime time.Time) error {
+	headers, err := parentDirHeaders(tarDir, modTime)
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parentDirHeaders(tarDir string, modTime time.Time) ([]*tar.Header, error) {
 	parent := filepath.Dir(tarDir)
 	if parent == "." || parent == "/" {
-		return nil
+		return nil, nil
 	}
 
-	if err := addParentDirs(parent, tw, uid, gid); err != nil {
-		return err
+	headers, err := parentDirHeaders(parent, modTime)
+	if err != nil {
+		return nil, err
 	}
 
 	info, err := os.Stat(parent)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	header, err := tar.FileInfoHeader(info, parent)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	header.Name = parent
-	header.ModTime = time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC)
+	header.ModTime = modTime
+
+	return append(headers, header), nil
+}
 
-	return tw.WriteHeader(header)
+// UntarOptions select which attributes of tar entries are restored in addition to their contents and permissions.
+type UntarOptions struct {
+	PreserveOwnership bool
+	PreserveModTime   bool
+	PreserveXattrs    bool
 }
 
+const xattrPAXPrefix = "SCHILY.xattr."
+
 func Untar(r io.Reader, dest string) error {
-	tr := tar.NewReader(r)
+	return UntarWithOptions(r, dest, UntarOptions{})
+}
+
+// UntarWithOptions extracts the tar read from r into dest. Gzip and zstd compressed tars are detected and
+// decompressed. Entries that would be written outside of dest, directly or through an existing symlink, are
+// refused, and existing files are replaced rather than written through. Errors identify the entry that caused them.
+func UntarWithOptions(r io.Reader, dest string, opts UntarOptions) error {
+	rc, err := Decompress(r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	resolvedDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	u := &untarrer{dest: dest, resolvedDest: resolvedDest, opts: opts}
+
+	var dirs []*tar.Header
+	tr := tar.NewReader(rc)
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
-			return nil
+			break
 		}
 		if err != nil {
-			return err
+			return errors.Wrap(err, "reading tar")
 		}
 
-		path := filepath.Join(dest, hdr.Name)
+		if err := u.extract(tr, hdr); err != nil {
+			return errors.Wrapf(err, "extracting '%s'", hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
 
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(path, hdr.FileInfo().Mode()); err != nil {
-				return err
+	// directory modification times change as their contents are written, so they are restored last
+	if opts.PreserveModTime {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			path := filepath.Join(dest, dirs[i].Name)
+			if err := os.Chtimes(path, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+				return errors.Wrapf(err, "extracting '%s'", dirs[i].Name)
 			}
-		case tar.TypeReg, tar.TypeRegA:
-			_, err := os.Stat(filepath.Dir(path))
-			if os.IsNotExist(err) {
-				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
-					return err
-				}
-			}
-			if err := writeFile(tr, path, hdr.FileInfo().Mode()); err != nil {
-				return err
+		}
+	}
+	return nil
+}
+
+type untarrer struct {
+	dest, resolvedDest string
+	opts               UntarOptions
+}
+
+func (u *untarrer) extract(tr *tar.Reader, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+
+	path, err := u.securePath(hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		if err := removeNonDir(path); err != nil {
+			return err
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		if err := writeFile(tr, path, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := u.securePath(hdr.Linkname, false)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+		// the attributes belong to the target, which has already been extracted
+		return nil
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(path, uint32(mode.Perm())); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		devType := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			devType = unix.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(path, devType|uint32(mode.Perm()), dev); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown file type in tar %d", hdr.Typeflag)
+	}
+
+	return u.setAttributes(path, hdr)
+}
+
+func (u *untarrer) setAttributes(path string, hdr *tar.Header) error {
+	if u.opts.PreserveOwnership {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if u.opts.PreserveXattrs {
+		for key, val := range hdr.PAXRecords {
+			if !strings.HasPrefix(key, xattrPAXPrefix) {
+				continue
 			}
-		case tar.TypeSymlink:
-			if err := os.Symlink(hdr.Linkname, path); err != nil {
-				return err
+			if err := unix.Lsetxattr(path, strings.TrimPrefix(key, xattrPAXPrefix), []byte(val), 0); err != nil {
+				return errors.Wrapf(err, "setting xattr '%s'", strings.TrimPrefix(key, xattrPAXPrefix))
 			}
-		default:
-			return fmt.Errorf("unknown file type in tar %d", hdr.Typeflag)
 		}
 	}
+	// symlink times cannot be set without following the link, so they are left as created
+	if u.opts.PreserveModTime && hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// securePath returns the path name is extracted to. Both the path and, after resolving existing symlinks, the
+// directory it is written in must be inside the destination. When followLast is true the final element is
+// resolved too, as for directories that later entries are written into.
+func (u *untarrer) securePath(name string, followLast bool) (string, error) {
+	path := filepath.Join(u.dest, name)
+	if !within(u.dest, path) {
+		return "", fmt.Errorf("path '%s' escapes the destination '%s'", name, u.dest)
+	}
+
+	existing := path
+	if !followLast {
+		existing = filepath.Dir(path)
+	}
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if !within(u.resolvedDest, resolved) {
+		return "", fmt.Errorf("path '%s' escapes the destination '%s' through a symlink", name, u.dest)
+	}
+	return path, nil
+}
+
+func within(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeNonDir removes any existing file at path so that it is replaced rather than written through.
+func removeNonDir(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("'%s' is an existing directory", path)
+	}
+	return os.Remove(path)
 }
 
 func writeFile(in io.Reader, path string, mode os.FileMode) error {
-	fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
 	if err != nil {
 		return err
 	}
@@ -2,15 +2,18 @@ package archive_test
 
 import (
 	"archive/tar"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
+	"golang.org/x/sys/unix"
 
 	"github.com/buildpack/lifecycle/archive"
 	h "github.com/buildpack/lifecycle/testhelpers"
@@ -54,7 +57,7 @@ func testTar(t *testing.T, when spec.G, it spec.S) {
 		it("writes a tar with the src filesystem contents", func() {
 			src = filepath.Join("testdata", "dir-to-tar")
 
-			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid))
+			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid, archive.NormalizedDateTime))
 			h.AssertNil(t, file.Close())
 
 			file, err := os.Open(tarFile)
@@ -107,6 +110,146 @@ func testTar(t *testing.T, when spec.G, it spec.S) {
 			})
 		})
 
+		it("uses the given modification time for every entry", func() {
+			src = filepath.Join("testdata", "dir-to-tar")
+			modTime := time.Date(2019, time.August, 1, 12, 0, 0, 0, time.UTC)
+
+			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid, modTime))
+			h.AssertNil(t, file.Close())
+
+			file, err := os.Open(tarFile)
+			h.AssertNil(t, err)
+			defer file.Close()
+
+			tr := tar.NewReader(file)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				h.AssertNil(t, err)
+				if !header.ModTime.Equal(modTime) {
+					t.Fatalf("expected %s time to be %s, instead got: %s", header.Name, modTime, header.ModTime)
+				}
+			}
+		})
+
+		it("only writes the entries accepted by the filter", func() {
+			src = filepath.Join("testdata", "dir-to-tar")
+			include := func(file string, fi os.FileInfo) bool {
+				return file != filepath.Join(src, "sub-dir")
+			}
+
+			_, err := archive.WriteFilteredTarFile(src, tarFile, uid, gid, archive.NormalizedDateTime, include)
+			h.AssertNil(t, err)
+
+			file, err := os.Open(tarFile)
+			h.AssertNil(t, err)
+			defer file.Close()
+
+			var names []string
+			tr := tar.NewReader(file)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				h.AssertNil(t, err)
+				names = append(names, header.Name)
+			}
+			h.AssertEq(t, names, []string{"testdata", "testdata/dir-to-tar", "testdata/dir-to-tar/some-file.txt"})
+		})
+
+		it("streams the tar and returns its digest", func() {
+			src = filepath.Join("testdata", "dir-to-tar")
+
+			sha, err := archive.WriteLayer(file, src, uid, gid, archive.NormalizedDateTime, nil)
+			h.AssertNil(t, err)
+			h.AssertNil(t, file.Close())
+
+			h.AssertEq(t, sha, "sha256:"+h.ComputeSHA256ForFile(t, tarFile))
+		})
+
+		it("writes a relocatable tar with names relative to the src directory", func() {
+			src = filepath.Join("testdata", "dir-to-tar")
+
+			_, err := archive.WriteRelativeLayer(file, src, uid, gid, archive.NormalizedDateTime)
+			h.AssertNil(t, err)
+			h.AssertNil(t, file.Close())
+
+			headers := readHeaders(t, tarFile)
+			var names []string
+			for name := range headers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			h.AssertEq(t, names, []string{"some-file.txt", "sub-dir", "sub-dir/link-file"})
+		})
+
+		it("returns the digest of the absolute tar along with the relative tar", func() {
+			src = filepath.Join(tmpDir, "layer")
+			h.AssertNil(t, os.Mkdir(src, 0755))
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(src, "a-file"), []byte("some-contents"), 0644))
+			h.AssertNil(t, os.Link(filepath.Join(src, "a-file"), filepath.Join(src, "b-link")))
+
+			sha, absSHA, err := archive.WriteRelativeLayerAndDigest(file, src, uid, gid, archive.NormalizedDateTime)
+			h.AssertNil(t, err)
+			h.AssertNil(t, file.Close())
+
+			h.AssertEq(t, sha, "sha256:"+h.ComputeSHA256ForFile(t, tarFile))
+			relSHA, err := archive.WriteRelativeLayer(ioutil.Discard, src, uid, gid, archive.NormalizedDateTime)
+			h.AssertNil(t, err)
+			h.AssertEq(t, sha, relSHA)
+			expected, err := archive.WriteLayer(ioutil.Discard, src, uid, gid, archive.NormalizedDateTime, nil)
+			h.AssertNil(t, err)
+			h.AssertEq(t, absSHA, expected)
+		})
+
+		it("writes hardlinks for files sharing an inode", func() {
+			src = filepath.Join(tmpDir, "hardlinks")
+			h.AssertNil(t, os.Mkdir(src, 0755))
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(src, "a-file"), []byte("some-contents"), 0644))
+			h.AssertNil(t, os.Link(filepath.Join(src, "a-file"), filepath.Join(src, "b-link")))
+
+			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid, archive.NormalizedDateTime))
+			h.AssertNil(t, file.Close())
+
+			headers := readHeaders(t, tarFile)
+			link := headers[filepath.Join(src, "b-link")]
+			h.AssertEq(t, link.Typeflag, byte(tar.TypeLink))
+			h.AssertEq(t, link.Linkname, filepath.Join(src, "a-file"))
+			h.AssertEq(t, link.Size, int64(0))
+			h.AssertEq(t, headers[filepath.Join(src, "a-file")].Typeflag, byte(tar.TypeReg))
+		})
+
+		it("writes xattrs as PAX records", func() {
+			src = filepath.Join(tmpDir, "xattrs")
+			h.AssertNil(t, os.Mkdir(src, 0755))
+			path := filepath.Join(src, "some-file")
+			h.AssertNil(t, ioutil.WriteFile(path, []byte("some-contents"), 0644))
+			if err := unix.Lsetxattr(path, "user.some-attr", []byte("some-value"), 0); err == unix.ENOTSUP {
+				t.Skip("xattrs are not supported by the filesystem")
+			} else {
+				h.AssertNil(t, err)
+			}
+
+			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid, archive.NormalizedDateTime))
+			h.AssertNil(t, file.Close())
+
+			header := readHeaders(t, tarFile)[path]
+			h.AssertEq(t, header.PAXRecords["SCHILY.xattr.user.some-attr"], "some-value")
+		})
+
+		it("writes the same tar for the same directory", func() {
+			src = filepath.Join("testdata", "dir-to-tar")
+
+			sha1, err := archive.WriteTarFile(src, filepath.Join(tmpDir, "first.tar"), uid, gid, archive.NormalizedDateTime)
+			h.AssertNil(t, err)
+			sha2, err := archive.WriteTarFile(src, filepath.Join(tmpDir, "second.tar"), uid, gid, archive.NormalizedDateTime)
+			h.AssertNil(t, err)
+			h.AssertEq(t, sha1, sha2)
+		})
+
 		when("a absolute path is given", func() {
 			it("has working test helpers", func() {
 				h.AssertEq(t, allParentDirectories("/some/absolute/directory"), []string{"/some", "/some/absolute"})
@@ -116,7 +259,7 @@ func testTar(t *testing.T, when spec.G, it spec.S) {
 				absoluteFilePath, err := filepath.Abs(filepath.Join("testdata", "dir-to-tar"))
 				h.AssertNil(t, err)
 
-				h.AssertNil(t, archive.WriteTarArchive(file, absoluteFilePath, uid, gid))
+				h.AssertNil(t, archive.WriteTarArchive(file, absoluteFilePath, uid, gid, archive.NormalizedDateTime))
 				h.AssertNil(t, file.Close())
 
 				file, err = os.Open(tarFile)
@@ -145,7 +288,7 @@ func testTar(t *testing.T, when spec.G, it spec.S) {
 			it("writes headers for all parent directories", func() {
 				relativePath := filepath.Join("testdata", "dir-to-tar", "sub-dir")
 
-				h.AssertNil(t, archive.WriteTarArchive(file, relativePath, uid, gid))
+				h.AssertNil(t, archive.WriteTarArchive(file, relativePath, uid, gid, archive.NormalizedDateTime))
 				h.AssertNil(t, file.Close())
 
 				file, err := os.Open(tarFile)
@@ -176,7 +319,7 @@ func testTar(t *testing.T, when spec.G, it spec.S) {
 			err = os.MkdirAll(src, 0764)
 			h.AssertNil(t, err)
 
-			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid))
+			h.AssertNil(t, archive.WriteTarArchive(file, src, uid, gid, archive.NormalizedDateTime))
 			h.AssertNil(t, file.Close())
 
 			file, err = os.Open(tarFile)
@@ -201,6 +344,24 @@ func testTar(t *testing.T, when spec.G, it spec.S) {
 	})
 }
 
+func readHeaders(t *testing.T, tarFile string) map[string]*tar.Header {
+	t.Helper()
+	f, err := os.Open(tarFile)
+	h.AssertNil(t, err)
+	defer f.Close()
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		h.AssertNil(t, err)
+		headers[header.Name] = header
+	}
+}
+
 func tarContains(t *testing.T, m string, r func()) {
 	t.Helper()
 	t.Log(m)
@@ -223,7 +384,7 @@ func assertDirectory(t *testing.T, header *tar.Header) {
 
 func assertModTimeNormalized(t *testing.T, header *tar.Header) {
 	t.Helper()
-	if !header.ModTime.Equal(time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC)) {
+	if !header.ModTime.Equal(archive.NormalizedDateTime) {
 		t.Fatalf(`expected %s time to be normalized, instead got: %s`, header.Name, header.ModTime.String())
 	}
 }
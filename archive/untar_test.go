@@ -0,0 +1,236 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+	"golang.org/x/sys/unix"
+
+	"github.com/buildpack/lifecycle/archive"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestUntar(t *testing.T) {
+	spec.Run(t, "untar", testUntar, spec.Report(report.Terminal{}))
+}
+
+func testUntar(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir, dest string
+		modTime      = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "untar-test")
+		h.AssertNil(t, err)
+
+		dest = filepath.Join(tmpDir, "dest")
+		h.AssertNil(t, os.Mkdir(dest, 0755))
+	})
+
+	it.After(func() {
+		h.AssertNil(t, os.RemoveAll(tmpDir))
+	})
+
+	tarOf := func(headers ...*tar.Header) *bytes.Buffer {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, hdr := range headers {
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Size = int64(len(hdr.Linkname))
+			}
+			contents := hdr.Linkname
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Linkname = ""
+			}
+			if hdr.ModTime.IsZero() {
+				hdr.ModTime = modTime
+			}
+			h.AssertNil(t, tw.WriteHeader(hdr))
+			if hdr.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(contents))
+				h.AssertNil(t, err)
+			}
+		}
+		h.AssertNil(t, tw.Close())
+		return buf
+	}
+
+	// file returns the header of a regular file; the contents are carried in Linkname until written
+	file := func(name, contents string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Linkname: contents}
+	}
+
+	dir := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+	}
+
+	when("#Untar", func() {
+		it("extracts directories, files and symlinks", func() {
+			h.AssertNil(t, archive.Untar(tarOf(
+				dir("some-dir"),
+				file("some-dir/some-file", "some-contents"),
+				&tar.Header{Name: "some-dir/some-link", Typeflag: tar.TypeSymlink, Linkname: "some-file"},
+			), dest))
+
+			contents, err := ioutil.ReadFile(filepath.Join(dest, "some-dir", "some-link"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "some-contents")
+		})
+
+		it("refuses entries that escape the destination", func() {
+			err := archive.Untar(tarOf(file("../escaped-file", "some-contents")), dest)
+			h.AssertError(t, err, "extracting '../escaped-file': path '../escaped-file' escapes the destination")
+
+			if _, err := os.Stat(filepath.Join(tmpDir, "escaped-file")); !os.IsNotExist(err) {
+				t.Fatal("expected file outside the destination not to be written")
+			}
+		})
+
+		it("refuses entries that escape the destination through a symlink", func() {
+			outside := filepath.Join(tmpDir, "outside")
+			h.AssertNil(t, os.Mkdir(outside, 0755))
+
+			err := archive.Untar(tarOf(
+				&tar.Header{Name: "some-link", Typeflag: tar.TypeSymlink, Linkname: outside},
+				file("some-link/escaped-file", "some-contents"),
+			), dest)
+			h.AssertError(t, err, "extracting 'some-link/escaped-file': path 'some-link/escaped-file' escapes the destination")
+
+			if _, err := os.Stat(filepath.Join(outside, "escaped-file")); !os.IsNotExist(err) {
+				t.Fatal("expected file outside the destination not to be written")
+			}
+		})
+
+		it("allows symlinks to directories inside the destination", func() {
+			h.AssertNil(t, archive.Untar(tarOf(
+				dir("some-dir"),
+				&tar.Header{Name: "some-link", Typeflag: tar.TypeSymlink, Linkname: "some-dir"},
+				file("some-link/some-file", "some-contents"),
+			), dest))
+
+			contents, err := ioutil.ReadFile(filepath.Join(dest, "some-dir", "some-file"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "some-contents")
+		})
+
+		it("replaces existing symlinks instead of writing through them", func() {
+			outsideFile := filepath.Join(tmpDir, "outside-file")
+			h.AssertNil(t, ioutil.WriteFile(outsideFile, []byte("outside-contents"), 0644))
+			h.AssertNil(t, os.Symlink(outsideFile, filepath.Join(dest, "some-file")))
+
+			h.AssertNil(t, archive.Untar(tarOf(file("some-file", "some-contents")), dest))
+
+			contents, err := ioutil.ReadFile(outsideFile)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "outside-contents")
+
+			fi, err := os.Lstat(filepath.Join(dest, "some-file"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, fi.Mode().IsRegular(), true)
+		})
+
+		it("extracts hardlinks", func() {
+			h.AssertNil(t, archive.Untar(tarOf(
+				file("some-file", "some-contents"),
+				&tar.Header{Name: "some-hardlink", Typeflag: tar.TypeLink, Linkname: "some-file"},
+			), dest))
+
+			fi1, err := os.Stat(filepath.Join(dest, "some-file"))
+			h.AssertNil(t, err)
+			fi2, err := os.Stat(filepath.Join(dest, "some-hardlink"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, os.SameFile(fi1, fi2), true)
+		})
+
+		it("refuses hardlinks to files outside the destination", func() {
+			outsideFile := filepath.Join(tmpDir, "outside-file")
+			h.AssertNil(t, ioutil.WriteFile(outsideFile, []byte("outside-contents"), 0644))
+
+			err := archive.Untar(tarOf(
+				&tar.Header{Name: "some-hardlink", Typeflag: tar.TypeLink, Linkname: "../outside-file"},
+			), dest)
+			h.AssertError(t, err, "extracting 'some-hardlink': path '../outside-file' escapes the destination")
+		})
+
+		it("extracts named pipes", func() {
+			h.AssertNil(t, archive.Untar(tarOf(
+				&tar.Header{Name: "some-fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+			), dest))
+
+			fi, err := os.Lstat(filepath.Join(dest, "some-fifo"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, fi.Mode()&os.ModeNamedPipe != 0, true)
+		})
+
+		it("reports the entry that failed", func() {
+			h.AssertNil(t, os.MkdirAll(filepath.Join(dest, "some-dir", "child"), 0755))
+
+			err := archive.Untar(tarOf(file("some-dir", "some-contents")), dest)
+			h.AssertError(t, err, "extracting 'some-dir'")
+		})
+	})
+
+	when("#UntarWithOptions", func() {
+		it("preserves modification times", func() {
+			h.AssertNil(t, archive.UntarWithOptions(tarOf(
+				dir("some-dir"),
+				file("some-dir/some-file", "some-contents"),
+			), dest, archive.UntarOptions{PreserveModTime: true}))
+
+			for _, path := range []string{"some-dir", "some-dir/some-file"} {
+				fi, err := os.Stat(filepath.Join(dest, path))
+				h.AssertNil(t, err)
+				h.AssertEq(t, fi.ModTime().UTC(), modTime)
+			}
+		})
+
+		it("preserves ownership", func() {
+			hdr := file("some-file", "some-contents")
+			hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+
+			h.AssertNil(t, archive.UntarWithOptions(tarOf(hdr), dest, archive.UntarOptions{PreserveOwnership: true}))
+
+			h.AssertUidGid(t, filepath.Join(dest, "some-file"), os.Getuid(), os.Getgid())
+		})
+
+		it("preserves xattrs", func() {
+			hdr := file("some-file", "some-contents")
+			hdr.PAXRecords = map[string]string{"SCHILY.xattr.user.some-attr": "some-value"}
+
+			err := archive.UntarWithOptions(tarOf(hdr), dest, archive.UntarOptions{PreserveXattrs: true})
+			if errno, ok := cause(err).(syscall.Errno); ok && errno == syscall.ENOTSUP {
+				t.Skip("xattrs are not supported by the filesystem")
+			}
+			h.AssertNil(t, err)
+
+			buf := make([]byte, 64)
+			n, err := unix.Lgetxattr(filepath.Join(dest, "some-file"), "user.some-attr", buf)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(buf[:n]), "some-value")
+		})
+	})
+}
+
+func cause(err error) error {
+	type causer interface {
+		Cause() error
+	}
+	for {
+		c, ok := err.(causer)
+		if !ok {
+			return err
+		}
+		err = c.Cause()
+	}
+}
@@ -38,6 +38,7 @@ type Process struct {
 
 type LaunchTOML struct {
 	Processes []Process `toml:"processes"`
+	Slices    []Slice   `toml:"slices"`
 }
 
 type BOMEntry struct {
@@ -49,6 +50,7 @@ type BuildMetadata struct {
 	Processes  []Process   `toml:"processes"`
 	Buildpacks []Buildpack `toml:"buildpacks"`
 	BOM        []BOMEntry  `toml:"bom"`
+	Slices     []Slice     `toml:"slices"`
 }
 
 type buildpackPlan struct {
@@ -77,6 +79,7 @@ func (b *Builder) Build() (*BuildMetadata, error) {
 	procMap := processMap{}
 	plan := b.Plan
 	var bom []BOMEntry
+	var slices []Slice
 	for _, bp := range b.Group.Group {
 		bpInfo, err := bp.lookup(b.BuildpacksDir)
 		if err != nil {
@@ -130,12 +133,14 @@ func (b *Builder) Build() (*BuildMetadata, error) {
 			return nil, err
 		}
 		procMap.add(launch.Processes)
+		slices = append(slices, launch.Slices...)
 	}
 
 	return &BuildMetadata{
 		Processes:  procMap.list(),
 		Buildpacks: b.Group.Group,
 		BOM:        bom,
+		Slices:     slices,
 	}, nil
 }
 
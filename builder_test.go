@@ -168,6 +168,23 @@ func testBuilder(t *testing.T, when spec.G, it spec.S) {
 				}
 			})
 
+			it("should return slices declared in launch.toml", func() {
+				mkfile(t,
+					`[[slices]]`+"\n"+
+						`paths = ["vendor", "*.jar"]`+"\n",
+					filepath.Join(appDir, "launch-A-v1.toml"),
+				)
+				metadata, err := builder.Build()
+				if err != nil {
+					t.Fatalf("Unexpected error:\n%s\n", err)
+				}
+				if s := cmp.Diff(metadata.Slices, []lifecycle.Slice{
+					{Paths: []string{"vendor", "*.jar"}},
+				}); s != "" {
+					t.Fatalf("Unexpected slices:\n%s\n", s)
+				}
+			})
+
 			it("should return build metadata when processes are not present", func() {
 				metadata, err := builder.Build()
 				if err != nil {
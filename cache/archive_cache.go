@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const archiveMetadataPath = "metadata.json"
+
+var errCacheReadOnly = errors.New("cache is read-only")
+
+// ArchiveCache is a read-only cache stored in a single tar file, as written by WriteArchive. The archive holds
+// the metadata of the cache in 'metadata.json' and each layer once under 'blobs/<algorithm>/<hex>'.
+type ArchiveCache struct {
+	path     string
+	metadata Metadata
+	layers   map[string]archiveEntry
+}
+
+// archiveEntry locates the contents of a layer within the archive.
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+// NewArchiveCache indexes the archive at path. Layers are read from the archive as they are retrieved.
+func NewArchiveCache(path string) (*ArchiveCache, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening cache archive")
+	}
+	defer file.Close()
+
+	c := &ArchiveCache{path: path, layers: map[string]archiveEntry{}}
+	cr := &countingReader{r: file}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "reading cache archive '%s'", path)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(hdr.Name)), "/")
+		switch {
+		case name == archiveMetadataPath:
+			if json.NewDecoder(tr).Decode(&c.metadata) != nil {
+				c.metadata = Metadata{}
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			sha := strings.Replace(strings.TrimPrefix(name, "blobs/"), "/", ":", 1)
+			c.layers[sha] = archiveEntry{offset: cr.n, size: hdr.Size}
+		}
+	}
+	return c, nil
+}
+
+func (c *ArchiveCache) Name() string {
+	return c.path
+}
+
+func (c *ArchiveCache) RetrieveMetadata() (Metadata, error) {
+	return c.metadata, nil
+}
+
+// RetrieveLayer returns the contents of the layer. Reading a layer whose contents do not match its SHA fails
+// with a CorruptLayerError.
+func (c *ArchiveCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
+	entry, ok := c.layers[sha]
+	if !ok {
+		return nil, errors.Errorf("layer with SHA '%s' not found in cache archive", sha)
+	}
+	file, err := os.Open(c.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening cache archive")
+	}
+	rc := struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, entry.offset, entry.size), file}
+	return newVerifyingReader(rc, sha, nil), nil
+}
+
+func (c *ArchiveCache) SetMetadata(metadata Metadata) error {
+	return errCacheReadOnly
+}
+
+func (c *ArchiveCache) NewLayerWriter() (LayerWriter, error) {
+	return nil, errCacheReadOnly
+}
+
+func (c *ArchiveCache) ReuseLayer(sha string) error {
+	return errCacheReadOnly
+}
+
+func (c *ArchiveCache) Commit() error {
+	return errCacheReadOnly
+}
+
+// WriteArchive writes the metadata and layers committed to a cache to a tar file at path that can be read
+// by NewArchiveCache. The file is replaced only once the archive is complete.
+func WriteArchive(path string, source ReadableCache) error {
+	meta, err := source.RetrieveMetadata()
+	if err != nil {
+		return errors.Wrap(err, "retrieving cache metadata")
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "serializing metadata")
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "creating cache archive")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	if err := tw.WriteHeader(&tar.Header{Name: archiveMetadataPath, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return errors.Wrap(err, "writing metadata to cache archive")
+	}
+	if _, err := tw.Write(data); err != nil {
+		return errors.Wrap(err, "writing metadata to cache archive")
+	}
+	for _, sha := range layerSHAs(meta) {
+		if err := writeArchiveLayer(tw, filepath.Dir(path), source, sha); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "writing cache archive")
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "writing cache archive")
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return errors.Wrap(err, "writing cache archive")
+	}
+	return nil
+}
+
+// writeArchiveLayer adds a layer to the archive. Headers record the size of their contents, which caches do
+// not provide, so the layer is spooled to a temporary file in dir first.
+func writeArchiveLayer(tw *tar.Writer, dir string, source ReadableCache, sha string) error {
+	rc, err := source.RetrieveLayer(sha)
+	if err != nil {
+		return errors.Wrapf(err, "retrieving layer with SHA '%s' from cache '%s'", sha, source.Name())
+	}
+	defer rc.Close()
+
+	spool, err := ioutil.TempFile(dir, "layer-*.tar")
+	if err != nil {
+		return errors.Wrap(err, "creating layer file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, rc)
+	if err != nil {
+		return errors.Wrapf(err, "retrieving layer with SHA '%s' from cache '%s'", sha, source.Name())
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "reading layer file (layer sha: %s)", sha)
+	}
+	name := "blobs/" + strings.Replace(sha, ":", "/", 1)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size}); err != nil {
+		return errors.Wrapf(err, "writing layer to cache archive (layer sha: %s)", sha)
+	}
+	if _, err := io.Copy(tw, spool); err != nil {
+		return errors.Wrapf(err, "writing layer to cache archive (layer sha: %s)", sha)
+	}
+	return nil
+}
+
+// layerSHAs returns the distinct SHAs of the layers in meta, sorted so that archives are reproducible.
+func layerSHAs(meta Metadata) []string {
+	seen := map[string]bool{}
+	var shas []string
+	for _, bp := range meta.Buildpacks {
+		for _, layer := range bp.Layers {
+			if layer.SHA == "" || seen[layer.SHA] {
+				continue
+			}
+			seen[layer.SHA] = true
+			shas = append(shas, layer.SHA)
+		}
+	}
+	sort.Strings(shas)
+	return shas
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,191 @@
+package cache_test
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/archive"
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestArchiveCache(t *testing.T) {
+	spec.Run(t, "ArchiveCache", testArchiveCache, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testArchiveCache(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir      string
+		archivePath string
+		shas        []string
+	)
+
+	layerSHA := func(data string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	}
+
+	readLayer := func(c *cache.ArchiveCache, sha string) (string, error) {
+		t.Helper()
+		rc, err := c.RetrieveLayer(sha)
+		h.AssertNil(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		return string(data), err
+	}
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "lifecycle.cache.archive_cache")
+		h.AssertNil(t, err)
+		archivePath = filepath.Join(tmpDir, "cache.tar")
+
+		volumeDir := filepath.Join(tmpDir, "volume")
+		h.AssertNil(t, os.Mkdir(volumeDir, 0755))
+		volumeCache, err := cache.NewVolumeCache(volumeDir, cache.WithCompression(archive.CompressionGzip))
+		h.AssertNil(t, err)
+
+		shas = nil
+		for _, data := range []string{"first-layer", "second-layer"} {
+			w, err := volumeCache.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte(data))
+			h.AssertNil(t, err)
+			h.AssertNil(t, w.Commit(layerSHA(data)))
+			shas = append(shas, layerSHA(data))
+		}
+		h.AssertNil(t, volumeCache.SetMetadata(cache.Metadata{
+			StackID: "some.stack.id",
+			Buildpacks: []metadata.BuildpackLayersMetadata{
+				{
+					ID: "buildpack.a",
+					Layers: map[string]metadata.BuildpackLayerMetadata{
+						"first":  {LayerMetadata: metadata.LayerMetadata{SHA: shas[0]}},
+						"second": {LayerMetadata: metadata.LayerMetadata{SHA: shas[1]}},
+					},
+				},
+				{
+					ID: "buildpack.b",
+					Layers: map[string]metadata.BuildpackLayerMetadata{
+						"shared": {LayerMetadata: metadata.LayerMetadata{SHA: shas[0]}},
+					},
+				},
+			},
+		}))
+		h.AssertNil(t, volumeCache.Commit())
+
+		committed, err := cache.NewVolumeCache(volumeDir)
+		h.AssertNil(t, err)
+		h.AssertNil(t, cache.WriteArchive(archivePath, committed))
+	})
+
+	it.After(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	when("#WriteArchive", func() {
+		it("writes the metadata and each layer once", func() {
+			file, err := os.Open(archivePath)
+			h.AssertNil(t, err)
+			defer file.Close()
+
+			var names []string
+			tr := tar.NewReader(file)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				h.AssertNil(t, err)
+				names = append(names, hdr.Name)
+			}
+			h.AssertEq(t, len(names), 3)
+			h.AssertEq(t, names[0], "metadata.json")
+			h.AssertContains(t, names, "blobs/sha256/"+shas[0][len("sha256:"):], "blobs/sha256/"+shas[1][len("sha256:"):])
+		})
+
+		it("leaves no temporary files next to the archive", func() {
+			files, err := ioutil.ReadDir(tmpDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(files), 2)
+		})
+	})
+
+	when("#NewArchiveCache", func() {
+		it("fails when the archive does not exist", func() {
+			_, err := cache.NewArchiveCache(filepath.Join(tmpDir, "does-not-exist.tar"))
+			h.AssertError(t, err, "opening cache archive")
+		})
+	})
+
+	when("#RetrieveMetadata", func() {
+		it("returns the metadata of the archived cache", func() {
+			subject, err := cache.NewArchiveCache(archivePath)
+			h.AssertNil(t, err)
+
+			meta, err := subject.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.StackID, "some.stack.id")
+			h.AssertEq(t, meta.MetadataForBuildpack("buildpack.b").Layers["shared"].SHA, shas[0])
+		})
+	})
+
+	when("#RetrieveLayer", func() {
+		it("returns the uncompressed layer", func() {
+			subject, err := cache.NewArchiveCache(archivePath)
+			h.AssertNil(t, err)
+
+			for i, expected := range []string{"first-layer", "second-layer"} {
+				data, err := readLayer(subject, shas[i])
+				h.AssertNil(t, err)
+				h.AssertEq(t, data, expected)
+			}
+		})
+
+		it("fails when the layer is not in the archive", func() {
+			subject, err := cache.NewArchiveCache(archivePath)
+			h.AssertNil(t, err)
+
+			_, err = subject.RetrieveLayer(layerSHA("other-layer"))
+			h.AssertError(t, err, "not found in cache archive")
+		})
+
+		it("fails reading a layer that does not match its SHA", func() {
+			file, err := os.Create(archivePath)
+			h.AssertNil(t, err)
+			tw := tar.NewWriter(file)
+			h.AssertNil(t, tw.WriteHeader(&tar.Header{Name: "blobs/sha256/" + shas[0][len("sha256:"):], Mode: 0644, Size: 10}))
+			_, err = tw.Write([]byte("other-data"))
+			h.AssertNil(t, err)
+			h.AssertNil(t, tw.Close())
+			h.AssertNil(t, file.Close())
+
+			subject, err := cache.NewArchiveCache(archivePath)
+			h.AssertNil(t, err)
+			_, err = readLayer(subject, shas[0])
+			h.AssertEq(t, cache.IsCorruptLayer(err), true)
+		})
+	})
+
+	when("the cache is modified", func() {
+		it("fails because it is read-only", func() {
+			subject, err := cache.NewArchiveCache(archivePath)
+			h.AssertNil(t, err)
+
+			h.AssertError(t, subject.SetMetadata(cache.Metadata{}), "cache is read-only")
+			h.AssertError(t, subject.ReuseLayer(shas[0]), "cache is read-only")
+			_, err = subject.NewLayerWriter()
+			h.AssertError(t, err, "cache is read-only")
+			h.AssertError(t, subject.Commit(), "cache is read-only")
+		})
+	})
+}
@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// BucketCredentials sign requests to a bucket with AWS Signature Version 4. Requests are sent unsigned when
+// AccessKeyID is empty.
+type BucketCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// bucketClient reads and writes the objects of an S3-compatible bucket using path-style requests.
+type bucketClient struct {
+	endpoint    *url.URL
+	bucket      string
+	region      string
+	credentials BucketCredentials
+	client      *http.Client
+	now         func() time.Time
+}
+
+// newBucketHTTPClient returns a client that gives up on connections and responses that stall. It sets no
+// overall timeout, since uploading or downloading a large layer may take arbitrarily long.
+func newBucketHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+		},
+	}
+}
+
+type bucketError struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *bucketError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func isBucketNotFound(err error) bool {
+	bErr, ok := errors.Cause(err).(*bucketError)
+	return ok && bErr.StatusCode == http.StatusNotFound
+}
+
+// isBucketConflict reports whether a conditional write failed because the object was changed by another writer.
+func isBucketConflict(err error) bool {
+	bErr, ok := errors.Cause(err).(*bucketError)
+	return ok && (bErr.StatusCode == http.StatusPreconditionFailed || bErr.StatusCode == http.StatusConflict)
+}
+
+// get returns the contents of the object with key. Closing the returned reader is the responsibility of the caller.
+func (b *bucketClient) get(key string) (io.ReadCloser, error) {
+	rc, _, err := b.getWithETag(key)
+	return rc, err
+}
+
+// getWithETag is like get but also returns the ETag of the object, for a later conditional put.
+func (b *bucketClient) getWithETag(key string) (io.ReadCloser, string, error) {
+	resp, err := b.do(http.MethodGet, key, nil, 0, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("ETag"), nil
+}
+
+func (b *bucketClient) head(key string) error {
+	resp, err := b.do(http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *bucketClient) put(key string, body io.Reader, size int64) error {
+	resp, err := b.do(http.MethodPut, key, body, size, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// putIfMatch is like put but fails with a conflict unless the object still has etag, or does not exist
+// when etag is empty.
+func (b *bucketClient) putIfMatch(key string, body io.Reader, size int64, etag string) error {
+	header := http.Header{}
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+	resp, err := b.do(http.MethodPut, key, body, size, header)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *bucketClient) delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a signed request for the object with key. The conditional headers in header are not signed.
+func (b *bucketClient) do(method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket + "/" + key
+	u.RawPath = escapePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s '%s'", method, key)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = unsignedPayload
+	}
+	b.sign(req, payloadHash)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s '%s'", method, key)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		bErr := &bucketError{StatusCode: resp.StatusCode}
+		if data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil {
+			xml.Unmarshal(data, bErr)
+		}
+		return nil, errors.Wrapf(bErr, "%s '%s'", method, key)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req, covering its host and all of its headers.
+func (b *bucketClient) sign(req *http.Request, payloadHash string) {
+	if b.credentials.AccessKeyID == "" {
+		return
+	}
+	now := b.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if b.credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // requests to the bucket have no query
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format("20060102"), b.region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + b.credentials.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.credentials.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// escapePath percent-encodes every byte of path except unreserved characters and slashes, as required by
+// Signature Version 4.
+func escapePath(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
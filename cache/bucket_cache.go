@@ -0,0 +1,313 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/archive"
+)
+
+const (
+	bucketMetadataKey    = "metadata.json"
+	bucketCommitAttempts = 5
+	defaultGracePeriod   = 24 * time.Hour
+)
+
+// BucketCache stores the cache in an S3-compatible bucket. Layers are stored once per SHA under
+// '<prefix>/blobs/', and the metadata of the cache is a single object that each commit replaces, so that
+// readers always see a complete cache. The metadata is replaced with a conditional put, so that a commit
+// racing another commit is retried against the metadata the other commit wrote.
+//
+// Layers that the replaced metadata referenced and the new metadata does not are only deleted once they have
+// been unreferenced for the grace period, since builds that started from the replaced metadata may still reuse
+// them, and are kept if the metadata committed by then references them again. A build that takes longer than
+// the grace period may find a reused layer deleted.
+type BucketCache struct {
+	committed   bool
+	name        string
+	prefix      string
+	client      *bucketClient
+	metadata    *Metadata
+	layers      map[string]bool
+	layerDir    string
+	gracePeriod time.Duration
+}
+
+// bucketMetadata is the object stored at metadata.json. It records when each layer that is no longer
+// referenced by the metadata was first found to be unreferenced.
+type bucketMetadata struct {
+	Metadata
+	UnreferencedLayers map[string]time.Time `json:"unreferencedLayers,omitempty"`
+}
+
+type BucketCacheOption func(c *BucketCache)
+
+// WithEndpoint sets the URL of the S3-compatible service. It defaults to the AWS S3 endpoint of the region.
+func WithEndpoint(endpoint *url.URL) BucketCacheOption {
+	return func(c *BucketCache) {
+		c.client.endpoint = endpoint
+	}
+}
+
+// WithRegion sets the region requests are signed for. It defaults to 'us-east-1'.
+func WithRegion(region string) BucketCacheOption {
+	return func(c *BucketCache) {
+		c.client.region = region
+	}
+}
+
+// WithGracePeriod sets how long layers stay in the bucket after they are no longer referenced. It defaults
+// to 24 hours.
+func WithGracePeriod(gracePeriod time.Duration) BucketCacheOption {
+	return func(c *BucketCache) {
+		c.gracePeriod = gracePeriod
+	}
+}
+
+func WithCredentials(credentials BucketCredentials) BucketCacheOption {
+	return func(c *BucketCache) {
+		c.client.credentials = credentials
+	}
+}
+
+func WithHTTPClient(client *http.Client) BucketCacheOption {
+	return func(c *BucketCache) {
+		c.client.client = client
+	}
+}
+
+// NewBucketCache returns a cache stored at bucketURL, of the form 's3://<bucket>[/<prefix>]'.
+func NewBucketCache(bucketURL string, ops ...BucketCacheOption) (*BucketCache, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing bucket URL '%s'", bucketURL)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, errors.Errorf("bucket URL '%s' must have the form 's3://<bucket>[/<prefix>]'", bucketURL)
+	}
+
+	c := &BucketCache{
+		name:   bucketURL,
+		prefix: strings.Trim(u.Path, "/"),
+		client: &bucketClient{
+			bucket: u.Host,
+			region: "us-east-1",
+			client: newBucketHTTPClient(),
+			now:    time.Now,
+		},
+		layers:      map[string]bool{},
+		gracePeriod: defaultGracePeriod,
+	}
+	for _, op := range ops {
+		op(c)
+	}
+	if c.client.endpoint == nil {
+		c.client.endpoint = &url.URL{Scheme: "https", Host: "s3." + c.client.region + ".amazonaws.com"}
+	}
+	return c, nil
+}
+
+func (c *BucketCache) Name() string {
+	return c.name
+}
+
+func (c *BucketCache) SetMetadata(metadata Metadata) error {
+	if c.committed {
+		return errCacheCommitted
+	}
+	c.metadata = &metadata
+	return nil
+}
+
+func (c *BucketCache) RetrieveMetadata() (Metadata, error) {
+	metadata, _, err := c.retrieveBucketMetadata()
+	return metadata.Metadata, err
+}
+
+// retrieveBucketMetadata returns the metadata object and its ETag. The ETag is empty when there is no metadata.
+func (c *BucketCache) retrieveBucketMetadata() (bucketMetadata, string, error) {
+	rc, etag, err := c.client.getWithETag(c.key(bucketMetadataKey))
+	if isBucketNotFound(err) {
+		return bucketMetadata{}, "", nil
+	} else if err != nil {
+		return bucketMetadata{}, "", errors.Wrap(err, "retrieving metadata")
+	}
+	defer rc.Close()
+
+	metadata := bucketMetadata{}
+	if json.NewDecoder(rc).Decode(&metadata) != nil {
+		return bucketMetadata{}, etag, nil
+	}
+	return metadata, etag, nil
+}
+
+// NewLayerWriter returns a writer that uploads a layer to the bucket once it is committed.
+func (c *BucketCache) NewLayerWriter() (LayerWriter, error) {
+	if c.committed {
+		return nil, errCacheCommitted
+	}
+	if c.layerDir == "" {
+		dir, err := ioutil.TempDir("", "lifecycle.cache.layers")
+		if err != nil {
+			return nil, errors.Wrap(err, "create layer directory")
+		}
+		c.layerDir = dir
+	}
+	return newFileLayerWriter(c.layerDir, archive.CompressionNone, func(sha, path string) error {
+		defer os.Remove(path)
+		file, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "opening layer file (layer sha: %s)", sha)
+		}
+		defer file.Close()
+		fi, err := file.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "opening layer file (layer sha: %s)", sha)
+		}
+		if err := c.client.put(c.layerKey(sha), file, fi.Size()); err != nil {
+			return errors.Wrapf(err, "uploading layer (layer sha: %s)", sha)
+		}
+		c.layers[sha] = true
+		return nil
+	})
+}
+
+func (c *BucketCache) ReuseLayer(sha string) error {
+	if c.committed {
+		return errCacheCommitted
+	}
+	if err := c.client.head(c.layerKey(sha)); err != nil {
+		return errors.Wrapf(err, "reusing layer (%s)", sha)
+	}
+	c.layers[sha] = true
+	return nil
+}
+
+// RetrieveLayer returns the contents of the layer. Reading a layer whose contents do not match its SHA fails
+// with a CorruptLayerError.
+func (c *BucketCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
+	rc, err := c.client.get(c.layerKey(sha))
+	if err != nil {
+		return nil, errors.Wrapf(err, "retrieving layer with SHA '%s'", sha)
+	}
+	return newVerifyingReader(rc, sha, nil), nil
+}
+
+func (c *BucketCache) Commit() error {
+	if c.committed {
+		return errCacheCommitted
+	}
+	if c.layerDir != "" {
+		defer os.RemoveAll(c.layerDir)
+	}
+
+	metadata := Metadata{}
+	if c.metadata != nil {
+		metadata = *c.metadata
+	}
+	var expired []string
+	for attempt := 1; ; attempt++ {
+		previous, etag, err := c.retrieveBucketMetadata()
+		if err != nil {
+			return err
+		}
+		var next bucketMetadata
+		next, expired = c.nextMetadata(metadata, previous)
+		data, err := json.Marshal(next)
+		if err != nil {
+			return errors.Wrap(err, "serializing metadata")
+		}
+		err = c.client.putIfMatch(c.key(bucketMetadataKey), bytes.NewReader(data), int64(len(data)), etag)
+		if isBucketConflict(err) && attempt < bucketCommitAttempts {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "committing metadata")
+		}
+		break
+	}
+	c.committed = true
+
+	if len(expired) == 0 {
+		return nil
+	}
+	// a build that reused an expired layer may have committed metadata referencing it since
+	current, _, err := c.retrieveBucketMetadata()
+	if err != nil {
+		return err
+	}
+	rereferenced := map[string]bool{}
+	for _, sha := range layerSHAs(current.Metadata) {
+		rereferenced[sha] = true
+	}
+	for _, sha := range expired {
+		if rereferenced[sha] {
+			continue
+		}
+		if err := c.client.delete(c.layerKey(sha)); err != nil && !isBucketNotFound(err) {
+			return errors.Wrapf(err, "deleting layer (%s)", sha)
+		}
+	}
+	return nil
+}
+
+// nextMetadata returns the metadata object that replaces previous, and the layers that have been unreferenced
+// for longer than the grace period and can be deleted.
+func (c *BucketCache) nextMetadata(metadata Metadata, previous bucketMetadata) (bucketMetadata, []string) {
+	now := c.client.now().UTC()
+	referenced := map[string]bool{}
+	for _, sha := range layerSHAs(metadata) {
+		referenced[sha] = true
+	}
+	unreferenced := map[string]time.Time{}
+	markUnreferenced := func(sha string, since time.Time) {
+		if _, ok := unreferenced[sha]; !ok && !referenced[sha] {
+			unreferenced[sha] = since
+		}
+	}
+	for sha, since := range previous.UnreferencedLayers {
+		markUnreferenced(sha, since)
+	}
+	for _, sha := range layerSHAs(previous.Metadata) {
+		markUnreferenced(sha, now)
+	}
+	for sha := range c.layers {
+		markUnreferenced(sha, now)
+	}
+
+	next := bucketMetadata{Metadata: metadata}
+	var expired []string
+	for sha, since := range unreferenced {
+		if now.Sub(since) >= c.gracePeriod {
+			expired = append(expired, sha)
+			continue
+		}
+		if next.UnreferencedLayers == nil {
+			next.UnreferencedLayers = map[string]time.Time{}
+		}
+		next.UnreferencedLayers[sha] = since
+	}
+	sort.Strings(expired)
+	return next, expired
+}
+
+func (c *BucketCache) key(name string) string {
+	if c.prefix == "" {
+		return name
+	}
+	return c.prefix + "/" + name
+}
+
+func (c *BucketCache) layerKey(sha string) string {
+	return c.key("blobs/" + strings.Replace(sha, ":", "/", 1))
+}
@@ -0,0 +1,392 @@
+package cache_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestBucketCache(t *testing.T) {
+	spec.Run(t, "BucketCache", testBucketCache, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+// fakeBucket is an in-memory stand-in for an S3-compatible service that stores the objects of any bucket.
+// beforePut and afterPut, if set, are called with the bucket locked before and after each put is handled.
+type fakeBucket struct {
+	sync.Mutex
+	objects       map[string][]byte
+	authorization []string
+	beforePut     func(key string)
+	afterPut      func(key string)
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	defer b.Unlock()
+	b.authorization = append(b.authorization, r.Header.Get("Authorization"))
+
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		if b.beforePut != nil {
+			b.beforePut(key)
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		existing, exists := b.objects[key]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || etag(existing) != match) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+			return
+		}
+		b.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+		if b.afterPut != nil {
+			b.afterPut(key)
+		}
+	case http.MethodGet, http.MethodHead:
+		data, ok := b.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *fakeBucket) keys() []string {
+	b.Lock()
+	defer b.Unlock()
+	var keys []string
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func testBucketCache(t *testing.T, when spec.G, it spec.S) {
+	var (
+		bucket   *fakeBucket
+		server   *httptest.Server
+		endpoint *url.URL
+		subject  *cache.BucketCache
+	)
+
+	layerSHA := func(data string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	}
+
+	newCache := func(ops ...cache.BucketCacheOption) *cache.BucketCache {
+		t.Helper()
+		c, err := cache.NewBucketCache(
+			"s3://some-bucket/some/prefix",
+			append([]cache.BucketCacheOption{
+				cache.WithEndpoint(endpoint),
+				cache.WithRegion("some-region"),
+				cache.WithCredentials(cache.BucketCredentials{AccessKeyID: "some-key-id", SecretAccessKey: "some-secret"}),
+				cache.WithHTTPClient(server.Client()),
+			}, ops...)...,
+		)
+		h.AssertNil(t, err)
+		return c
+	}
+
+	addLayer := func(c *cache.BucketCache, data string) string {
+		t.Helper()
+		w, err := c.NewLayerWriter()
+		h.AssertNil(t, err)
+		_, err = w.Write([]byte(data))
+		h.AssertNil(t, err)
+		sha := layerSHA(data)
+		h.AssertNil(t, w.Commit(sha))
+		return sha
+	}
+
+	metadataWith := func(shas ...string) cache.Metadata {
+		layers := map[string]metadata.BuildpackLayerMetadata{}
+		for i, sha := range shas {
+			layers[fmt.Sprintf("layer-%d", i)] = metadata.BuildpackLayerMetadata{
+				LayerMetadata: metadata.LayerMetadata{SHA: sha},
+			}
+		}
+		return cache.Metadata{
+			Buildpacks: []metadata.BuildpackLayersMetadata{{ID: "some.buildpack.id", Layers: layers}},
+		}
+	}
+
+	it.Before(func() {
+		bucket = &fakeBucket{objects: map[string][]byte{}}
+		server = httptest.NewServer(bucket)
+		var err error
+		endpoint, err = url.Parse(server.URL)
+		h.AssertNil(t, err)
+		subject = newCache()
+	})
+
+	it.After(func() {
+		server.Close()
+	})
+
+	when("#NewBucketCache", func() {
+		it("fails when the URL is not an s3 URL", func() {
+			_, err := cache.NewBucketCache("https://some-bucket/some/prefix")
+			h.AssertError(t, err, "must have the form 's3://<bucket>[/<prefix>]'")
+		})
+	})
+
+	when("#Name", func() {
+		it("returns the bucket URL", func() {
+			h.AssertEq(t, subject.Name(), "s3://some-bucket/some/prefix")
+		})
+	})
+
+	when("#RetrieveMetadata", func() {
+		it("returns empty metadata when nothing has been committed", func() {
+			meta, err := subject.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(meta.Buildpacks), 0)
+		})
+
+		it("returns an error when the service fails", func() {
+			server.Close()
+			_, err := subject.RetrieveMetadata()
+			h.AssertError(t, err, "retrieving metadata")
+		})
+	})
+
+	when("#Commit", func() {
+		it("stores the metadata and layers under the prefix", func() {
+			sha := addLayer(subject, "some-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(sha)))
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertContains(t, bucket.keys(),
+				"/some-bucket/some/prefix/metadata.json",
+				"/some-bucket/some/prefix/blobs/sha256/"+strings.TrimPrefix(sha, "sha256:"),
+			)
+
+			reader := newCache()
+			meta, err := reader.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.Buildpacks[0].Layers["layer-0"].SHA, sha)
+
+			rc, err := reader.RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			data, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(data), "some-layer")
+		})
+
+		it("does not change the committed metadata until the cache is committed", func() {
+			sha := addLayer(subject, "some-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(sha)))
+
+			meta, err := newCache().RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(meta.Buildpacks), 0)
+		})
+
+		assertRetrievable := func(shas ...string) {
+			t.Helper()
+			reader := newCache()
+			for _, sha := range shas {
+				rc, err := reader.RetrieveLayer(sha)
+				h.AssertNil(t, err)
+				rc.Close()
+			}
+		}
+
+		it("keeps layers that are no longer referenced for the grace period", func() {
+			oldSHA := addLayer(subject, "old-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(oldSHA)))
+			h.AssertNil(t, subject.Commit())
+
+			next := newCache()
+			newSHA := addLayer(next, "new-layer")
+			h.AssertNil(t, next.SetMetadata(metadataWith(newSHA)))
+			h.AssertNil(t, next.Commit())
+
+			assertRetrievable(oldSHA, newSHA)
+		})
+
+		it("keeps layers reused by a build that commits after another build stops referencing them", func() {
+			sharedSHA := addLayer(subject, "shared-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(sharedSHA)))
+			h.AssertNil(t, subject.Commit())
+
+			reusing := newCache(cache.WithGracePeriod(time.Hour))
+			replacing := newCache(cache.WithGracePeriod(time.Hour))
+			h.AssertNil(t, reusing.ReuseLayer(sharedSHA))
+			otherSHA := addLayer(replacing, "other-layer")
+			h.AssertNil(t, replacing.SetMetadata(metadataWith(otherSHA)))
+			h.AssertNil(t, replacing.Commit())
+			h.AssertNil(t, reusing.SetMetadata(metadataWith(sharedSHA)))
+			h.AssertNil(t, reusing.Commit())
+
+			assertRetrievable(sharedSHA, otherSHA)
+			meta, err := newCache().RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.Buildpacks[0].Layers["layer-0"].SHA, sharedSHA)
+
+			next := newCache(cache.WithGracePeriod(0))
+			h.AssertNil(t, next.ReuseLayer(sharedSHA))
+			h.AssertNil(t, next.SetMetadata(metadataWith(sharedSHA)))
+			h.AssertNil(t, next.Commit())
+
+			assertRetrievable(sharedSHA)
+			_, err = newCache().RetrieveLayer(otherSHA)
+			h.AssertError(t, err, "retrieving layer with SHA '"+otherSHA+"'")
+		})
+
+		it("retries against the metadata committed by a concurrent build", func() {
+			sha := addLayer(subject, "some-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(sha)))
+
+			concurrentSHA := layerSHA("concurrent-layer")
+			metadataKey := "/some-bucket/some/prefix/metadata.json"
+			bucket.beforePut = func(key string) {
+				if key != metadataKey {
+					return
+				}
+				bucket.beforePut = nil
+				bucket.objects["/some-bucket/some/prefix/blobs/sha256/"+strings.TrimPrefix(concurrentSHA, "sha256:")] = []byte("concurrent-layer")
+				data, err := json.Marshal(metadataWith(concurrentSHA))
+				h.AssertNil(t, err)
+				bucket.objects[metadataKey] = data
+			}
+			h.AssertNil(t, subject.Commit())
+
+			meta, err := newCache().RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.Buildpacks[0].Layers["layer-0"].SHA, sha)
+			bucket.Lock()
+			committed := string(bucket.objects[metadataKey])
+			bucket.Unlock()
+			h.AssertStringContains(t, committed, `"unreferencedLayers":{"`+concurrentSHA+`"`)
+		})
+
+		it("deletes layers that have been unreferenced for the grace period", func() {
+			oldSHA := addLayer(subject, "old-layer")
+			keptSHA := addLayer(subject, "kept-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(oldSHA, keptSHA)))
+			h.AssertNil(t, subject.Commit())
+
+			next := newCache(cache.WithGracePeriod(0))
+			h.AssertNil(t, next.ReuseLayer(keptSHA))
+			newSHA := addLayer(next, "new-layer")
+			h.AssertNil(t, next.SetMetadata(metadataWith(keptSHA, newSHA)))
+			h.AssertNil(t, next.Commit())
+
+			reader := newCache()
+			for _, sha := range []string{keptSHA, newSHA} {
+				rc, err := reader.RetrieveLayer(sha)
+				h.AssertNil(t, err)
+				rc.Close()
+			}
+			_, err := reader.RetrieveLayer(oldSHA)
+			h.AssertError(t, err, "retrieving layer with SHA '"+oldSHA+"'")
+		})
+
+		it("keeps expired layers that a concurrent build references again before they are deleted", func() {
+			oldSHA := addLayer(subject, "old-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(oldSHA)))
+			h.AssertNil(t, subject.Commit())
+
+			metadataKey := "/some-bucket/some/prefix/metadata.json"
+			bucket.afterPut = func(key string) {
+				if key != metadataKey {
+					return
+				}
+				bucket.afterPut = nil
+				data, err := json.Marshal(metadataWith(oldSHA))
+				h.AssertNil(t, err)
+				bucket.objects[metadataKey] = data
+			}
+			next := newCache(cache.WithGracePeriod(0))
+			newSHA := addLayer(next, "new-layer")
+			h.AssertNil(t, next.SetMetadata(metadataWith(newSHA)))
+			h.AssertNil(t, next.Commit())
+
+			assertRetrievable(oldSHA)
+		})
+
+		it("cannot be modified after commit", func() {
+			h.AssertNil(t, subject.Commit())
+			h.AssertError(t, subject.Commit(), "cache cannot be modified after commit")
+			h.AssertError(t, subject.SetMetadata(cache.Metadata{}), "cache cannot be modified after commit")
+			h.AssertError(t, subject.ReuseLayer("some-sha"), "cache cannot be modified after commit")
+			_, err := subject.NewLayerWriter()
+			h.AssertError(t, err, "cache cannot be modified after commit")
+		})
+
+		it("signs requests", func() {
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, len(bucket.authorization) > 0, true)
+			for _, auth := range bucket.authorization {
+				if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=some-key-id/") ||
+					!strings.Contains(auth, "/some-region/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+					t.Fatalf("unexpected authorization header: %s", auth)
+				}
+			}
+		})
+	})
+
+	when("#ReuseLayer", func() {
+		it("fails when the layer is not in the bucket", func() {
+			h.AssertError(t, subject.ReuseLayer(layerSHA("some-layer")), "status 404")
+		})
+	})
+
+	when("#RetrieveLayer", func() {
+		it("fails reading a layer that does not match its SHA", func() {
+			sha := addLayer(subject, "some-layer")
+			h.AssertNil(t, subject.SetMetadata(metadataWith(sha)))
+			h.AssertNil(t, subject.Commit())
+
+			key := "/some-bucket/some/prefix/blobs/sha256/" + strings.TrimPrefix(sha, "sha256:")
+			bucket.Lock()
+			bucket.objects[key] = []byte("other-data")
+			bucket.Unlock()
+
+			rc, err := newCache().RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			_, err = ioutil.ReadAll(rc)
+			h.AssertEq(t, cache.IsCorruptLayer(err), true)
+		})
+	})
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// accessTimesFile records when each layer of a VolumeCache was last added, reused or retrieved.
+const accessTimesFile = "access-times.json"
+
+// EvictionReport describes the layers removed from a size-bounded VolumeCache when it was committed.
+type EvictionReport struct {
+	MaxSize int64          `toml:"max-size"`
+	Size    int64          `toml:"size"`
+	Evicted []EvictedLayer `toml:"evicted"`
+}
+
+type EvictedLayer struct {
+	SHA      string    `toml:"sha"`
+	Size     int64     `toml:"size"`
+	LastUsed time.Time `toml:"last-used"`
+}
+
+// WithMaxSize bounds the total size of the layers in the cache. Layers that were not used by the build but are
+// still referenced by the cache metadata are kept from one commit to the next while they fit, and the least
+// recently used layers are evicted to stay within maxSize. A maxSize of zero leaves the cache unbounded, keeping
+// only the layers used by the build.
+func WithMaxSize(maxSize int64) VolumeCacheOption {
+	return func(c *VolumeCache) {
+		c.maxSize = maxSize
+	}
+}
+
+// WithUnreferencedLayers keeps the layers of a size-bounded cache that its metadata does not reference. It is
+// meant for caches whose layers are looked up by SHA alone, such as launch caches.
+func WithUnreferencedLayers() VolumeCacheOption {
+	return func(c *VolumeCache) {
+		c.keepUnreferenced = true
+	}
+}
+
+// EvictionReport returns the layers evicted by the last commit.
+func (c *VolumeCache) EvictionReport() EvictionReport {
+	return c.evictions
+}
+
+func (c *VolumeCache) touch(sha string) {
+	c.accessMu.Lock()
+	defer c.accessMu.Unlock()
+	c.accessTimes[sha] = time.Now()
+}
+
+func readAccessTimes(dir string) map[string]time.Time {
+	accessTimes := map[string]time.Time{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, accessTimesFile))
+	if err != nil {
+		return accessTimes
+	}
+	if json.Unmarshal(data, &accessTimes) != nil {
+		return map[string]time.Time{}
+	}
+	return accessTimes
+}
+
+// writeAccessTimes records the access times of the layers staged in the cache.
+func (c *VolumeCache) writeAccessTimes() error {
+	layers, err := c.stagedLayers()
+	if err != nil {
+		return err
+	}
+	accessTimes := map[string]time.Time{}
+	for _, l := range layers {
+		if t, ok := c.accessTimes[l.SHA]; ok {
+			accessTimes[l.SHA] = t
+		}
+	}
+	data, err := json.Marshal(accessTimes)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.stagingDir, accessTimesFile), data, 0666)
+}
+
+// evict carries the committed layers that were not used by the build but are still referenced into staging,
+// then removes the least recently used staged layers until the cache fits within its maximum size. Evicted
+// layers are dropped from the staged metadata. Committed layers that nothing references are left behind, so
+// that they are deleted with the committed directory.
+func (c *VolumeCache) evict() error {
+	metadata, err := c.stagedMetadata()
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, bp := range metadata.Buildpacks {
+		for _, layer := range bp.Layers {
+			referenced[layer.SHA] = true
+		}
+	}
+
+	committed, err := ioutil.ReadDir(c.committedDir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range committed {
+		if !strings.HasSuffix(fi.Name(), ".tar") {
+			continue
+		}
+		if !c.keepUnreferenced && !referenced[strings.TrimSuffix(fi.Name(), ".tar")] {
+			continue
+		}
+		staged := filepath.Join(c.stagingDir, fi.Name())
+		if _, err := os.Stat(staged); err == nil {
+			continue
+		}
+		if err := os.Link(filepath.Join(c.committedDir, fi.Name()), staged); err != nil {
+			return errors.Wrapf(err, "keeping layer '%s'", strings.TrimSuffix(fi.Name(), ".tar"))
+		}
+	}
+
+	layers, err := c.stagedLayers()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, l := range layers {
+		size += l.Size
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		if !layers[i].LastUsed.Equal(layers[j].LastUsed) {
+			return layers[i].LastUsed.Before(layers[j].LastUsed)
+		}
+		return layers[i].SHA < layers[j].SHA
+	})
+
+	report := EvictionReport{MaxSize: c.maxSize}
+	evicted := map[string]bool{}
+	for _, l := range layers {
+		if size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.stagingDir, l.SHA+".tar")); err != nil {
+			return errors.Wrapf(err, "evicting layer '%s'", l.SHA)
+		}
+		size -= l.Size
+		evicted[l.SHA] = true
+		report.Evicted = append(report.Evicted, l)
+	}
+	report.Size = size
+	c.evictions = report
+
+	if len(evicted) == 0 {
+		return nil
+	}
+	return c.removeFromStagedMetadata(evicted)
+}
+
+func (c *VolumeCache) stagedLayers() ([]EvictedLayer, error) {
+	fis, err := ioutil.ReadDir(c.stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	var layers []EvictedLayer
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".tar") {
+			continue
+		}
+		sha := strings.TrimSuffix(fi.Name(), ".tar")
+		layers = append(layers, EvictedLayer{SHA: sha, Size: fi.Size(), LastUsed: c.accessTimes[sha]})
+	}
+	return layers, nil
+}
+
+// stagedMetadata returns the metadata set by the build, which is empty if it set none.
+func (c *VolumeCache) stagedMetadata() (Metadata, error) {
+	var metadata Metadata
+	data, err := ioutil.ReadFile(filepath.Join(c.stagingDir, MetadataLabel))
+	if os.IsNotExist(err) {
+		return metadata, nil
+	} else if err != nil {
+		return metadata, err
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, errors.Wrap(err, "reading staged metadata")
+	}
+	return metadata, nil
+}
+
+func (c *VolumeCache) removeFromStagedMetadata(evicted map[string]bool) error {
+	metadata, err := c.stagedMetadata()
+	if err != nil {
+		return err
+	}
+	for _, bp := range metadata.Buildpacks {
+		for name, layer := range bp.Layers {
+			if evicted[layer.SHA] {
+				delete(bp.Layers, name)
+			}
+		}
+	}
+	return c.SetMetadata(metadata)
+}
@@ -0,0 +1,9 @@
+package cache
+
+// WithRename replaces the function that moves the directories of the cache, so that tests can fail each step
+// of committing and recovering commits.
+func WithRename(rename func(oldpath, newpath string) error) VolumeCacheOption {
+	return func(c *VolumeCache) {
+		c.rename = rename
+	}
+}
@@ -4,17 +4,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 
 	"github.com/buildpack/imgutil"
 	"github.com/pkg/errors"
 
+	"github.com/buildpack/lifecycle/archive"
 	"github.com/buildpack/lifecycle/metadata"
 )
 
+// cleaner is implemented by images that keep files on disk, such as layers exported from the Docker daemon.
+type cleaner interface {
+	Cleanup() error
+}
+
 type ImageCache struct {
 	committed bool
 	origImage imgutil.Image
 	newImage  imgutil.Image
+	layerDir  string
 }
 
 func NewImageCache(origImage imgutil.Image, newImage imgutil.Image) *ImageCache {
@@ -59,6 +68,24 @@ func (c *ImageCache) AddLayerFile(sha string, tarPath string) error {
 	return c.newImage.AddLayer(tarPath)
 }
 
+// NewLayerWriter returns a writer for a layer of the new cache image. Images read their layers when they are
+// saved, so written layers are kept in a temporary directory until the cache is committed.
+func (c *ImageCache) NewLayerWriter() (LayerWriter, error) {
+	if c.committed {
+		return nil, errCacheCommitted
+	}
+	if c.layerDir == "" {
+		dir, err := ioutil.TempDir("", "lifecycle.cache.layers")
+		if err != nil {
+			return nil, errors.Wrap(err, "create layer directory")
+		}
+		c.layerDir = dir
+	}
+	return newFileLayerWriter(c.layerDir, archive.CompressionNone, func(sha, path string) error {
+		return c.newImage.AddLayer(path)
+	})
+}
+
 func (c *ImageCache) ReuseLayer(sha string) error {
 	if c.committed {
 		return errCacheCommitted
@@ -66,14 +93,23 @@ func (c *ImageCache) ReuseLayer(sha string) error {
 	return c.newImage.ReuseLayer(sha)
 }
 
+// RetrieveLayer returns the contents of the layer. Reading a layer whose contents do not match its SHA fails
+// with a CorruptLayerError.
 func (c *ImageCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
-	return c.origImage.GetLayer(sha)
+	rc, err := c.origImage.GetLayer(sha)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingReader(rc, sha, nil), nil
 }
 
 func (c *ImageCache) Commit() error {
 	if c.committed {
 		return errCacheCommitted
 	}
+	if c.layerDir != "" {
+		defer os.RemoveAll(c.layerDir)
+	}
 
 	if err := c.newImage.Save(); err != nil {
 		return errors.Wrapf(err, "saving image '%s'", c.newImage.Name())
@@ -86,6 +122,22 @@ func (c *ImageCache) Commit() error {
 			fmt.Printf("Unable to delete previous cache image: %v", err)
 		}
 	}
+	cleanup(c.origImage)
 	c.origImage = c.newImage
 	return nil
 }
+
+// Cleanup removes the files the images of the cache keep on disk.
+func (c *ImageCache) Cleanup() error {
+	if err := cleanup(c.origImage); err != nil {
+		return err
+	}
+	return cleanup(c.newImage)
+}
+
+func cleanup(image imgutil.Image) error {
+	if c, ok := image.(cleaner); ok {
+		return c.Cleanup()
+	}
+	return nil
+}
@@ -134,6 +134,23 @@ func testImageCache(t *testing.T, when spec.G, it spec.S) {
 			})
 		})
 
+		when("layer does not match its SHA", func() {
+			it.Before(func() {
+				h.AssertNil(t, fakeOriginalImage.AddLayer(testLayerTarPath))
+				h.AssertNil(t, ioutil.WriteFile(testLayerTarPath, []byte("corrupt data"), 0666))
+			})
+
+			it("fails reading the layer", func() {
+				rc, err := subject.RetrieveLayer(testLayerSHA)
+				h.AssertNil(t, err)
+				defer rc.Close()
+
+				_, err = ioutil.ReadAll(rc)
+				h.AssertError(t, err, "cached layer with SHA '"+testLayerSHA+"' is corrupt")
+				h.AssertEq(t, cache.IsCorruptLayer(err), true)
+			})
+		})
+
 		when("layer does not exist", func() {
 			it("returns an error", func() {
 				_, err := subject.RetrieveLayer("some_nonexistent_sha")
@@ -142,6 +159,28 @@ func testImageCache(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
+	when("#Cleanup", func() {
+		it("cleans up the files both images keep on disk", func() {
+			orig := &cleanupCountingImage{Image: fakeOriginalImage}
+			newImage := &cleanupCountingImage{Image: fakeNewImage}
+			subject = cache.NewImageCache(orig, newImage)
+
+			h.AssertNil(t, subject.Cleanup())
+
+			h.AssertEq(t, orig.cleanups, 1)
+			h.AssertEq(t, newImage.cleanups, 1)
+		})
+
+		it("cleans up the original image once the cache is committed", func() {
+			orig := &cleanupCountingImage{Image: fakeOriginalImage}
+			subject = cache.NewImageCache(orig, fakeNewImage)
+
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, orig.cleanups, 1)
+		})
+	})
+
 	when("#Commit", func() {
 		when("with #SetMetadata", func() {
 			var newMetadata cache.Metadata
@@ -232,6 +271,37 @@ func testImageCache(t *testing.T, when spec.G, it spec.S) {
 
 		})
 
+		when("with #NewLayerWriter", func() {
+			when("write then commit", func() {
+				it("retrieve returns newly added layer", func() {
+					w, err := subject.NewLayerWriter()
+					h.AssertNil(t, err)
+					_, err = w.Write([]byte("dummy data"))
+					h.AssertNil(t, err)
+					h.AssertNil(t, w.Commit(testLayerSHA))
+
+					h.AssertNil(t, subject.Commit())
+
+					rc, err := subject.RetrieveLayer(testLayerSHA)
+					h.AssertNil(t, err)
+					defer rc.Close()
+
+					bytes, err := ioutil.ReadAll(rc)
+					h.AssertNil(t, err)
+					h.AssertEq(t, string(bytes), "dummy data")
+				})
+			})
+
+			when("write after commit", func() {
+				it("returns an error", func() {
+					h.AssertNil(t, subject.Commit())
+
+					_, err := subject.NewLayerWriter()
+					h.AssertError(t, err, "cache cannot be modified after commit")
+				})
+			})
+		})
+
 		when("with #ReuseLayer", func() {
 			it.Before(func() {
 				fakeNewImage.AddPreviousLayer(testLayerSHA, testLayerTarPath)
@@ -288,3 +358,14 @@ func testImageCache(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 }
+
+// cleanupCountingImage counts how many times the files it keeps on disk are cleaned up.
+type cleanupCountingImage struct {
+	*fakes.Image
+	cleanups int
+}
+
+func (i *cleanupCountingImage) Cleanup() error {
+	i.cleanups++
+	return nil
+}
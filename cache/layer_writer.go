@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/archive"
+)
+
+// LayerWriter receives the contents of a layer as it is produced. The digest of a layer is only known once it
+// has been written, so the layer is stored by Commit; Close discards a layer that was not committed.
+type LayerWriter interface {
+	io.Writer
+	Commit(sha string) error
+	Close() error
+}
+
+// fileLayerWriter writes a layer, compressed as requested, to a temporary file in dir and hands the file to
+// store once its digest is known.
+type fileLayerWriter struct {
+	file  *os.File
+	w     io.WriteCloser
+	store func(sha, path string) error
+	done  bool
+}
+
+func newFileLayerWriter(dir string, compression archive.Compression, store func(sha, path string) error) (*fileLayerWriter, error) {
+	file, err := ioutil.TempFile(dir, "layer-*.tar")
+	if err != nil {
+		return nil, errors.Wrap(err, "create layer file in cache")
+	}
+	w, err := archive.Compress(file, compression)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &fileLayerWriter{file: file, w: w, store: store}, nil
+}
+
+func (w *fileLayerWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *fileLayerWriter) Commit(sha string) error {
+	if w.done {
+		return errors.Errorf("layer (%s) has already been closed", sha)
+	}
+	w.done = true
+	if err := w.w.Close(); err != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		return errors.Wrapf(err, "compressing layer (layer sha: %s)", sha)
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return errors.Wrapf(err, "closing layer file (layer sha: %s)", sha)
+	}
+	if err := w.store(sha, w.file.Name()); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *fileLayerWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.w.Close()
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
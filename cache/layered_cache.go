@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/metadata"
+)
+
+// ReadableCache is a cache that layers can be restored from.
+type ReadableCache interface {
+	Name() string
+	RetrieveMetadata() (Metadata, error)
+	RetrieveLayer(sha string) (io.ReadCloser, error)
+}
+
+// WritableCache is a cache that layers can also be stored in.
+type WritableCache interface {
+	ReadableCache
+	SetMetadata(metadata Metadata) error
+	NewLayerWriter() (LayerWriter, error)
+	ReuseLayer(sha string) error
+	Commit() error
+}
+
+// LayeredCache restores layers from a writable cache followed by read-only seed caches, and stores layers only
+// in the writable cache. Each layer is restored from the first cache that has it, so layers rebuilt by an app are
+// not shadowed by older copies in a seed. Layers reused from a seed are copied to the writable cache, so that
+// the writable cache has every layer its metadata references.
+type LayeredCache struct {
+	writable WritableCache
+	seeds    []ReadableCache
+
+	mu sync.Mutex
+	// holders are the indexes, in order of precedence, of the caches whose metadata references each layer SHA.
+	holders map[string][]int
+}
+
+func NewLayeredCache(writable WritableCache, seeds ...ReadableCache) *LayeredCache {
+	return &LayeredCache{writable: writable, seeds: seeds}
+}
+
+func (c *LayeredCache) Name() string {
+	return c.writable.Name()
+}
+
+// RetrieveMetadata merges the metadata of the caches in order of precedence. The stack and the version of
+// each buildpack are those of the first cache that records them; layers cached on another stack or by another
+// version of the buildpack are left out.
+func (c *LayeredCache) RetrieveMetadata() (Metadata, error) {
+	merged := Metadata{}
+	holders := map[string][]int{}
+	for i, rc := range c.caches() {
+		meta, err := rc.RetrieveMetadata()
+		if err != nil {
+			return Metadata{}, errors.Wrapf(err, "retrieving metadata of cache '%s'", rc.Name())
+		}
+		for _, bp := range meta.Buildpacks {
+			for _, layer := range bp.Layers {
+				holders[layer.SHA] = append(holders[layer.SHA], i)
+			}
+		}
+
+		if meta.StackID != "" && merged.StackID != "" && meta.StackID != merged.StackID {
+			continue
+		}
+		if merged.StackID == "" {
+			merged.StackID = meta.StackID
+		}
+		for _, bp := range meta.Buildpacks {
+			mergeBuildpackLayers(&merged, bp.ID, bp.Version, bp.Layers)
+		}
+	}
+
+	c.mu.Lock()
+	c.holders = holders
+	c.mu.Unlock()
+	return merged, nil
+}
+
+// RetrieveLayer returns the contents of the layer from the first cache that has it.
+func (c *LayeredCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
+	holders, err := c.layerHolders(sha)
+	if err != nil {
+		return nil, err
+	}
+	caches := c.caches()
+	var errs []string
+	for _, i := range holders {
+		rc, err := caches[i].RetrieveLayer(sha)
+		if err == nil {
+			return rc, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return nil, errors.Errorf("layer with SHA '%s' not found in cache '%s' or its seeds", sha, c.Name())
+	}
+	return nil, errors.Errorf("retrieving layer with SHA '%s': %s", sha, errs[len(errs)-1])
+}
+
+func (c *LayeredCache) SetMetadata(metadata Metadata) error {
+	return c.writable.SetMetadata(metadata)
+}
+
+func (c *LayeredCache) NewLayerWriter() (LayerWriter, error) {
+	return c.writable.NewLayerWriter()
+}
+
+// ReuseLayer keeps a layer of the writable cache, or copies a layer of the first seed that has it into the
+// writable cache.
+func (c *LayeredCache) ReuseLayer(sha string) error {
+	err := c.writable.ReuseLayer(sha)
+	if err == nil || errors.Cause(err) == errCacheCommitted {
+		return err
+	}
+	holders, hErr := c.layerHolders(sha)
+	if hErr != nil {
+		return hErr
+	}
+	caches := c.caches()
+	for _, i := range holders {
+		if i == 0 {
+			continue
+		}
+		if err = c.copyLayer(caches[i], sha); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// copyLayer stores the layer retrieved from a seed in the writable cache, failing with a CorruptLayerError if
+// its contents do not match its SHA.
+func (c *LayeredCache) copyLayer(seed ReadableCache, sha string) error {
+	rc, err := seed.RetrieveLayer(sha)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	w, err := c.writable.NewLayerWriter()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, newVerifyingReader(rc, sha, nil)); err != nil {
+		return errors.Wrapf(err, "copying layer with SHA '%s' from cache '%s'", sha, seed.Name())
+	}
+	return w.Commit(sha)
+}
+
+func (c *LayeredCache) Commit() error {
+	return c.writable.Commit()
+}
+
+// mergeBuildpackLayers adds the layers of a buildpack that meta does not have yet, unless meta records another
+// version of the buildpack.
+func mergeBuildpackLayers(meta *Metadata, id, version string, layers map[string]metadata.BuildpackLayerMetadata) {
+	for i := range meta.Buildpacks {
+		bp := &meta.Buildpacks[i]
+		if bp.ID != id {
+			continue
+		}
+		if bp.Version != version {
+			return
+		}
+		for name, layer := range layers {
+			if _, ok := bp.Layers[name]; !ok {
+				bp.Layers[name] = layer
+			}
+		}
+		return
+	}
+	merged := map[string]metadata.BuildpackLayerMetadata{}
+	for name, layer := range layers {
+		merged[name] = layer
+	}
+	meta.Buildpacks = append(meta.Buildpacks, metadata.BuildpackLayersMetadata{ID: id, Version: version, Layers: merged})
+}
+
+// caches returns the writable cache followed by the seeds.
+func (c *LayeredCache) caches() []ReadableCache {
+	return append([]ReadableCache{c.writable}, c.seeds...)
+}
+
+// layerHolders returns the indexes of the caches that have the layer, retrieving their metadata if it has not
+// been retrieved yet.
+func (c *LayeredCache) layerHolders(sha string) ([]int, error) {
+	c.mu.Lock()
+	holders := c.holders
+	c.mu.Unlock()
+	if holders == nil {
+		if _, err := c.RetrieveMetadata(); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		holders = c.holders
+		c.mu.Unlock()
+	}
+	return holders[sha], nil
+}
@@ -0,0 +1,227 @@
+package cache_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestLayeredCache(t *testing.T) {
+	spec.Run(t, "LayeredCache", testLayeredCache, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testLayeredCache(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir   string
+		appDir   string
+		seed     *cache.ArchiveCache
+		otherSHA string
+	)
+
+	layerSHA := func(data string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(data)))
+	}
+
+	layer := func(data string) metadata.BuildpackLayerMetadata {
+		return metadata.BuildpackLayerMetadata{
+			LayerMetadata:              metadata.LayerMetadata{SHA: layerSHA(data)},
+			BuildpackLayerMetadataFile: metadata.BuildpackLayerMetadataFile{Cache: true},
+		}
+	}
+
+	// fillCache commits layers with the given contents to the volume cache in dir.
+	fillCache := func(dir string, meta cache.Metadata, contents ...string) {
+		t.Helper()
+		h.AssertNil(t, os.MkdirAll(dir, 0755))
+		volumeCache, err := cache.NewVolumeCache(dir)
+		h.AssertNil(t, err)
+		for _, data := range contents {
+			w, err := volumeCache.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte(data))
+			h.AssertNil(t, err)
+			h.AssertNil(t, w.Commit(layerSHA(data)))
+		}
+		h.AssertNil(t, volumeCache.SetMetadata(meta))
+		h.AssertNil(t, volumeCache.Commit())
+	}
+
+	appCache := func() *cache.VolumeCache {
+		t.Helper()
+		return mustVolumeCache(t, appDir)
+	}
+
+	readLayer := func(c *cache.LayeredCache, sha string) string {
+		t.Helper()
+		rc, err := c.RetrieveLayer(sha)
+		h.AssertNil(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		h.AssertNil(t, err)
+		return string(data)
+	}
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "lifecycle.cache.layered_cache")
+		h.AssertNil(t, err)
+		appDir = filepath.Join(tmpDir, "app")
+		otherSHA = layerSHA("other-stack-layer")
+
+		seedDir := filepath.Join(tmpDir, "seed")
+		fillCache(seedDir, cache.Metadata{
+			StackID: "some.stack.id",
+			Buildpacks: []metadata.BuildpackLayersMetadata{
+				{ID: "buildpack.jdk", Version: "1.0.0", Layers: map[string]metadata.BuildpackLayerMetadata{
+					"jdk":   layer("seed-jdk"),
+					"maven": layer("seed-maven"),
+				}},
+				{ID: "buildpack.node", Version: "1.0.0", Layers: map[string]metadata.BuildpackLayerMetadata{
+					"node": layer("seed-node"),
+				}},
+			},
+		}, "seed-jdk", "seed-maven", "seed-node")
+		h.AssertNil(t, cache.WriteArchive(filepath.Join(tmpDir, "seed.tar"), mustVolumeCache(t, seedDir)))
+		seed, err = cache.NewArchiveCache(filepath.Join(tmpDir, "seed.tar"))
+		h.AssertNil(t, err)
+
+		fillCache(appDir, cache.Metadata{
+			StackID: "some.stack.id",
+			Buildpacks: []metadata.BuildpackLayersMetadata{
+				{ID: "buildpack.jdk", Version: "1.0.0", Layers: map[string]metadata.BuildpackLayerMetadata{
+					"jdk": layer("app-jdk"),
+				}},
+				{ID: "buildpack.node", Version: "2.0.0", Layers: map[string]metadata.BuildpackLayerMetadata{}},
+			},
+		}, "app-jdk")
+	})
+
+	it.After(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	when("#RetrieveMetadata", func() {
+		it("prefers the layers of the writable cache and adds the layers of the seeds", func() {
+			meta, err := cache.NewLayeredCache(appCache(), seed).RetrieveMetadata()
+			h.AssertNil(t, err)
+
+			jdk := meta.MetadataForBuildpack("buildpack.jdk")
+			h.AssertEq(t, jdk.Layers["jdk"].SHA, layerSHA("app-jdk"))
+			h.AssertEq(t, jdk.Layers["maven"].SHA, layerSHA("seed-maven"))
+		})
+
+		it("leaves out layers cached by another version of the buildpack", func() {
+			meta, err := cache.NewLayeredCache(appCache(), seed).RetrieveMetadata()
+			h.AssertNil(t, err)
+
+			node := meta.MetadataForBuildpack("buildpack.node")
+			h.AssertEq(t, node.Version, "2.0.0")
+			h.AssertEq(t, len(node.Layers), 0)
+		})
+
+		it("leaves out seeds cached on another stack", func() {
+			otherDir := filepath.Join(tmpDir, "other")
+			fillCache(otherDir, cache.Metadata{
+				StackID: "other.stack.id",
+				Buildpacks: []metadata.BuildpackLayersMetadata{
+					{ID: "buildpack.other", Layers: map[string]metadata.BuildpackLayerMetadata{"other": layer("other-stack-layer")}},
+				},
+			}, "other-stack-layer")
+
+			meta, err := cache.NewLayeredCache(appCache(), seed, mustVolumeCache(t, otherDir)).RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.StackID, "some.stack.id")
+			h.AssertEq(t, len(meta.MetadataForBuildpack("buildpack.other").Layers), 0)
+		})
+	})
+
+	when("#RetrieveLayer", func() {
+		it("restores each layer from the first cache that has it", func() {
+			subject := cache.NewLayeredCache(appCache(), seed)
+
+			h.AssertEq(t, readLayer(subject, layerSHA("app-jdk")), "app-jdk")
+			h.AssertEq(t, readLayer(subject, layerSHA("seed-maven")), "seed-maven")
+		})
+
+		it("fails when no cache has the layer", func() {
+			_, err := cache.NewLayeredCache(appCache(), seed).RetrieveLayer(otherSHA)
+			h.AssertError(t, err, "not found in cache '"+appDir+"' or its seeds")
+		})
+	})
+
+	when("#ReuseLayer", func() {
+		it("copies layers reused from the seeds to the writable cache", func() {
+			subject := cache.NewLayeredCache(appCache(), seed)
+			meta, err := subject.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertNil(t, subject.ReuseLayer(layerSHA("app-jdk")))
+			h.AssertNil(t, subject.ReuseLayer(layerSHA("seed-maven")))
+			h.AssertNil(t, subject.SetMetadata(meta))
+			h.AssertNil(t, subject.Commit())
+
+			for _, sha := range []string{layerSHA("seed-maven"), layerSHA("app-jdk")} {
+				has, err := appCache().HasLayer(sha)
+				h.AssertNil(t, err)
+				h.AssertEq(t, has, true)
+			}
+
+			h.AssertEq(t, readLayer(cache.NewLayeredCache(appCache()), layerSHA("seed-maven")), "seed-maven")
+		})
+
+		it("fails when the layer of the seed is corrupt", func() {
+			corrupt := &corruptCache{ReadableCache: seed, sha: layerSHA("seed-maven")}
+			subject := cache.NewLayeredCache(appCache(), corrupt)
+			_, err := subject.RetrieveMetadata()
+			h.AssertNil(t, err)
+
+			err = subject.ReuseLayer(layerSHA("seed-maven"))
+			h.AssertEq(t, cache.IsCorruptLayer(err), true)
+		})
+
+		it("fails when no cache has the layer", func() {
+			err := cache.NewLayeredCache(appCache(), seed).ReuseLayer(otherSHA)
+			h.AssertError(t, err, otherSHA)
+		})
+	})
+
+	when("#NewLayerWriter", func() {
+		it("writes layers to the writable cache", func() {
+			subject := cache.NewLayeredCache(appCache(), seed)
+			w, err := subject.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte("new-layer"))
+			h.AssertNil(t, err)
+			h.AssertNil(t, w.Commit(layerSHA("new-layer")))
+			h.AssertNil(t, subject.Commit())
+
+			has, err := appCache().HasLayer(layerSHA("new-layer"))
+			h.AssertNil(t, err)
+			h.AssertEq(t, has, true)
+		})
+	})
+}
+
+// corruptCache returns other contents for the layer with sha.
+type corruptCache struct {
+	cache.ReadableCache
+	sha string
+}
+
+func (c *corruptCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
+	if sha != c.sha {
+		return c.ReadableCache.RetrieveLayer(sha)
+	}
+	return ioutil.NopCloser(strings.NewReader("other-contents")), nil
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile is locked by every VolumeCache sharing a directory: shared while reading committed layers, and
+// exclusive while creating a staging directory or committing.
+const lockFile = "lock"
+
+func (c *VolumeCache) withLock(how int, fn func() error) error {
+	path := filepath.Join(c.dir, lockFile)
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "opening lock file '%s'", path)
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		return errors.Wrapf(err, "locking cache '%s'", c.dir)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
+
+// lockStagingDir holds an exclusive lock on dir until the returned file is closed, marking the directory as
+// in use by a live build.
+func lockStagingDir(dir string) (*os.File, error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// removeStaleStaging removes the entries of root that are not locked by a live build, left behind by builds that
+// exited without committing. It must be called with the cache locked exclusively, so that no build is between
+// creating and locking its staging directory.
+func removeStaleStaging(root string) error {
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(root, fi.Name())
+		file, err := lockStagingDir(path)
+		if err == syscall.EWOULDBLOCK {
+			continue
+		} else if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+			return err
+		}
+		if file != nil {
+			file.Close()
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
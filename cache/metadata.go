@@ -13,6 +13,8 @@ var (
 )
 
 type Metadata struct {
+	// StackID is the stack the cached layers were built on. Caches written by older lifecycles do not record it.
+	StackID    string                             `json:"stackID,omitempty"`
 	Buildpacks []metadata.BuildpackLayersMetadata `json:"buildpacks"`
 }
 
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/archive"
+)
+
+// ReadOnlyVolumeCache reads the layers committed to a VolumeCache directory without writing to it, so that
+// the directory may be mounted read-only. It creates no staging directory or lock file; when other builds share
+// the directory, it takes the lock they created while opening the committed files.
+type ReadOnlyVolumeCache struct {
+	dir string
+}
+
+func NewReadOnlyVolumeCache(dir string) (*ReadOnlyVolumeCache, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &ReadOnlyVolumeCache{dir: dir}, nil
+}
+
+func (c *ReadOnlyVolumeCache) Name() string {
+	return c.dir
+}
+
+func (c *ReadOnlyVolumeCache) RetrieveMetadata() (Metadata, error) {
+	file, err := c.open(MetadataLabel)
+	if os.IsNotExist(errors.Cause(err)) {
+		return Metadata{}, nil
+	} else if err != nil {
+		return Metadata{}, errors.Wrap(err, "opening metadata file")
+	}
+	defer file.Close()
+
+	metadata := Metadata{}
+	if json.NewDecoder(file).Decode(&metadata) != nil {
+		return Metadata{}, nil
+	}
+	return metadata, nil
+}
+
+// RetrieveLayer returns the uncompressed contents of the layer, however it was stored. Reading a layer whose
+// contents do not match its SHA fails with a CorruptLayerError.
+func (c *ReadOnlyVolumeCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
+	file, err := c.open(sha + ".tar")
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrapf(err, "layer with SHA '%s' not found", sha)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "opening layer with SHA '%s'", sha)
+	}
+	rc, err := archive.Decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, &CorruptLayerError{SHA: sha, Reason: err.Error()}
+	}
+	return newVerifyingReader(&layerReader{ReadCloser: rc, file: file}, sha, nil), nil
+}
+
+// open opens the committed file with name. A backup left without a committed directory by an interrupted
+// commit is the last complete commit, as when a VolumeCache recovers it.
+func (c *ReadOnlyVolumeCache) open(name string) (*os.File, error) {
+	var file *os.File
+	err := c.withSharedLock(func() error {
+		committedDir := filepath.Join(c.dir, "committed")
+		if _, err := os.Stat(committedDir); os.IsNotExist(err) {
+			committedDir = filepath.Join(c.dir, "committed-backup")
+		}
+		var err error
+		file, err = os.Open(filepath.Join(committedDir, name))
+		return err
+	})
+	return file, err
+}
+
+// withSharedLock runs fn holding the lock of the cache directory, if any build created one.
+func (c *ReadOnlyVolumeCache) withSharedLock(fn func() error) error {
+	file, err := os.Open(filepath.Join(c.dir, lockFile))
+	if os.IsNotExist(err) {
+		return fn()
+	} else if err != nil {
+		return errors.Wrapf(err, "opening lock file in '%s'", c.dir)
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		return errors.Wrapf(err, "locking cache '%s'", c.dir)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
@@ -0,0 +1,132 @@
+package cache_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/archive"
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestReadOnlyVolumeCache(t *testing.T) {
+	spec.Run(t, "ReadOnlyVolumeCache", testReadOnlyVolumeCache, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testReadOnlyVolumeCache(t *testing.T, when spec.G, it spec.S) {
+	var (
+		volumeDir string
+		layerSHA  string
+		subject   *cache.ReadOnlyVolumeCache
+	)
+
+	// files lists the paths under volumeDir.
+	var files = func() []string {
+		t.Helper()
+		var paths []string
+		h.AssertNil(t, filepath.Walk(volumeDir, func(path string, _ os.FileInfo, err error) error {
+			paths = append(paths, path)
+			return err
+		}))
+		sort.Strings(paths)
+		return paths
+	}
+
+	it.Before(func() {
+		var err error
+		volumeDir, err = ioutil.TempDir("", "lifecycle.cache.read_only_volume_cache")
+		h.AssertNil(t, err)
+
+		writer, err := cache.NewVolumeCache(volumeDir, cache.WithCompression(archive.CompressionGzip))
+		h.AssertNil(t, err)
+		w, err := writer.NewLayerWriter()
+		h.AssertNil(t, err)
+		_, err = w.Write([]byte("some-layer"))
+		h.AssertNil(t, err)
+		layerSHA = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("some-layer")))
+		h.AssertNil(t, w.Commit(layerSHA))
+		h.AssertNil(t, writer.SetMetadata(cache.Metadata{
+			Buildpacks: []metadata.BuildpackLayersMetadata{{
+				ID: "some.buildpack.id",
+				Layers: map[string]metadata.BuildpackLayerMetadata{
+					"some-layer": {LayerMetadata: metadata.LayerMetadata{SHA: layerSHA}},
+				},
+			}},
+		}))
+		h.AssertNil(t, writer.Commit())
+
+		subject, err = cache.NewReadOnlyVolumeCache(volumeDir)
+		h.AssertNil(t, err)
+	})
+
+	it.After(func() {
+		os.RemoveAll(volumeDir)
+	})
+
+	it("returns the metadata and layers committed to the directory", func() {
+		meta, err := subject.RetrieveMetadata()
+		h.AssertNil(t, err)
+		h.AssertEq(t, meta.Buildpacks[0].Layers["some-layer"].SHA, layerSHA)
+
+		rc, err := subject.RetrieveLayer(layerSHA)
+		h.AssertNil(t, err)
+		defer rc.Close()
+		contents, err := ioutil.ReadAll(rc)
+		h.AssertNil(t, err)
+		h.AssertEq(t, string(contents), "some-layer")
+	})
+
+	it("does not write to the directory", func() {
+		h.AssertNil(t, os.Remove(filepath.Join(volumeDir, "lock")))
+		before := files()
+
+		subject, err := cache.NewReadOnlyVolumeCache(volumeDir)
+		h.AssertNil(t, err)
+		_, err = subject.RetrieveMetadata()
+		h.AssertNil(t, err)
+		rc, err := subject.RetrieveLayer(layerSHA)
+		h.AssertNil(t, err)
+		_, err = ioutil.ReadAll(rc)
+		h.AssertNil(t, err)
+		h.AssertNil(t, rc.Close())
+
+		h.AssertEq(t, files(), before)
+	})
+
+	it("reads the last complete commit when a commit was interrupted", func() {
+		h.AssertNil(t, os.Rename(filepath.Join(volumeDir, "committed"), filepath.Join(volumeDir, "committed-backup")))
+
+		meta, err := subject.RetrieveMetadata()
+		h.AssertNil(t, err)
+		h.AssertEq(t, meta.Buildpacks[0].Layers["some-layer"].SHA, layerSHA)
+		rc, err := subject.RetrieveLayer(layerSHA)
+		h.AssertNil(t, err)
+		h.AssertNil(t, rc.Close())
+	})
+
+	it("fails retrieving a layer that is not in the cache", func() {
+		_, err := subject.RetrieveLayer("sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("other-layer"))))
+		h.AssertError(t, err, "not found")
+	})
+
+	it("returns empty metadata when nothing was committed", func() {
+		emptyDir, err := ioutil.TempDir("", "lifecycle.cache.read_only_volume_cache")
+		h.AssertNil(t, err)
+		defer os.RemoveAll(emptyDir)
+
+		empty, err := cache.NewReadOnlyVolumeCache(emptyDir)
+		h.AssertNil(t, err)
+		meta, err := empty.RetrieveMetadata()
+		h.AssertNil(t, err)
+		h.AssertEq(t, meta, cache.Metadata{})
+	})
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CorruptLayerError is returned while reading a cached layer whose contents do not match its SHA.
+type CorruptLayerError struct {
+	SHA    string
+	Reason string
+}
+
+func (e *CorruptLayerError) Error() string {
+	return fmt.Sprintf("cached layer with SHA '%s' is corrupt: %s", e.SHA, e.Reason)
+}
+
+// IsCorruptLayer reports whether err was caused by reading a corrupt layer.
+func IsCorruptLayer(err error) bool {
+	_, ok := errors.Cause(err).(*CorruptLayerError)
+	return ok
+}
+
+// verifyingReader hashes a layer as it is read and fails at the end of the layer, instead of returning io.EOF,
+// if the contents do not match the layer's SHA. A layer that ends unexpectedly is reported as corrupt too, while
+// other failures to read it are returned unchanged. onCorrupt is called once when the layer is found to be corrupt.
+type verifyingReader struct {
+	io.ReadCloser
+	sha       string
+	hash      hash.Hash
+	onCorrupt func()
+	err       error
+}
+
+// NewVerifyingReader returns rc, failing with a CorruptLayerError at the end of the layer if the contents read
+// from it do not match sha.
+func NewVerifyingReader(rc io.ReadCloser, sha string) io.ReadCloser {
+	return newVerifyingReader(rc, sha, nil)
+}
+
+// newVerifyingReader verifies the layer read from rc against sha. Layers that are not named after a sha256
+// digest cannot be verified and are returned as they are.
+func newVerifyingReader(rc io.ReadCloser, sha string, onCorrupt func()) io.ReadCloser {
+	if !strings.HasPrefix(sha, "sha256:") {
+		return rc
+	}
+	return &verifyingReader{ReadCloser: rc, sha: sha, hash: sha256.New(), onCorrupt: onCorrupt}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	switch {
+	case err == io.EOF:
+		if actual := "sha256:" + hex.EncodeToString(r.hash.Sum(nil)); actual != r.sha {
+			return n, r.corrupt(fmt.Sprintf("contents have SHA '%s'", actual))
+		}
+	case errors.Cause(err) == io.ErrUnexpectedEOF:
+		return n, r.corrupt("contents are truncated")
+	}
+	return n, err
+}
+
+func (r *verifyingReader) corrupt(reason string) error {
+	r.err = &CorruptLayerError{SHA: r.sha, Reason: reason}
+	if r.onCorrupt != nil {
+		r.onCorrupt()
+	}
+	return r.err
+}
@@ -0,0 +1,69 @@
+package cache_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/cache"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	spec.Run(t, "VerifyingReader", testVerifyingReader, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+// failingReader returns contents, then fails with err.
+type failingReader struct {
+	contents io.Reader
+	err      error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.contents.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func testVerifyingReader(t *testing.T, when spec.G, it spec.S) {
+	var (
+		contents = []byte("some-layer-contents")
+		sha      = fmt.Sprintf("sha256:%x", sha256.Sum256(contents))
+	)
+
+	it("returns the contents when they match the SHA", func() {
+		actual, err := ioutil.ReadAll(cache.NewVerifyingReader(ioutil.NopCloser(bytes.NewReader(contents)), sha))
+		h.AssertNil(t, err)
+		h.AssertEq(t, actual, contents)
+	})
+
+	it("reports contents that do not match the SHA as corrupt", func() {
+		_, err := ioutil.ReadAll(cache.NewVerifyingReader(ioutil.NopCloser(bytes.NewReader([]byte("other"))), sha))
+		h.AssertEq(t, cache.IsCorruptLayer(err), true)
+	})
+
+	it("reports truncated contents as corrupt", func() {
+		rc := ioutil.NopCloser(&failingReader{contents: bytes.NewReader(contents[:5]), err: io.ErrUnexpectedEOF})
+		_, err := ioutil.ReadAll(cache.NewVerifyingReader(rc, sha))
+		h.AssertEq(t, cache.IsCorruptLayer(err), true)
+	})
+
+	it("returns other failures to read the contents unchanged", func() {
+		readErr := errors.New("some-read-error")
+		rc := ioutil.NopCloser(&failingReader{contents: bytes.NewReader(contents[:5]), err: readErr})
+		_, err := ioutil.ReadAll(cache.NewVerifyingReader(rc, sha))
+		h.AssertEq(t, cache.IsCorruptLayer(err), false)
+		if err != readErr {
+			t.Fatalf("expected error '%s', got: %v", readErr, err)
+		}
+	})
+}
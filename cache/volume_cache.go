@@ -5,22 +5,51 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io"
-	"math/rand"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/archive"
 )
 
+// VolumeCache stores layers in a directory that may be shared by concurrent builds. Each build stages its layers
+// in a directory of its own, and commits replace the committed layers one at a time while holding a lock, so
+// that the last build to commit wins and the committed layers always match their metadata.
 type VolumeCache struct {
 	committed    bool
 	dir          string
 	backupDir    string
+	stagingRoot  string
 	stagingDir   string
+	stagingLock  *os.File
 	committedDir string
+	compression  archive.Compression
+	maxSize      int64
+	// keepUnreferenced keeps layers the metadata does not reference when the cache is size-bounded
+	keepUnreferenced bool
+	// rename moves the directories of the cache when committing and recovering commits
+	rename      func(oldpath, newpath string) error
+	accessMu    sync.Mutex // layers may be retrieved concurrently
+	accessTimes map[string]time.Time
+	evictions   EvictionReport
 }
 
-func NewVolumeCache(dir string) (*VolumeCache, error) {
+type VolumeCacheOption func(c *VolumeCache)
+
+// WithCompression compresses the layers added to the cache. Layers are read back regardless of how they were
+// compressed, so the compression of a cache can be changed at any time.
+func WithCompression(compression archive.Compression) VolumeCacheOption {
+	return func(c *VolumeCache) {
+		c.compression = compression
+	}
+}
+
+func NewVolumeCache(dir string, ops ...VolumeCacheOption) (*VolumeCache, error) {
 	if _, err := os.Stat(dir); err != nil {
 		return nil, err
 	}
@@ -28,20 +57,36 @@ func NewVolumeCache(dir string) (*VolumeCache, error) {
 	c := &VolumeCache{
 		dir:          dir,
 		backupDir:    filepath.Join(dir, "committed-backup"),
-		stagingDir:   filepath.Join(dir, "staging"),
+		stagingRoot:  filepath.Join(dir, "staging"),
 		committedDir: filepath.Join(dir, "committed"),
+		compression:  archive.CompressionNone,
+		rename:       os.Rename,
 	}
-
-	if err := c.setupStagingDir(); err != nil {
-		return nil, errors.Wrapf(err, "initializing staging directory '%s'", c.stagingDir)
+	for _, op := range ops {
+		op(c)
 	}
 
-	if err := os.RemoveAll(c.backupDir); err != nil {
-		return nil, errors.Wrapf(err, "removing backup directory '%s'", c.backupDir)
-	}
+	err := c.withLock(syscall.LOCK_EX, func() error {
+		if err := c.setupStagingDir(); err != nil {
+			return errors.Wrapf(err, "initializing staging directory in '%s'", c.stagingRoot)
+		}
+
+		if err := c.recoverCommit(); err != nil {
+			return errors.Wrap(err, "recovering interrupted commit")
+		}
 
-	if err := os.MkdirAll(c.committedDir, 0777); err != nil {
-		return nil, errors.Wrapf(err, "creating committed directory '%s'", c.committedDir)
+		if err := os.MkdirAll(c.committedDir, 0777); err != nil {
+			return errors.Wrapf(err, "creating committed directory '%s'", c.committedDir)
+		}
+		c.accessTimes = readAccessTimes(c.committedDir)
+		return nil
+	})
+	if err != nil {
+		if c.stagingLock != nil {
+			c.stagingLock.Close()
+			os.RemoveAll(c.stagingDir)
+		}
+		return nil, err
 	}
 
 	return c, nil
@@ -71,9 +116,14 @@ func (c *VolumeCache) SetMetadata(metadata Metadata) error {
 
 func (c *VolumeCache) RetrieveMetadata() (Metadata, error) {
 	metadataPath := filepath.Join(c.committedDir, MetadataLabel)
-	file, err := os.Open(metadataPath)
+	var file *os.File
+	err := c.withLock(syscall.LOCK_SH, func() error {
+		var err error
+		file, err = os.Open(metadataPath)
+		return err
+	})
 	if err != nil {
-		if os.IsNotExist(err) {
+		if os.IsNotExist(errors.Cause(err)) {
 			return Metadata{}, nil
 		}
 		return Metadata{}, errors.Wrapf(err, "opening metadata file '%s'", metadataPath)
@@ -87,68 +137,139 @@ func (c *VolumeCache) RetrieveMetadata() (Metadata, error) {
 	return metadata, nil
 }
 
+// AddLayerFile stores the layer at tarPath. An uncompressed cache links the file when it is on the same
+// filesystem, so that its contents are not written to disk a second time.
 func (c *VolumeCache) AddLayerFile(sha string, tarPath string) error {
 	if c.committed {
 		return errCacheCommitted
 	}
-	if err := copyFile(tarPath, filepath.Join(c.stagingDir, sha+".tar")); err != nil {
-		return errors.Wrapf(err, "caching layer (%s)", sha)
+	if c.compression != archive.CompressionNone {
+		return c.addCompressedLayerFile(sha, tarPath)
+	}
+	dest := filepath.Join(c.stagingDir, sha+".tar")
+	if err := os.Link(tarPath, dest); err != nil {
+		if err := copyFile(tarPath, dest); err != nil {
+			return errors.Wrapf(err, "caching layer (%s)", sha)
+		}
 	}
+	c.touch(sha)
 	return nil
 }
 
-func (c *VolumeCache) AddLayer(rc io.ReadCloser) error {
-	if c.committed {
-		return errCacheCommitted
+func (c *VolumeCache) addCompressedLayerFile(sha string, tarPath string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return errors.Wrapf(err, "caching layer (%s)", sha)
+	}
+	defer f.Close()
+
+	w, err := c.NewLayerWriter()
+	if err != nil {
+		return err
 	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return errors.Wrapf(err, "caching layer (%s)", sha)
+	}
+	return w.Commit(sha)
+}
 
-	tarFile := filepath.Join(c.stagingDir, randString(10)+".tar")
-	fh, err := os.Create(tarFile)
+func (c *VolumeCache) AddLayer(rc io.ReadCloser) error {
+	w, err := c.NewLayerWriter()
 	if err != nil {
-		return errors.Wrapf(err, "create layer file in cache")
+		return err
 	}
+	defer w.Close()
 
 	hasher := sha256.New()
-	mw := io.MultiWriter(hasher, fh)
-	if _, err := io.Copy(mw, rc); err != nil {
-		fh.Close()
+	if _, err := io.Copy(io.MultiWriter(hasher, w), rc); err != nil {
 		return errors.Wrap(err, "copying layer to tar file")
 	}
-	sha := hex.EncodeToString(hasher.Sum(make([]byte, 0, hasher.Size())))
-	if err := fh.Close(); err != nil {
-		return errors.Wrapf(err, "closing layer file (layer sha: %s)", sha)
-	}
-	if err := os.Rename(tarFile, filepath.Join(c.stagingDir, "sha256:"+sha+".tar")); err != nil {
-		return errors.Wrapf(err, "renaming layer file (layer sha: %s)", sha)
+	return w.Commit("sha256:" + hex.EncodeToString(hasher.Sum(nil)))
+}
+
+// NewLayerWriter returns a writer that stages a layer directly in the cache, compressing it, as it is written.
+func (c *VolumeCache) NewLayerWriter() (LayerWriter, error) {
+	if c.committed {
+		return nil, errCacheCommitted
 	}
-	return nil
+	return newFileLayerWriter(c.stagingDir, c.compression, func(sha, path string) error {
+		if err := os.Rename(path, filepath.Join(c.stagingDir, sha+".tar")); err != nil {
+			return errors.Wrapf(err, "renaming layer file (layer sha: %s)", sha)
+		}
+		c.touch(sha)
+		return nil
+	})
 }
 
 func (c *VolumeCache) ReuseLayer(sha string) error {
 	if c.committed {
 		return errCacheCommitted
 	}
-	if err := os.Link(filepath.Join(c.committedDir, sha+".tar"), filepath.Join(c.stagingDir, sha+".tar")); err != nil {
+	err := c.withLock(syscall.LOCK_SH, func() error {
+		return os.Link(filepath.Join(c.committedDir, sha+".tar"), filepath.Join(c.stagingDir, sha+".tar"))
+	})
+	if err != nil {
 		return errors.Wrapf(err, "reusing layer (%s)", sha)
 	}
+	c.touch(sha)
 	return nil
 }
 
+// RetrieveLayer returns the uncompressed contents of the layer, however it was stored. The layer remains
+// readable if another build commits while it is being read. Reading a layer whose contents do not match its
+// SHA fails with a CorruptLayerError and removes the layer from the cache.
 func (c *VolumeCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
-	path, err := c.RetrieveLayerFile(sha)
+	var file *os.File
+	err := c.withLock(syscall.LOCK_SH, func() error {
+		path, err := c.RetrieveLayerFile(sha)
+		if err != nil {
+			return err
+		}
+		if file, err = os.Open(path); err != nil {
+			return errors.Wrapf(err, "opening layer with SHA '%s'", sha)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	file, err := os.Open(path)
+	rc, err := archive.Decompress(file)
 	if err != nil {
-		return nil, errors.Wrapf(err, "opening layer with SHA '%s'", sha)
+		c.discardLayer(sha, file)
+		file.Close()
+		return nil, &CorruptLayerError{SHA: sha, Reason: err.Error()}
 	}
-	return file, nil
+	c.touch(sha)
+	return newVerifyingReader(&layerReader{ReadCloser: rc, file: file}, sha, func() {
+		c.discardLayer(sha, file)
+	}), nil
+}
+
+// discardLayer removes a corrupt layer from the committed layers so that it is not reused, unless another
+// build has since committed a layer with the same SHA.
+func (c *VolumeCache) discardLayer(sha string, file *os.File) {
+	opened, err := file.Stat()
+	if err != nil {
+		return
+	}
+	path := filepath.Join(c.committedDir, sha+".tar")
+	c.withLock(syscall.LOCK_EX, func() error {
+		if fi, err := os.Stat(path); err == nil && os.SameFile(fi, opened) {
+			return os.Remove(path)
+		}
+		return nil
+	})
 }
 
 func (c *VolumeCache) HasLayer(sha string) (bool, error) {
-	if _, err := os.Stat(filepath.Join(c.committedDir, sha+".tar")); err != nil {
-		if os.IsNotExist(err) {
+	err := c.withLock(syscall.LOCK_SH, func() error {
+		_, err := os.Stat(filepath.Join(c.committedDir, sha+".tar"))
+		return err
+	})
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
 			return false, nil
 		}
 		return false, errors.Wrapf(err, "retrieving layer with SHA '%s'", sha)
@@ -156,6 +277,8 @@ func (c *VolumeCache) HasLayer(sha string) (bool, error) {
 	return true, nil
 }
 
+// RetrieveLayerFile returns the path of the layer as it is stored, which is compressed if the cache that added it was.
+// The path is only valid until another build commits to the cache.
 func (c *VolumeCache) RetrieveLayerFile(sha string) (string, error) {
 	path := filepath.Join(c.committedDir, sha+".tar")
 	if _, err := os.Stat(path); err != nil {
@@ -171,27 +294,123 @@ func (c *VolumeCache) Commit() error {
 	if c.committed {
 		return errCacheCommitted
 	}
+	defer c.stagingLock.Close()
+	return c.withLock(syscall.LOCK_EX, c.commit)
+}
+
+func (c *VolumeCache) commit() error {
+	if c.maxSize > 0 {
+		if err := c.evict(); err != nil {
+			return errors.Wrap(err, "evicting layers")
+		}
+	}
+	if err := c.writeAccessTimes(); err != nil {
+		return errors.Wrap(err, "recording layer access times")
+	}
+	if err := syncDir(c.stagingDir); err != nil {
+		return errors.Wrap(err, "syncing staged layers")
+	}
 	c.committed = true
-	if err := os.Rename(c.committedDir, c.backupDir); err != nil {
+	if err := c.rename(c.committedDir, c.backupDir); err != nil {
 		return errors.Wrap(err, "backing up cache")
 	}
-	defer os.RemoveAll(c.backupDir)
 
-	if err1 := os.Rename(c.stagingDir, c.committedDir); err1 != nil {
-		if err2 := os.Rename(c.backupDir, c.committedDir); err2 != nil {
+	if err1 := c.rename(c.stagingDir, c.committedDir); err1 != nil {
+		if err2 := c.rename(c.backupDir, c.committedDir); err2 != nil {
 			return errors.Wrap(err2, "rolling back cache")
 		}
 		return errors.Wrap(err1, "committing cache")
 	}
+	if err := syncFile(c.dir); err != nil {
+		return errors.Wrap(err, "syncing cache directory")
+	}
+
+	// a backup left behind is removed when the cache is next opened
+	os.RemoveAll(c.backupDir)
+	return nil
+}
 
+// recoverCommit restores the cache to the last complete commit after a build was interrupted while committing.
+// The committed directory only ever moves to the backup directory, and the staging directory only replaces it
+// once the backup exists, so a backup without a committed directory is the last commit, and a backup alongside
+// a committed directory is left over from a commit that completed.
+func (c *VolumeCache) recoverCommit() error {
+	if _, err := os.Stat(c.backupDir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(c.committedDir); os.IsNotExist(err) {
+		if err := c.rename(c.backupDir, c.committedDir); err != nil {
+			return errors.Wrapf(err, "restoring backup directory '%s'", c.backupDir)
+		}
+		return syncFile(c.dir)
+	} else if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(c.backupDir); err != nil {
+		return errors.Wrapf(err, "removing backup directory '%s'", c.backupDir)
+	}
 	return nil
 }
 
+// syncDir flushes the files in dir, and the directory itself, to disk.
+func syncDir(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			if err := syncFile(filepath.Join(dir, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return syncFile(dir)
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// setupStagingDir creates and locks a staging directory for this build, removing those of builds that are gone.
 func (c *VolumeCache) setupStagingDir() error {
-	if err := os.RemoveAll(c.stagingDir); err != nil {
+	if err := os.MkdirAll(c.stagingRoot, 0777); err != nil {
 		return err
 	}
-	return os.MkdirAll(c.stagingDir, 0777)
+	if err := removeStaleStaging(c.stagingRoot); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(c.stagingRoot, "build-")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		return err
+	}
+	lock, err := lockStagingDir(dir)
+	if err != nil {
+		return err
+	}
+	c.stagingDir, c.stagingLock = dir, lock
+	return nil
+}
+
+// layerReader closes both the decompressed stream of a layer and the file it is read from.
+type layerReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *layerReader) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
 }
 
 func copyFile(from, to string) error {
@@ -211,11 +430,3 @@ func copyFile(from, to string) error {
 
 	return err
 }
-
-func randString(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = 'a' + byte(rand.Intn(26))
-	}
-	return string(b)
-}
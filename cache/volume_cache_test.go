@@ -1,18 +1,23 @@
 package cache_test
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 
+	"github.com/buildpack/lifecycle/archive"
 	"github.com/buildpack/lifecycle/cache"
 	"github.com/buildpack/lifecycle/metadata"
 	h "github.com/buildpack/lifecycle/testhelpers"
@@ -51,6 +56,15 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 		os.RemoveAll(tmpDir)
 	})
 
+	// buildStagingDir returns the staging directory of the only open cache.
+	var buildStagingDir = func() string {
+		t.Helper()
+		dirs, err := ioutil.ReadDir(stagingDir)
+		h.AssertNil(t, err)
+		h.AssertEq(t, len(dirs), 1)
+		return filepath.Join(stagingDir, dirs[0].Name())
+	}
+
 	when("#NewVolumeCache", func() {
 		it("returns an error when the volume path does not exist", func() {
 			_, err := cache.NewVolumeCache(filepath.Join(tmpDir, "does_not_exist"))
@@ -79,6 +93,22 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 			})
 		})
 
+		when("another build is staging layers", func() {
+			it("keeps its staging dir", func() {
+				other, err := cache.NewVolumeCache(volumeDir)
+				h.AssertNil(t, err)
+				h.AssertNil(t, other.AddLayer(ioutil.NopCloser(strings.NewReader("some data"))))
+
+				subject, err = cache.NewVolumeCache(volumeDir)
+				h.AssertNil(t, err)
+
+				dirs, err := ioutil.ReadDir(stagingDir)
+				h.AssertNil(t, err)
+				h.AssertEq(t, len(dirs), 2)
+				h.AssertNil(t, other.Commit())
+			})
+		})
+
 		when("staging does not exist", func() {
 			it("creates staging dir", func() {
 				var err error
@@ -105,6 +135,7 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 
 		when("backup dir already exists", func() {
 			it.Before(func() {
+				h.AssertNil(t, os.MkdirAll(committedDir, 0777))
 				h.AssertNil(t, os.MkdirAll(backupDir, 0777))
 				h.AssertNil(t, ioutil.WriteFile(filepath.Join(backupDir, "some-layer.tar"), []byte("some data"), 0666))
 			})
@@ -123,6 +154,461 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
+	when("the cache compresses layers", func() {
+		it.Before(func() {
+			var err error
+
+			subject, err = cache.NewVolumeCache(volumeDir, cache.WithCompression(archive.CompressionGzip))
+			h.AssertNil(t, err)
+		})
+
+		it("stores compressed layers and retrieves them uncompressed", func() {
+			w, err := subject.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte("dummy data"))
+			h.AssertNil(t, err)
+			h.AssertNil(t, w.Commit("some_sha"))
+
+			tarPath := filepath.Join(tmpDir, "some-layer.tar")
+			h.AssertNil(t, ioutil.WriteFile(tarPath, []byte("other data"), 0666))
+			h.AssertNil(t, subject.AddLayerFile("other_sha", tarPath))
+
+			h.AssertNil(t, subject.Commit())
+
+			for sha, expected := range map[string]string{"some_sha": "dummy data", "other_sha": "other data"} {
+				stored, err := ioutil.ReadFile(filepath.Join(committedDir, sha+".tar"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, stored[:2], []byte{0x1f, 0x8b})
+
+				rc, err := subject.RetrieveLayer(sha)
+				h.AssertNil(t, err)
+				contents, err := ioutil.ReadAll(rc)
+				h.AssertNil(t, err)
+				h.AssertNil(t, rc.Close())
+				h.AssertEq(t, string(contents), expected)
+			}
+		})
+
+		it("retrieves layers stored without compression", func() {
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(committedDir, "some_sha.tar"), []byte("dummy data"), 0666))
+
+			rc, err := subject.RetrieveLayer("some_sha")
+			h.AssertNil(t, err)
+			defer rc.Close()
+			contents, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "dummy data")
+		})
+	})
+
+	when("a cached layer is corrupt", func() {
+		var sha string
+
+		var commitLayer = func(ops ...cache.VolumeCacheOption) {
+			t.Helper()
+			c, err := cache.NewVolumeCache(volumeDir, ops...)
+			h.AssertNil(t, err)
+			w, err := c.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte("some layer contents"))
+			h.AssertNil(t, err)
+			sha = "sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("some layer contents")))
+			h.AssertNil(t, w.Commit(sha))
+			h.AssertNil(t, c.Commit())
+		}
+
+		var truncateLayer = func() {
+			t.Helper()
+			h.AssertNil(t, os.Truncate(filepath.Join(committedDir, sha+".tar"), 10))
+		}
+
+		it("returns intact layers", func() {
+			commitLayer()
+			rc, err := mustVolumeCache(t, volumeDir).RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			contents, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "some layer contents")
+		})
+
+		it("fails to read a layer whose contents do not match its SHA", func() {
+			commitLayer()
+			truncateLayer()
+
+			rc, err := mustVolumeCache(t, volumeDir).RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			_, err = ioutil.ReadAll(rc)
+			h.AssertError(t, err, "cached layer with SHA '"+sha+"' is corrupt")
+			h.AssertEq(t, cache.IsCorruptLayer(err), true)
+		})
+
+		it("fails to read a compressed layer that cannot be decompressed", func() {
+			commitLayer(cache.WithCompression(archive.CompressionGzip))
+			truncateLayer()
+
+			rc, err := mustVolumeCache(t, volumeDir).RetrieveLayer(sha)
+			if err == nil {
+				defer rc.Close()
+				_, err = ioutil.ReadAll(rc)
+			}
+			h.AssertEq(t, cache.IsCorruptLayer(err), true)
+		})
+
+		it("removes the layer from the cache", func() {
+			commitLayer()
+			truncateLayer()
+
+			subject = mustVolumeCache(t, volumeDir)
+			rc, err := subject.RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			_, err = ioutil.ReadAll(rc)
+			h.AssertEq(t, cache.IsCorruptLayer(err), true)
+
+			has, err := subject.HasLayer(sha)
+			h.AssertNil(t, err)
+			h.AssertEq(t, has, false)
+		})
+	})
+
+	when("the cache has a maximum size", func() {
+		var addLayer = func(c *cache.VolumeCache, sha, contents string) {
+			t.Helper()
+			w, err := c.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte(contents))
+			h.AssertNil(t, err)
+			h.AssertNil(t, w.Commit(sha))
+		}
+
+		var committedLayers = func() []string {
+			t.Helper()
+			matches, err := filepath.Glob(filepath.Join(committedDir, "*.tar"))
+			h.AssertNil(t, err)
+			var shas []string
+			for _, m := range matches {
+				shas = append(shas, strings.TrimSuffix(filepath.Base(m), ".tar"))
+			}
+			return shas
+		}
+
+		it.Before(func() {
+			previous, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+			addLayer(previous, "sha-a", "layer a...")
+			addLayer(previous, "sha-b", "layer b...")
+			h.AssertNil(t, previous.Commit())
+		})
+
+		it("keeps unused layers from previous commits while they fit", func() {
+			var err error
+			subject, err = cache.NewVolumeCache(volumeDir, cache.WithMaxSize(100), cache.WithUnreferencedLayers())
+			h.AssertNil(t, err)
+			addLayer(subject, "sha-c", "layer c...")
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, committedLayers(), []string{"sha-a", "sha-b", "sha-c"})
+			h.AssertEq(t, len(subject.EvictionReport().Evicted), 0)
+		})
+
+		it("evicts the least recently used layers", func() {
+			var err error
+			subject, err = cache.NewVolumeCache(volumeDir, cache.WithMaxSize(25), cache.WithUnreferencedLayers())
+			h.AssertNil(t, err)
+			h.AssertNil(t, subject.ReuseLayer("sha-a"))
+			addLayer(subject, "sha-c", "layer c...")
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, committedLayers(), []string{"sha-a", "sha-c"})
+
+			report := subject.EvictionReport()
+			h.AssertEq(t, report.MaxSize, int64(25))
+			h.AssertEq(t, report.Size, int64(20))
+			h.AssertEq(t, len(report.Evicted), 1)
+			h.AssertEq(t, report.Evicted[0].SHA, "sha-b")
+			h.AssertEq(t, report.Evicted[0].Size, int64(10))
+		})
+
+		it("remembers access times across commits", func() {
+			retriever, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+			h.AssertNil(t, retriever.ReuseLayer("sha-b"))
+			h.AssertNil(t, retriever.ReuseLayer("sha-a"))
+			h.AssertNil(t, retriever.Commit())
+
+			subject, err = cache.NewVolumeCache(volumeDir, cache.WithMaxSize(15), cache.WithUnreferencedLayers())
+			h.AssertNil(t, err)
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, committedLayers(), []string{"sha-a"})
+		})
+
+		it("deletes unused layers from previous commits that the metadata does not reference", func() {
+			var err error
+			subject, err = cache.NewVolumeCache(volumeDir, cache.WithMaxSize(100))
+			h.AssertNil(t, err)
+			addLayer(subject, "sha-c", "layer c...")
+			h.AssertNil(t, subject.SetMetadata(cache.Metadata{
+				Buildpacks: []metadata.BuildpackLayersMetadata{{
+					ID: "bp.id",
+					Layers: map[string]metadata.BuildpackLayerMetadata{
+						"layer-a": {LayerMetadata: metadata.LayerMetadata{SHA: "sha-a"}},
+						"layer-c": {LayerMetadata: metadata.LayerMetadata{SHA: "sha-c"}},
+					},
+				}},
+			}))
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, committedLayers(), []string{"sha-a", "sha-c"})
+			h.AssertEq(t, len(subject.EvictionReport().Evicted), 0)
+		})
+
+		it("removes evicted layers from the metadata", func() {
+			var err error
+			subject, err = cache.NewVolumeCache(volumeDir, cache.WithMaxSize(15))
+			h.AssertNil(t, err)
+			addLayer(subject, "sha-c", "layer c...")
+			addLayer(subject, "sha-d", "layer d...")
+			h.AssertNil(t, subject.SetMetadata(cache.Metadata{
+				Buildpacks: []metadata.BuildpackLayersMetadata{{
+					ID: "bp.id",
+					Layers: map[string]metadata.BuildpackLayerMetadata{
+						"layer-c": {LayerMetadata: metadata.LayerMetadata{SHA: "sha-c"}},
+						"layer-d": {LayerMetadata: metadata.LayerMetadata{SHA: "sha-d"}},
+					},
+				}},
+			}))
+			h.AssertNil(t, subject.Commit())
+
+			h.AssertEq(t, committedLayers(), []string{"sha-d"})
+
+			meta, err := subject.RetrieveMetadata()
+			h.AssertNil(t, err)
+			_, ok := meta.Buildpacks[0].Layers["layer-c"]
+			h.AssertEq(t, ok, false)
+			h.AssertEq(t, meta.Buildpacks[0].Layers["layer-d"].SHA, "sha-d")
+		})
+	})
+
+	when("a build was interrupted while committing", func() {
+		// stageBuild writes the files a build stages in dir, as they are left behind when it exits.
+		var stageBuild = func(dir, sha string) {
+			t.Helper()
+			h.AssertNil(t, os.MkdirAll(dir, 0777))
+			h.AssertNil(t, ioutil.WriteFile(filepath.Join(dir, sha+".tar"), []byte("layer "+sha), 0666))
+			h.AssertNil(t, ioutil.WriteFile(
+				filepath.Join(dir, cache.MetadataLabel),
+				[]byte(`{"buildpacks": [{"key": "some-buildpack", "layers": {"some-layer": {"sha": "`+sha+`"}}}]}`),
+				0666,
+			))
+		}
+
+		var assertCommitted = func(sha string) {
+			t.Helper()
+			reader, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+			meta, err := reader.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.Buildpacks[0].Layers["some-layer"].SHA, sha)
+			rc, err := reader.RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			contents, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "layer "+sha)
+
+			if _, err := os.Stat(backupDir); !os.IsNotExist(err) {
+				t.Fatalf("expected backup dir to be removed, got: %v", err)
+			}
+			buildStagingDir()
+		}
+
+		it.Before(func() {
+			stageBuild(committedDir, "sha-previous")
+		})
+
+		it("discards the staged layers when it stopped before backing up the committed layers", func() {
+			stageBuild(filepath.Join(stagingDir, "build-interrupted"), "sha-interrupted")
+
+			assertCommitted("sha-previous")
+		})
+
+		it("restores the committed layers when it stopped after backing them up", func() {
+			stageBuild(filepath.Join(stagingDir, "build-interrupted"), "sha-interrupted")
+			h.AssertNil(t, os.Rename(committedDir, backupDir))
+
+			assertCommitted("sha-previous")
+		})
+
+		it("keeps the new layers when it stopped after moving them into place", func() {
+			h.AssertNil(t, os.Rename(committedDir, backupDir))
+			stageBuild(committedDir, "sha-interrupted")
+
+			assertCommitted("sha-interrupted")
+		})
+
+		it("keeps the new layers when it stopped while removing the backup", func() {
+			h.AssertNil(t, os.Rename(committedDir, backupDir))
+			stageBuild(committedDir, "sha-interrupted")
+			h.AssertNil(t, os.Remove(filepath.Join(backupDir, cache.MetadataLabel)))
+
+			assertCommitted("sha-interrupted")
+		})
+
+		when("a step of committing fails", func() {
+			// failRenames fails the renames of the cache with the given call numbers, counting from 1.
+			var failRenames = func(calls ...int) cache.VolumeCacheOption {
+				n := 0
+				return cache.WithRename(func(oldpath, newpath string) error {
+					n++
+					for _, c := range calls {
+						if c == n {
+							return errors.New("some-rename-error")
+						}
+					}
+					return os.Rename(oldpath, newpath)
+				})
+			}
+
+			var commitFailing = func(calls ...int) error {
+				t.Helper()
+				subject, err := cache.NewVolumeCache(volumeDir, failRenames(calls...))
+				h.AssertNil(t, err)
+				stageBuild(buildStagingDir(), "sha-failed")
+				return subject.Commit()
+			}
+
+			it("keeps the committed layers when backing them up fails", func() {
+				h.AssertError(t, commitFailing(1), "backing up cache: some-rename-error")
+
+				assertCommitted("sha-previous")
+			})
+
+			it("restores the committed layers when moving the staged layers into place fails", func() {
+				h.AssertError(t, commitFailing(2), "committing cache: some-rename-error")
+
+				assertCommitted("sha-previous")
+			})
+
+			it("restores the committed layers when the cache is next opened if rolling back fails", func() {
+				h.AssertError(t, commitFailing(2, 3), "rolling back cache: some-rename-error")
+
+				assertCommitted("sha-previous")
+			})
+
+			it("recovers when the cache is next opened if restoring the backup fails", func() {
+				h.AssertError(t, commitFailing(2, 3), "rolling back cache: some-rename-error")
+
+				_, err := cache.NewVolumeCache(volumeDir, failRenames(1))
+				h.AssertError(t, err, "recovering interrupted commit: restoring backup directory")
+
+				assertCommitted("sha-previous")
+			})
+		})
+	})
+
+	when("the cache is shared by concurrent builds", func() {
+		var commitBuild = func(c *cache.VolumeCache, sha string) error {
+			w, err := c.NewLayerWriter()
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			if _, err := w.Write([]byte("layer " + sha)); err != nil {
+				return err
+			}
+			if err := w.Commit(sha); err != nil {
+				return err
+			}
+			if err := c.SetMetadata(cache.Metadata{
+				Buildpacks: []metadata.BuildpackLayersMetadata{{
+					ID:     "some-buildpack",
+					Layers: map[string]metadata.BuildpackLayerMetadata{"some-layer": {LayerMetadata: metadata.LayerMetadata{SHA: sha}}},
+				}},
+			}); err != nil {
+				return err
+			}
+			return c.Commit()
+		}
+
+		var assertConsistent = func(expectedSHA string) {
+			t.Helper()
+			reader, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+			meta, err := reader.RetrieveMetadata()
+			h.AssertNil(t, err)
+			sha := meta.Buildpacks[0].Layers["some-layer"].SHA
+			if expectedSHA != "" {
+				h.AssertEq(t, sha, expectedSHA)
+			}
+			rc, err := reader.RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			contents, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "layer "+sha)
+		}
+
+		it("commits each build in turn when commits interleave", func() {
+			first, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+			second, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+
+			h.AssertNil(t, commitBuild(first, "sha-first"))
+			assertConsistent("sha-first")
+
+			h.AssertNil(t, commitBuild(second, "sha-second"))
+			assertConsistent("sha-second")
+		})
+
+		it("lets a build reuse layers committed by another build while it was running", func() {
+			h.AssertNil(t, commitBuild(mustVolumeCache(t, volumeDir), "sha-a"))
+
+			reusing, err := cache.NewVolumeCache(volumeDir)
+			h.AssertNil(t, err)
+			h.AssertNil(t, commitBuild(mustVolumeCache(t, volumeDir), "sha-b"))
+
+			h.AssertNil(t, reusing.ReuseLayer("sha-b"))
+			h.AssertNil(t, reusing.Commit())
+
+			has, err := mustVolumeCache(t, volumeDir).HasLayer("sha-b")
+			h.AssertNil(t, err)
+			h.AssertEq(t, has, true)
+		})
+
+		it("leaves a consistent cache when many builds commit at once", func() {
+			var (
+				wg   sync.WaitGroup
+				errs = make(chan error, 20)
+			)
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					c, err := cache.NewVolumeCache(volumeDir)
+					if err != nil {
+						errs <- err
+						return
+					}
+					errs <- commitBuild(c, fmt.Sprintf("sha-%d", i))
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				h.AssertNil(t, err)
+			}
+
+			assertConsistent("")
+			dirs, err := ioutil.ReadDir(stagingDir)
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(dirs), 1)
+		})
+	})
+
 	when("VolumeCache", func() {
 		it.Before(func() {
 			var err error
@@ -242,7 +728,7 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 
 		when("#Commit", func() {
 			it("should clear the staging dir", func() {
-				layerTarPath := filepath.Join(stagingDir, "some-layer.tar")
+				layerTarPath := filepath.Join(buildStagingDir(), "some-layer.tar")
 				h.AssertNil(t, ioutil.WriteFile(layerTarPath, []byte("some data"), 0666))
 
 				err := subject.Commit()
@@ -331,6 +817,16 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 					})
 				})
 
+				it("links the layer file instead of copying it", func() {
+					h.AssertNil(t, subject.AddLayerFile("some_sha", tarPath))
+
+					original, err := os.Stat(tarPath)
+					h.AssertNil(t, err)
+					staged, err := os.Stat(filepath.Join(buildStagingDir(), "some_sha.tar"))
+					h.AssertNil(t, err)
+					h.AssertEq(t, os.SameFile(original, staged), true)
+				})
+
 				when("add after commit", func() {
 					it("retrieve returns the newly set metadata", func() {
 						err := subject.Commit()
@@ -404,6 +900,52 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 
 			})
 
+			when("#NewLayerWriter", func() {
+				when("write then commit", func() {
+					it("retrieve returns newly added layer", func() {
+						w, err := subject.NewLayerWriter()
+						h.AssertNil(t, err)
+						_, err = w.Write([]byte("dummy data"))
+						h.AssertNil(t, err)
+						h.AssertNil(t, w.Commit("some_sha"))
+						h.AssertNil(t, w.Close())
+
+						h.AssertNil(t, subject.Commit())
+
+						rc, err := subject.RetrieveLayer("some_sha")
+						h.AssertNil(t, err)
+						defer rc.Close()
+
+						bytes, err := ioutil.ReadAll(rc)
+						h.AssertNil(t, err)
+						h.AssertEq(t, string(bytes), "dummy data")
+					})
+				})
+
+				when("write then close", func() {
+					it("discards the layer", func() {
+						w, err := subject.NewLayerWriter()
+						h.AssertNil(t, err)
+						_, err = w.Write([]byte("dummy data"))
+						h.AssertNil(t, err)
+						h.AssertNil(t, w.Close())
+
+						files, err := ioutil.ReadDir(buildStagingDir())
+						h.AssertNil(t, err)
+						h.AssertEq(t, len(files), 0)
+					})
+				})
+
+				when("write after commit", func() {
+					it("returns an error", func() {
+						h.AssertNil(t, subject.Commit())
+
+						_, err := subject.NewLayerWriter()
+						h.AssertError(t, err, "cache cannot be modified after commit")
+					})
+				})
+			})
+
 			when("#ReuseLayer", func() {
 				it.Before(func() {
 					h.AssertNil(t, ioutil.WriteFile(filepath.Join(committedDir, "some_sha.tar"), []byte("dummy data"), 0666))
@@ -461,3 +1003,10 @@ func testVolumeCache(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 }
+
+func mustVolumeCache(t *testing.T, dir string) *cache.VolumeCache {
+	t.Helper()
+	c, err := cache.NewVolumeCache(dir)
+	h.AssertNil(t, err)
+	return c
+}
@@ -0,0 +1,136 @@
+package lifecycle
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
+)
+
+// CachedLayer is a layer stored in a cache by a buildpack.
+type CachedLayer struct {
+	Buildpack string
+	Version   string
+	Name      string
+	metadata.BuildpackLayerMetadata
+}
+
+func (l CachedLayer) Identifier() string {
+	return l.Buildpack + ":" + l.Name
+}
+
+// CachePruneFilter selects the layers to prune from a cache. A layer is selected when it matches every
+// criterion that is set.
+type CachePruneFilter struct {
+	// Buildpacks are the IDs of the buildpacks whose layers are selected.
+	Buildpacks []string
+	// Layers are the names of the selected layers, optionally prefixed with a buildpack ID and a colon.
+	Layers []string
+	// CachedBefore selects layers cached before the given time. Layers cached by older lifecycles do not record
+	// when they were cached and are never selected by it.
+	CachedBefore time.Time
+}
+
+// Empty reports whether no criterion is set, in which case the filter selects no layers.
+func (f CachePruneFilter) Empty() bool {
+	return len(f.Buildpacks) == 0 && len(f.Layers) == 0 && f.CachedBefore.IsZero()
+}
+
+func (f CachePruneFilter) matches(l CachedLayer) bool {
+	if len(f.Buildpacks) > 0 && !contains(f.Buildpacks, l.Buildpack) {
+		return false
+	}
+	if len(f.Layers) > 0 && !contains(f.Layers, l.Name) && !contains(f.Layers, l.Identifier()) {
+		return false
+	}
+	if !f.CachedBefore.IsZero() && (l.CachedAt == nil || !l.CachedAt.Before(f.CachedBefore)) {
+		return false
+	}
+	return true
+}
+
+// ListCache returns the layers stored in a cache, ordered by buildpack and layer name.
+func ListCache(cacheStore Cache) ([]CachedLayer, error) {
+	meta, err := cacheStore.RetrieveMetadata()
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieving cache metadata")
+	}
+	return cachedLayers(meta), nil
+}
+
+// PruneCache removes the layers selected by filter from a cache and commits the layers that remain. The layers
+// are removed together when the cache is committed, or not at all. It returns the removed layers.
+func PruneCache(cacheStore Cache, filter CachePruneFilter) ([]CachedLayer, error) {
+	if filter.Empty() {
+		return nil, errors.New("no layers selected to prune")
+	}
+	meta, err := cacheStore.RetrieveMetadata()
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieving cache metadata")
+	}
+
+	newMeta := cache.Metadata{StackID: meta.StackID}
+	reused := map[string]bool{}
+	var pruned []CachedLayer
+	for _, bp := range meta.Buildpacks {
+		kept := metadata.BuildpackLayersMetadata{ID: bp.ID, Version: bp.Version, Layers: map[string]metadata.BuildpackLayerMetadata{}}
+		for name, layer := range bp.Layers {
+			l := CachedLayer{Buildpack: bp.ID, Version: bp.Version, Name: name, BuildpackLayerMetadata: layer}
+			if filter.matches(l) {
+				pruned = append(pruned, l)
+				continue
+			}
+			if !reused[layer.SHA] {
+				if err := cacheStore.ReuseLayer(layer.SHA); err != nil {
+					return nil, errors.Wrapf(err, "keeping layer '%s'", l.Identifier())
+				}
+				reused[layer.SHA] = true
+			}
+			kept.Layers[name] = layer
+		}
+		if len(kept.Layers) > 0 {
+			newMeta.Buildpacks = append(newMeta.Buildpacks, kept)
+		}
+	}
+
+	if err := cacheStore.SetMetadata(newMeta); err != nil {
+		return nil, errors.Wrap(err, "setting cache metadata")
+	}
+	if err := cacheStore.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing cache")
+	}
+	sortCachedLayers(pruned)
+	return pruned, nil
+}
+
+func cachedLayers(meta cache.Metadata) []CachedLayer {
+	var layers []CachedLayer
+	for _, bp := range meta.Buildpacks {
+		for name, layer := range bp.Layers {
+			layers = append(layers, CachedLayer{Buildpack: bp.ID, Version: bp.Version, Name: name, BuildpackLayerMetadata: layer})
+		}
+	}
+	sortCachedLayers(layers)
+	return layers
+}
+
+func sortCachedLayers(layers []CachedLayer) {
+	sort.Slice(layers, func(i, j int) bool {
+		if layers[i].Buildpack != layers[j].Buildpack {
+			return layers[i].Buildpack < layers[j].Buildpack
+		}
+		return layers[i].Name < layers[j].Name
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
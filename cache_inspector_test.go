@@ -0,0 +1,226 @@
+package lifecycle_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildpack/imgutil/fakes"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle"
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestCacheInspector(t *testing.T) {
+	spec.Run(t, "CacheInspector", testCacheInspector, spec.Report(report.Terminal{}))
+}
+
+func testCacheInspector(t *testing.T, when spec.G, it spec.S) {
+	var (
+		cacheDir string
+		oldTime  = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		newTime  = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+		shas     = map[string]string{}
+	)
+
+	layerSHA := func(name string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(name)))
+	}
+
+	cacheMetadata := func() cache.Metadata {
+		layer := func(name string, cachedAt time.Time, launch bool) metadata.BuildpackLayerMetadata {
+			return metadata.BuildpackLayerMetadata{
+				LayerMetadata:              metadata.LayerMetadata{SHA: layerSHA(name), Size: int64(len(name))},
+				BuildpackLayerMetadataFile: metadata.BuildpackLayerMetadataFile{Cache: true, Launch: launch, Data: map[string]interface{}{"key": name}},
+				CacheLayerMetadata:         metadata.CacheLayerMetadata{Relative: true, CachedAt: &cachedAt},
+			}
+		}
+		return cache.Metadata{
+			StackID: "some.stack.id",
+			Buildpacks: []metadata.BuildpackLayersMetadata{
+				{
+					ID:      "buildpack.a",
+					Version: "1.0.0",
+					Layers: map[string]metadata.BuildpackLayerMetadata{
+						"old-layer": layer("a-old", oldTime, true),
+						"new-layer": layer("a-new", newTime, false),
+					},
+				},
+				{
+					ID:      "buildpack.b",
+					Version: "2.0.0",
+					Layers: map[string]metadata.BuildpackLayerMetadata{
+						"old-layer": layer("b-old", oldTime, false),
+					},
+				},
+			},
+		}
+	}
+
+	identifiers := func(layers []lifecycle.CachedLayer) []string {
+		var ids []string
+		for _, l := range layers {
+			ids = append(ids, l.Identifier())
+		}
+		return ids
+	}
+
+	it.Before(func() {
+		var err error
+		cacheDir, err = ioutil.TempDir("", "lifecycle.cache-inspector")
+		h.AssertNil(t, err)
+
+		volumeCache, err := cache.NewVolumeCache(cacheDir)
+		h.AssertNil(t, err)
+		for _, name := range []string{"a-old", "a-new", "b-old"} {
+			w, err := volumeCache.NewLayerWriter()
+			h.AssertNil(t, err)
+			_, err = w.Write([]byte(name))
+			h.AssertNil(t, err)
+			h.AssertNil(t, w.Commit(layerSHA(name)))
+			shas[name] = layerSHA(name)
+		}
+		h.AssertNil(t, volumeCache.SetMetadata(cacheMetadata()))
+		h.AssertNil(t, volumeCache.Commit())
+	})
+
+	it.After(func() {
+		h.AssertNil(t, os.RemoveAll(cacheDir))
+	})
+
+	openCache := func() *cache.VolumeCache {
+		t.Helper()
+		volumeCache, err := cache.NewVolumeCache(cacheDir)
+		h.AssertNil(t, err)
+		return volumeCache
+	}
+
+	when("#ListCache", func() {
+		it("lists the layers of each buildpack in order", func() {
+			layers, err := lifecycle.ListCache(openCache())
+			h.AssertNil(t, err)
+
+			h.AssertEq(t, identifiers(layers), []string{"buildpack.a:new-layer", "buildpack.a:old-layer", "buildpack.b:old-layer"})
+			h.AssertEq(t, layers[1].Version, "1.0.0")
+			h.AssertEq(t, layers[1].SHA, shas["a-old"])
+			h.AssertEq(t, layers[1].Size, int64(5))
+			h.AssertEq(t, layers[1].Launch, true)
+			h.AssertEq(t, *layers[1].CachedAt, oldTime)
+			h.AssertEq(t, layers[1].Data, map[string]interface{}{"key": "a-old"})
+		})
+	})
+
+	when("#PruneCache", func() {
+		prune := func(filter lifecycle.CachePruneFilter) ([]string, []string) {
+			t.Helper()
+			pruned, err := lifecycle.PruneCache(openCache(), filter)
+			h.AssertNil(t, err)
+			remaining, err := lifecycle.ListCache(openCache())
+			h.AssertNil(t, err)
+			return identifiers(pruned), identifiers(remaining)
+		}
+
+		it("prunes the layers of a buildpack", func() {
+			pruned, remaining := prune(lifecycle.CachePruneFilter{Buildpacks: []string{"buildpack.a"}})
+			h.AssertEq(t, pruned, []string{"buildpack.a:new-layer", "buildpack.a:old-layer"})
+			h.AssertEq(t, remaining, []string{"buildpack.b:old-layer"})
+		})
+
+		it("prunes layers by name", func() {
+			pruned, remaining := prune(lifecycle.CachePruneFilter{Layers: []string{"old-layer"}})
+			h.AssertEq(t, pruned, []string{"buildpack.a:old-layer", "buildpack.b:old-layer"})
+			h.AssertEq(t, remaining, []string{"buildpack.a:new-layer"})
+		})
+
+		it("prunes layers by buildpack ID and name", func() {
+			pruned, remaining := prune(lifecycle.CachePruneFilter{Layers: []string{"buildpack.b:old-layer"}})
+			h.AssertEq(t, pruned, []string{"buildpack.b:old-layer"})
+			h.AssertEq(t, remaining, []string{"buildpack.a:new-layer", "buildpack.a:old-layer"})
+		})
+
+		it("prunes layers cached before a time", func() {
+			pruned, remaining := prune(lifecycle.CachePruneFilter{CachedBefore: newTime})
+			h.AssertEq(t, pruned, []string{"buildpack.a:old-layer", "buildpack.b:old-layer"})
+			h.AssertEq(t, remaining, []string{"buildpack.a:new-layer"})
+		})
+
+		it("prunes layers matching every criterion", func() {
+			pruned, remaining := prune(lifecycle.CachePruneFilter{Buildpacks: []string{"buildpack.a"}, CachedBefore: newTime})
+			h.AssertEq(t, pruned, []string{"buildpack.a:old-layer"})
+			h.AssertEq(t, remaining, []string{"buildpack.a:new-layer", "buildpack.b:old-layer"})
+		})
+
+		it("removes pruned layers from the cache and keeps the others", func() {
+			prune(lifecycle.CachePruneFilter{Buildpacks: []string{"buildpack.a"}})
+
+			volumeCache := openCache()
+			for name, expected := range map[string]bool{"a-old": false, "a-new": false, "b-old": true} {
+				has, err := volumeCache.HasLayer(shas[name])
+				h.AssertNil(t, err)
+				h.AssertEq(t, has, expected)
+			}
+			meta, err := volumeCache.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, meta.StackID, "some.stack.id")
+		})
+
+		it("fails without criteria", func() {
+			_, err := lifecycle.PruneCache(openCache(), lifecycle.CachePruneFilter{})
+			h.AssertError(t, err, "no layers selected to prune")
+		})
+
+		it("leaves the cache unchanged when it fails", func() {
+			h.AssertNil(t, os.Remove(filepath.Join(cacheDir, "committed", shas["b-old"]+".tar")))
+
+			_, err := lifecycle.PruneCache(openCache(), lifecycle.CachePruneFilter{Buildpacks: []string{"buildpack.a"}})
+			h.AssertError(t, err, "keeping layer 'buildpack.b:old-layer'")
+
+			layers, err := lifecycle.ListCache(openCache())
+			h.AssertNil(t, err)
+			h.AssertEq(t, len(layers), 3)
+		})
+
+		when("the cache is an image", func() {
+			var (
+				origImage *fakes.Image
+				newImage  *fakes.Image
+			)
+
+			it.Before(func() {
+				origImage = fakes.NewImage("some-cache-image", "", nil)
+				newImage = fakes.NewImage("some-cache-image", "", nil)
+				h.AssertNil(t, cache.NewImageCache(origImage, origImage).SetMetadata(cacheMetadata()))
+				for name, sha := range shas {
+					path := filepath.Join(cacheDir, name+".tar")
+					h.AssertNil(t, ioutil.WriteFile(path, []byte(name), 0666))
+					newImage.AddPreviousLayer(sha, path)
+				}
+			})
+
+			it.After(func() {
+				origImage.Cleanup()
+				newImage.Cleanup()
+			})
+
+			it("saves an image with the remaining layers", func() {
+				pruned, err := lifecycle.PruneCache(cache.NewImageCache(origImage, newImage), lifecycle.CachePruneFilter{Layers: []string{"old-layer"}})
+				h.AssertNil(t, err)
+				h.AssertEq(t, identifiers(pruned), []string{"buildpack.a:old-layer", "buildpack.b:old-layer"})
+
+				h.AssertEq(t, newImage.IsSaved(), true)
+				h.AssertEq(t, newImage.ReusedLayers(), []string{shas["a-new"]})
+				layers, err := lifecycle.ListCache(cache.NewImageCache(newImage, newImage))
+				h.AssertNil(t, err)
+				h.AssertEq(t, identifiers(layers), []string{"buildpack.a:new-layer"})
+			})
+		})
+	})
+}
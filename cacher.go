@@ -3,8 +3,9 @@ package lifecycle
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -18,17 +19,23 @@ type Cache interface {
 	Name() string
 	SetMetadata(metadata cache.Metadata) error
 	RetrieveMetadata() (cache.Metadata, error)
-	AddLayerFile(sha string, tarPath string) error
+	NewLayerWriter() (cache.LayerWriter, error)
 	ReuseLayer(sha string) error
 	RetrieveLayer(sha string) (io.ReadCloser, error)
 	Commit() error
 }
 
 type Cacher struct {
-	ArtifactsDir string
-	Buildpacks   []Buildpack
-	Out, Err     *log.Logger
-	UID, GID     int
+	Buildpacks []Buildpack
+	StackID    string
+	Out, Err   *log.Logger
+	UID, GID   int
+	// SourceDateEpoch is the modification time of layer entries, which must match the exporter's so that the
+	// app image SHAs recorded for launch layers match the app image.
+	SourceDateEpoch time.Time
+	// HashLayerContents fingerprints layers by the contents of their files rather than by their modification
+	// times. It is implied by SourceDateEpoch, since pinned modification times do not change with the contents.
+	HashLayerContents bool
 }
 
 func (c *Cacher) Cache(layersDir string, cacheStore Cache) error {
@@ -37,7 +44,7 @@ func (c *Cacher) Cache(layersDir string, cacheStore Cache) error {
 		return errors.Wrap(err, "metadata for previous cache")
 	}
 
-	newMetadata := cache.Metadata{}
+	newMetadata := cache.Metadata{StackID: c.StackID}
 	for _, bp := range c.Buildpacks {
 		bpDir, err := readBuildpackLayersDir(layersDir, bp)
 		if err != nil {
@@ -57,7 +64,7 @@ func (c *Cacher) Cache(layersDir string, cacheStore Cache) error {
 				return err
 			}
 			origLayerMetadata := origMetadata.MetadataForBuildpack(bp.ID).Layers[l.name()]
-			if data.SHA, err = c.addOrReuseLayer(cacheStore, l, origLayerMetadata.SHA); err != nil {
+			if data.LayerMetadata, data.CacheLayerMetadata, err = c.addOrReuseLayer(cacheStore, l, data.Launch, origLayerMetadata); err != nil {
 				return err
 			}
 			bpMetadata.Layers[l.name()] = data
@@ -72,18 +79,93 @@ func (c *Cacher) Cache(layersDir string, cacheStore Cache) error {
 	return cacheStore.Commit()
 }
 
-func (c *Cacher) addOrReuseLayer(cache Cache, layer bpLayer, previousSHA string) (string, error) {
-	tarPath := filepath.Join(c.ArtifactsDir, escapeID(layer.Identifier())+".tar")
-	sha, err := archive.WriteTarFile(layer.Path(), tarPath, c.UID, c.GID)
+// addOrReuseLayer caches layer archived relative to its directory, so that it can be restored into any
+// layers directory. Layers cached by absolute path are reused as they are while their contents are unchanged.
+// A layer that can no longer be reused, such as one removed from the cache because it was corrupt, is cached again.
+func (c *Cacher) addOrReuseLayer(cache Cache, layer bpLayer, launch bool, previous metadata.BuildpackLayerMetadata) (metadata.LayerMetadata, metadata.CacheLayerMetadata, error) {
+	fingerprint, err := archive.Fingerprint(layer.Path(), c.UID, c.GID, c.modTime(), c.hashContents())
 	if err != nil {
-		return "", errors.Wrapf(err, "caching layer '%s'", layer.Identifier())
+		return metadata.LayerMetadata{}, metadata.CacheLayerMetadata{}, errors.Wrapf(err, "fingerprinting layer '%s'", layer.Identifier())
 	}
+	if previous.SHA != "" && previous.Fingerprint == fingerprint {
+		cacheMD, err := c.cacheMetadata(layer, launch, previous.CacheLayerMetadata)
+		if err != nil {
+			return metadata.LayerMetadata{}, metadata.CacheLayerMetadata{}, err
+		}
+		if err := cache.ReuseLayer(previous.SHA); err == nil {
+			c.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), previous.SHA)
+			return previous.LayerMetadata, cacheMD, nil
+		}
+	}
+
+	w, err := cache.NewLayerWriter()
+	if err != nil {
+		return metadata.LayerMetadata{}, metadata.CacheLayerMetadata{}, errors.Wrapf(err, "caching layer '%s'", layer.Identifier())
+	}
+	defer w.Close()
 
-	if sha == previousSHA {
-		c.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), sha)
-		return sha, cache.ReuseLayer(previousSHA)
+	cw := &countingWriter{w: w}
+	now := time.Now().UTC()
+	cacheMD := metadata.CacheLayerMetadata{Relative: true, CachedAt: &now}
+	var sha string
+	if launch {
+		sha, cacheMD.LaunchSHA, err = archive.WriteRelativeLayerAndDigest(cw, layer.Path(), c.UID, c.GID, c.modTime())
+	} else {
+		sha, err = archive.WriteRelativeLayer(cw, layer.Path(), c.UID, c.GID, c.modTime())
+	}
+	if err != nil {
+		return metadata.LayerMetadata{}, metadata.CacheLayerMetadata{}, errors.Wrapf(err, "caching layer '%s'", layer.Identifier())
+	}
+	if sha == previous.SHA && previous.CachedAt != nil {
+		cacheMD.CachedAt = previous.CachedAt
+	}
+
+	md := metadata.LayerMetadata{SHA: sha, Fingerprint: fingerprint, Size: cw.n}
+	if sha == previous.SHA {
+		if err := cache.ReuseLayer(previous.SHA); err == nil {
+			c.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), sha)
+			return md, cacheMD, nil
+		}
 	}
 
 	c.Out.Printf("Caching layer '%s' with SHA %s\n", layer.Identifier(), sha)
-	return sha, cache.AddLayerFile(sha, tarPath)
+	return md, cacheMD, w.Commit(sha)
+}
+
+// cacheMetadata records the SHA a reused relative launch layer has in the app image, which differs from its
+// SHA in the cache, if the previous metadata lacks it. The SHA of a layer cached by absolute path is the same
+// in both. Layers cached anew get their launch SHA as they are written.
+func (c *Cacher) cacheMetadata(layer bpLayer, launch bool, md metadata.CacheLayerMetadata) (metadata.CacheLayerMetadata, error) {
+	if !launch || !md.Relative || md.LaunchSHA != "" {
+		return md, nil
+	}
+	sha, err := archive.WriteLayer(ioutil.Discard, layer.Path(), c.UID, c.GID, c.modTime(), nil)
+	if err != nil {
+		return md, errors.Wrapf(err, "hashing launch layer '%s'", layer.Identifier())
+	}
+	md.LaunchSHA = sha
+	return md, nil
+}
+
+func (c *Cacher) modTime() time.Time {
+	if c.SourceDateEpoch.IsZero() {
+		return archive.NormalizedDateTime
+	}
+	return c.SourceDateEpoch
+}
+
+func (c *Cacher) hashContents() bool {
+	return c.HashLayerContents || !c.SourceDateEpoch.IsZero()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
 }
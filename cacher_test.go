@@ -15,6 +15,7 @@ import (
 	"github.com/sclevine/spec/report"
 
 	"github.com/buildpack/lifecycle"
+	"github.com/buildpack/lifecycle/archive"
 	"github.com/buildpack/lifecycle/cache"
 	h "github.com/buildpack/lifecycle/testhelpers"
 )
@@ -51,14 +52,14 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 			h.AssertNil(t, err)
 
 			subject = &lifecycle.Cacher{
-				ArtifactsDir: tmpDir,
 				Buildpacks: []lifecycle.Buildpack{
-					{ID: "buildpack.id"},
+					{ID: "buildpack.id", Version: "1.2.3"},
 					{ID: "other.buildpack.id"},
 				},
-				Out: emptyLogger,
-				UID: 1234,
-				GID: 4321,
+				StackID: "some.stack.id",
+				Out:     emptyLogger,
+				UID:     1234,
+				GID:     4321,
 			}
 		})
 
@@ -70,8 +71,8 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 		when("the layers are valid", func() {
 			it.Before(func() {
 				layersDir = filepath.Join("testdata", "cacher", "layers")
-				cacheTrueLayerSHA = "sha256:" + h.ComputeSHA256ForPath(t, filepath.Join(layersDir, "buildpack.id/cache-true-layer"), 1234, 4321)
-				otherBuildpackLayerSHA = "sha256:" + h.ComputeSHA256ForPath(t, filepath.Join(layersDir, "other.buildpack.id/other-buildpack-layer"), 1234, 4321)
+				cacheTrueLayerSHA = relativeLayerSHA(t, filepath.Join(layersDir, "buildpack.id/cache-true-layer"), 1234, 4321)
+				otherBuildpackLayerSHA = relativeLayerSHA(t, filepath.Join(layersDir, "other.buildpack.id/other-buildpack-layer"), 1234, 4321)
 			})
 
 			when("there is no previous cache", func() {
@@ -82,14 +83,14 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 					assertTarFileContents(
 						t,
 						filepath.Join(cacheDir, "committed", cacheTrueLayerSHA+".tar"),
-						filepath.Join(layersDir, "buildpack.id/cache-true-layer/file-from-cache-true-layer"),
+						"file-from-cache-true-layer",
 						"file-from-cache-true-contents",
 					)
 
 					assertTarFileContents(
 						t,
 						filepath.Join(cacheDir, "committed", otherBuildpackLayerSHA+".tar"),
-						filepath.Join(layersDir, "other.buildpack.id/other-buildpack-layer/other-buildpack-layer-file"),
+						"other-buildpack-layer-file",
 						"other-buildpack-layer-contents",
 					)
 				})
@@ -101,7 +102,7 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 					assertTarFileOwner(
 						t,
 						filepath.Join(cacheDir, "committed", cacheTrueLayerSHA+".tar"),
-						filepath.Join(layersDir, "buildpack.id/cache-true-layer/file-from-cache-true-layer"),
+						"file-from-cache-true-layer",
 						1234,
 						4321,
 					)
@@ -109,7 +110,7 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 					assertTarFileOwner(
 						t,
 						filepath.Join(cacheDir, "committed", otherBuildpackLayerSHA+".tar"),
-						filepath.Join(layersDir, "other.buildpack.id/other-buildpack-layer/other-buildpack-layer-file"),
+						"other-buildpack-layer-file",
 						1234,
 						4321,
 					)
@@ -122,9 +123,24 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 					metadata, err := testCache.RetrieveMetadata()
 					h.AssertNil(t, err)
 
+					t.Log("records the size of layers and when they were cached")
+					if metadata.Buildpacks[0].Layers["cache-true-layer"].Size == 0 {
+						t.Fatal("expected layer size to be recorded in cache metadata")
+					}
+					if metadata.Buildpacks[0].Layers["cache-true-layer"].CachedAt == nil {
+						t.Fatal("expected layer cache time to be recorded in cache metadata")
+					}
+
+					t.Log("records the stack and buildpack versions")
+					h.AssertEq(t, metadata.StackID, "some.stack.id")
+					h.AssertEq(t, metadata.Buildpacks[0].Version, "1.2.3")
+
 					t.Log("adds layer shas to metadata")
 					h.AssertEq(t, metadata.Buildpacks[0].ID, "buildpack.id")
 					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].SHA, cacheTrueLayerSHA)
+					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].Relative, true)
+					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].LaunchSHA,
+						"sha256:"+h.ComputeSHA256ForPath(t, filepath.Join(layersDir, "buildpack.id/cache-true-layer"), 1234, 4321))
 					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].Launch, true)
 					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].Build, false)
 					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].Cache, true)
@@ -133,6 +149,18 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 					})
 				})
 
+				it("records the launch SHA the exporter gives layers when a source date epoch is set", func() {
+					epoch := time.Date(2019, time.August, 1, 12, 0, 0, 0, time.UTC)
+					subject.SourceDateEpoch = epoch
+					h.AssertNil(t, subject.Cache(layersDir, testCache))
+
+					exportedSHA, err := archive.WriteTarFile(filepath.Join(layersDir, "buildpack.id/cache-true-layer"), filepath.Join(tmpDir, "exported.tar"), 1234, 4321, epoch)
+					h.AssertNil(t, err)
+					metadata, err := testCache.RetrieveMetadata()
+					h.AssertNil(t, err)
+					h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].LaunchSHA, exportedSHA)
+				})
+
 				it("doesn't export uncached layers", func() {
 					err := subject.Cache(layersDir, testCache)
 					h.AssertNil(t, err)
@@ -150,7 +178,7 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 				)
 
 				it.Before(func() {
-					computedReusableLayerSHA = "sha256:" + h.ComputeSHA256ForPath(t, filepath.Join(layersDir, "buildpack.id/cache-true-no-sha-layer"), 1234, 4321)
+					computedReusableLayerSHA = relativeLayerSHA(t, filepath.Join(layersDir, "buildpack.id/cache-true-no-sha-layer"), 1234, 4321)
 					metadataTemplate = `{
 					"buildpacks": [
 					 {
@@ -196,6 +224,35 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 						h.AssertEq(t, previousLayers, reusedLayers)
 					})
 
+					it("reuses unchanged layers without writing tars", func() {
+						h.AssertNil(t, os.RemoveAll(tmpDir))
+						h.AssertNil(t, os.Mkdir(tmpDir, 0777))
+
+						err := subject.Cache(layersDir, testCache)
+						h.AssertNil(t, err)
+
+						tars, err := filepath.Glob(filepath.Join(tmpDir, "*.tar"))
+						h.AssertNil(t, err)
+						h.AssertEq(t, len(tars), 0)
+
+						metadata, err := testCache.RetrieveMetadata()
+						h.AssertNil(t, err)
+						h.AssertEq(t, metadata.Buildpacks[0].Layers["cache-true-layer"].SHA, cacheTrueLayerSHA)
+						if metadata.Buildpacks[0].Layers["cache-true-layer"].Fingerprint == "" {
+							t.Fatal("expected fingerprint to be recorded in cache metadata")
+						}
+					})
+
+					it("caches layers again that were removed from the cache", func() {
+						h.AssertNil(t, os.Remove(filepath.Join(cacheDir, "committed", cacheTrueLayerSHA+".tar")))
+
+						h.AssertNil(t, subject.Cache(layersDir, testCache))
+
+						if _, err := os.Stat(filepath.Join(cacheDir, "committed", cacheTrueLayerSHA+".tar")); err != nil {
+							t.Fatalf("expected layer to be cached again: %s", err)
+						}
+					})
+
 					it("sets cache metadata", func() {
 						err := subject.Cache(layersDir, testCache)
 						h.AssertNil(t, err)
@@ -287,3 +344,10 @@ func testCacher(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 }
+
+func relativeLayerSHA(t *testing.T, path string, uid, gid int) string {
+	t.Helper()
+	sha, err := archive.WriteRelativeLayer(ioutil.Discard, path, uid, gid, archive.NormalizedDateTime)
+	h.AssertNil(t, err)
+	return sha
+}
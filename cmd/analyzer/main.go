@@ -16,6 +16,7 @@ import (
 	"github.com/buildpack/lifecycle"
 	"github.com/buildpack/lifecycle/cmd"
 	"github.com/buildpack/lifecycle/image/auth"
+	"github.com/buildpack/lifecycle/image/signature"
 )
 
 var (
@@ -30,6 +31,7 @@ var (
 	useDaemon    bool
 	useHelpers   bool
 	printVersion bool
+	verifyKey    string
 )
 
 func init() {
@@ -43,6 +45,7 @@ func init() {
 	cmd.FlagUseCredHelpers(&useHelpers)
 	cmd.FlagSkipLayers(&skipLayers)
 	cmd.FlagVersion(&printVersion)
+	cmd.FlagVerificationKeyPath(&verifyKey)
 }
 
 func main() {
@@ -61,6 +64,9 @@ func main() {
 	if flag.Arg(0) == "" {
 		cmd.Exit(cmd.FailErrCode(errors.New("image argument is required"), cmd.CodeInvalidArgs, "parse arguments"))
 	}
+	if verifyKey != "" && useDaemon {
+		cmd.Exit(cmd.FailErrCode(errors.New("signatures of images in a Docker daemon cannot be verified"), cmd.CodeInvalidArgs, "parse arguments"))
+	}
 	repoName = flag.Arg(0)
 	cmd.Exit(analyzer())
 }
@@ -89,6 +95,19 @@ func analyzer() error {
 		SkipLayers:   skipLayers,
 	}
 
+	if verifyKey != "" {
+		key, err := signature.ReadPublicKey(verifyKey)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "read verification key")
+		}
+		analyzer.Verifier = &signature.Verifier{
+			Key: key,
+			NewImage: func(ref string) (imgutil.Image, error) {
+				return remote.NewImage(ref, auth.DefaultEnvKeychain(), remote.FromBaseImage(ref))
+			},
+		}
+	}
+
 	var img imgutil.Image
 	if useDaemon {
 		dockerClient, err := cmd.DockerClient()
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildpack/imgutil/remote"
+	"github.com/docker/go-units"
+
+	"github.com/buildpack/lifecycle"
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/cmd"
+	"github.com/buildpack/lifecycle/image/auth"
+)
+
+var (
+	cacheImageTag  string
+	cacheDir       string
+	cacheLayout    string
+	cacheArchive   string
+	cacheBucket    string
+	bucketEndpoint string
+	bucketRegion   string
+	pruneBuildpack string
+	pruneLayer     string
+	pruneOlderThan time.Duration
+	useDaemon      bool
+	printVersion   bool
+)
+
+func init() {
+	cmd.FlagCacheImage(&cacheImageTag)
+	cmd.FlagCacheDir(&cacheDir)
+	cmd.FlagCacheLayout(&cacheLayout)
+	cmd.FlagCacheArchive(&cacheArchive)
+	cmd.FlagCacheBucket(&cacheBucket)
+	cmd.FlagCacheBucketEndpoint(&bucketEndpoint)
+	cmd.FlagCacheBucketRegion(&bucketRegion)
+	cmd.FlagPruneBuildpacks(&pruneBuildpack)
+	cmd.FlagPruneLayers(&pruneLayer)
+	cmd.FlagPruneOlderThan(&pruneOlderThan)
+	cmd.FlagUseDaemon(&useDaemon)
+	cmd.FlagVersion(&printVersion)
+}
+
+func main() {
+	// suppress output from libraries, lifecycle will not use standard logger
+	log.SetOutput(ioutil.Discard)
+
+	flag.Parse()
+
+	if printVersion {
+		cmd.ExitWithVersion()
+	}
+
+	if flag.NArg() > 0 {
+		cmd.Exit(cmd.FailErrCode(errors.New("received unexpected args"), cmd.CodeInvalidArgs, "parse arguments"))
+	}
+	if cacheImageTag == "" && cacheLayout == "" && cacheBucket == "" && cacheArchive == "" && cacheDir == "" {
+		cmd.Exit(cmd.FailErrCode(errors.New("must supply either -image, -layout, -bucket, -archive or -path"), cmd.CodeInvalidArgs, "parse arguments"))
+	}
+	cmd.Exit(inspect())
+}
+
+func inspect() error {
+	cacheStore, err := newCache()
+	if err != nil {
+		return err
+	}
+	if imageCache, ok := cacheStore.(*cache.ImageCache); ok {
+		defer imageCache.Cleanup()
+	}
+
+	filter := lifecycle.CachePruneFilter{
+		Buildpacks: splitList(pruneBuildpack),
+		Layers:     splitList(pruneLayer),
+	}
+	if pruneOlderThan > 0 {
+		filter.CachedBefore = time.Now().Add(-pruneOlderThan)
+	}
+	if filter.Empty() {
+		layers, err := lifecycle.ListCache(cacheStore)
+		if err != nil {
+			return cmd.FailErr(err, "list cache")
+		}
+		return printLayers(layers)
+	}
+
+	pruned, err := lifecycle.PruneCache(cacheStore, filter)
+	if err != nil {
+		return cmd.FailErr(err, "prune cache")
+	}
+	for _, l := range pruned {
+		cmd.OutLogger.Printf("Pruned layer '%s' with SHA %s from cache '%s'", l.Identifier(), l.SHA, cacheStore.Name())
+	}
+	return nil
+}
+
+func newCache() (lifecycle.Cache, error) {
+	if cacheImageTag != "" && useDaemon {
+		imageCache, err := cmd.NewDaemonImageCache(cacheImageTag)
+		if err != nil {
+			return nil, cmd.FailErr(err, "create daemon image cache")
+		}
+		return imageCache, nil
+	}
+	if cacheImageTag == "" && cacheLayout != "" {
+		imageCache, err := cmd.NewLayoutImageCache(cacheLayout)
+		if err != nil {
+			return nil, cmd.FailErr(err, "create layout image cache")
+		}
+		return imageCache, nil
+	}
+	if cacheImageTag == "" && cacheBucket != "" {
+		bucketCache, err := cmd.NewBucketCache(cacheBucket, bucketEndpoint, bucketRegion)
+		if err != nil {
+			return nil, cmd.FailErrCode(err, cmd.CodeInvalidArgs, "create bucket cache")
+		}
+		return bucketCache, nil
+	}
+	if cacheImageTag == "" && cacheArchive != "" {
+		archiveCache, err := cache.NewArchiveCache(cacheArchive)
+		if err != nil {
+			return nil, cmd.FailErr(err, "open cache archive")
+		}
+		return archiveCache, nil
+	}
+	if cacheImageTag == "" {
+		volumeCache, err := cache.NewVolumeCache(cacheDir)
+		if err != nil {
+			return nil, cmd.FailErr(err, "create volume cache")
+		}
+		return volumeCache, nil
+	}
+
+	origCacheImage, err := remote.NewImage(
+		cacheImageTag,
+		auth.DefaultEnvKeychain(),
+		remote.FromBaseImage(cacheImageTag),
+	)
+	if err != nil {
+		return nil, cmd.FailErr(err, "accessing cache image")
+	}
+
+	emptyImage, err := remote.NewImage(
+		cacheImageTag,
+		auth.DefaultEnvKeychain(),
+		remote.WithPreviousImage(cacheImageTag),
+	)
+	if err != nil {
+		return nil, cmd.FailErr(err, "creating new cache image")
+	}
+
+	return cache.NewImageCache(origCacheImage, emptyImage), nil
+}
+
+func printLayers(layers []lifecycle.CachedLayer) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tVERSION\tSHA\tSIZE\tFLAGS\tCACHED\tMETADATA")
+	for _, l := range layers {
+		size, cached := "-", "-"
+		if l.Size > 0 {
+			size = units.HumanSize(float64(l.Size))
+		}
+		if l.CachedAt != nil {
+			cached = l.CachedAt.Format(time.RFC3339)
+		}
+		data, err := json.Marshal(l.Data)
+		if err != nil {
+			return cmd.FailErr(err, "print layer metadata")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Identifier(), l.Version, l.SHA, size, flags(l), cached, data)
+	}
+	return w.Flush()
+}
+
+func flags(l lifecycle.CachedLayer) string {
+	var flags []string
+	if l.Build {
+		flags = append(flags, "build")
+	}
+	if l.Launch {
+		flags = append(flags, "launch")
+	}
+	if l.Cache {
+		flags = append(flags, "cache")
+	}
+	return strings.Join(flags, ",")
+}
+
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -10,28 +10,53 @@ import (
 	"github.com/buildpack/imgutil/remote"
 
 	"github.com/buildpack/lifecycle"
+	"github.com/buildpack/lifecycle/archive"
 	"github.com/buildpack/lifecycle/cache"
 	"github.com/buildpack/lifecycle/cmd"
 	"github.com/buildpack/lifecycle/image/auth"
 )
 
 var (
-	cacheImageTag string
-	cacheDir      string
-	layersDir     string
-	groupPath     string
-	uid           int
-	gid           int
-	printVersion  bool
+	cacheImageTag  string
+	cacheDir       string
+	cacheLayout    string
+	cacheExport    string
+	cacheBucket    string
+	cacheSeeds     string
+	bucketEndpoint string
+	bucketRegion   string
+	compression    string
+	maxSize        string
+	layersDir      string
+	groupPath      string
+	stackID        string
+	sourceEpoch    string
+	hashContents   bool
+	uid            int
+	gid            int
+	useDaemon      bool
+	printVersion   bool
 )
 
 func init() {
 	cmd.FlagLayersDir(&layersDir)
 	cmd.FlagCacheImage(&cacheImageTag)
 	cmd.FlagCacheDir(&cacheDir)
+	cmd.FlagCacheLayout(&cacheLayout)
+	cmd.FlagCacheExport(&cacheExport)
+	cmd.FlagCacheBucket(&cacheBucket)
+	cmd.FlagCacheSeeds(&cacheSeeds)
+	cmd.FlagCacheBucketEndpoint(&bucketEndpoint)
+	cmd.FlagCacheBucketRegion(&bucketRegion)
+	cmd.FlagCacheCompression(&compression)
+	cmd.FlagCacheMaxSize(&maxSize)
 	cmd.FlagGroupPath(&groupPath)
+	cmd.FlagStackID(&stackID)
+	cmd.FlagSourceDateEpoch(&sourceEpoch)
+	cmd.FlagHashLayerContents(&hashContents)
 	cmd.FlagUID(&uid)
 	cmd.FlagGID(&gid)
+	cmd.FlagUseDaemon(&useDaemon)
 	cmd.FlagVersion(&printVersion)
 }
 
@@ -48,8 +73,8 @@ func main() {
 	if flag.NArg() > 0 {
 		cmd.Exit(cmd.FailErrCode(errors.New("received unexpected args"), cmd.CodeInvalidArgs, "parse arguments"))
 	}
-	if cacheImageTag == "" && cacheDir == "" {
-		cmd.Exit(cmd.FailErrCode(errors.New("must supply either -image or -path"), cmd.CodeInvalidArgs, "parse arguments"))
+	if cacheImageTag == "" && cacheLayout == "" && cacheBucket == "" && cacheDir == "" && cacheExport == "" {
+		cmd.Exit(cmd.FailErrCode(errors.New("must supply either -image, -layout, -bucket, -path or -export"), cmd.CodeInvalidArgs, "parse arguments"))
 	}
 	cmd.Exit(doCache())
 }
@@ -60,23 +85,32 @@ func doCache() error {
 		return cmd.FailErr(err, "read buildpack group")
 	}
 
-	artifactsDir, err := ioutil.TempDir("", "lifecycle.exporter.layer")
+	sourceDateEpoch, err := cmd.ParseSourceDateEpoch(sourceEpoch)
 	if err != nil {
-		return cmd.FailErr(err, "create temp directory")
+		return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse source date epoch")
 	}
-	defer os.RemoveAll(artifactsDir)
 
 	cacher := &lifecycle.Cacher{
-		Buildpacks:   group.Group,
-		ArtifactsDir: artifactsDir,
-		Out:          log.New(os.Stdout, "", 0),
-		Err:          log.New(os.Stderr, "", 0),
-		UID:          uid,
-		GID:          gid,
+		Buildpacks:        group.Group,
+		StackID:           stackID,
+		Out:               log.New(os.Stdout, "", 0),
+		Err:               log.New(os.Stderr, "", 0),
+		UID:               uid,
+		GID:               gid,
+		SourceDateEpoch:   sourceDateEpoch,
+		HashLayerContents: hashContents,
 	}
 
 	var cacheStore lifecycle.Cache
-	if cacheImageTag != "" {
+	var volumeCache *cache.VolumeCache
+	if cacheImageTag != "" && useDaemon {
+		imageCache, err := cmd.NewDaemonImageCache(cacheImageTag)
+		if err != nil {
+			return cmd.FailErr(err, "create daemon image cache")
+		}
+		defer imageCache.Cleanup()
+		cacheStore = imageCache
+	} else if cacheImageTag != "" {
 		origCacheImage, err := remote.NewImage(
 			cacheImageTag,
 			auth.DefaultEnvKeychain(),
@@ -99,17 +133,61 @@ func doCache() error {
 			origCacheImage,
 			emptyImage,
 		)
+	} else if cacheLayout != "" {
+		cacheStore, err = cmd.NewLayoutImageCache(cacheLayout)
+		if err != nil {
+			return cmd.FailErr(err, "create layout image cache")
+		}
+	} else if cacheBucket != "" {
+		cacheStore, err = cmd.NewBucketCache(cacheBucket, bucketEndpoint, bucketRegion)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "create bucket cache")
+		}
 	} else {
-		var err error
-		cacheStore, err = cache.NewVolumeCache(cacheDir)
+		if cacheDir == "" {
+			// only an archive of the cache was requested, so the cache is kept in a temporary directory
+			tmpDir, err := ioutil.TempDir("", "lifecycle.cache")
+			if err != nil {
+				return cmd.FailErr(err, "create volume cache")
+			}
+			defer os.RemoveAll(tmpDir)
+			cacheDir = tmpDir
+		}
+		compression, err := archive.ParseCompression(compression)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse arguments")
+		}
+		maxSize, err := cmd.ParseSize(maxSize)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse arguments")
+		}
+		volumeCache, err = cache.NewVolumeCache(cacheDir, cache.WithCompression(compression), cache.WithMaxSize(maxSize))
 		if err != nil {
 			return cmd.FailErr(err, "create volume cache")
 		}
+		cacheStore = volumeCache
+	}
+
+	if cacheSeeds != "" {
+		seeds, err := cmd.NewSeedCaches(cacheSeeds, bucketEndpoint, bucketRegion)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "create seed caches")
+		}
+		cacheStore = cache.NewLayeredCache(cacheStore, seeds...)
 	}
 
 	if err := cacher.Cache(layersDir, cacheStore); err != nil {
 		return cmd.FailErrCode(err, cmd.CodeFailed, "cache")
 	}
+	if volumeCache != nil {
+		cmd.PrintEvictions(cmd.OutLogger, cacheDir, volumeCache.EvictionReport())
+	}
+	if cacheExport != "" {
+		if err := cache.WriteArchive(cacheExport, cacheStore); err != nil {
+			return cmd.FailErr(err, "export cache")
+		}
+		cmd.OutLogger.Printf("Exported cache '%s' to '%s'", cacheStore.Name(), cacheExport)
+	}
 
 	return nil
 }
@@ -4,12 +4,19 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/image/layout"
+	"github.com/buildpack/lifecycle/image/local"
 )
 
 const (
@@ -22,30 +29,54 @@ const (
 	DefaultStackPath     = "/cnb/stack.toml"
 	DefaultAnalyzedPath  = "./analyzed.toml"
 	DefaultPlanPath      = "./plan.toml"
+	DefaultReportPath    = "./report.toml"
+	DefaultPreviewPath   = "./preview.toml"
 	DefaultProcessType   = "web"
 	DefaultLauncherPath  = "/cnb/lifecycle/launcher"
 
-	EnvLayersDir         = "CNB_LAYERS_DIR"
-	EnvAppDir            = "CNB_APP_DIR"
-	EnvBuildpacksDir     = "CNB_BUILDPACKS_DIR"
-	EnvPlatformDir       = "CNB_PLATFORM_DIR"
-	EnvAnalyzedPath      = "CNB_ANALYZED_PATH"
-	EnvOrderPath         = "CNB_ORDER_PATH"
-	EnvGroupPath         = "CNB_GROUP_PATH"
-	EnvStackPath         = "CNB_STACK_PATH"
-	EnvPlanPath          = "CNB_PLAN_PATH"
-	EnvUseDaemon         = "CNB_USE_DAEMON"       // defaults to false
-	EnvUseHelpers        = "CNB_USE_CRED_HELPERS" // defaults to false
-	EnvRunImage          = "CNB_RUN_IMAGE"
-	EnvCacheImage        = "CNB_CACHE_IMAGE"
-	EnvCacheDir          = "CNB_CACHE_DIR"
-	EnvLaunchCacheDir    = "CNB_LAUNCH_CACHE_DIR"
-	EnvUID               = "CNB_USER_ID"
-	EnvGID               = "CNB_GROUP_ID"
-	EnvRegistryAuth      = "CNB_REGISTRY_AUTH"
-	EnvSkipLayers        = "CNB_ANALYZE_SKIP_LAYERS" // defaults to false
-	EnvProcessType       = "CNB_PROCESS_TYPE"
-	EnvProcessTypeLegacy = "PACK_PROCESS_TYPE" // deprecated
+	EnvLayersDir          = "CNB_LAYERS_DIR"
+	EnvAppDir             = "CNB_APP_DIR"
+	EnvBuildpacksDir      = "CNB_BUILDPACKS_DIR"
+	EnvPlatformDir        = "CNB_PLATFORM_DIR"
+	EnvAnalyzedPath       = "CNB_ANALYZED_PATH"
+	EnvOrderPath          = "CNB_ORDER_PATH"
+	EnvGroupPath          = "CNB_GROUP_PATH"
+	EnvStackPath          = "CNB_STACK_PATH"
+	EnvStackID            = "CNB_STACK_ID"
+	EnvPlanPath           = "CNB_PLAN_PATH"
+	EnvReportPath         = "CNB_REPORT_PATH"
+	EnvImageConfigPath    = "CNB_IMAGE_CONFIG_PATH"
+	EnvSlicesPath         = "CNB_SLICES_PATH"
+	EnvSigningKeyPath     = "CNB_SIGNING_KEY_PATH"
+	EnvDryRun             = "CNB_DRY_RUN" // defaults to false
+	EnvPreviewPath        = "CNB_PREVIEW_PATH"
+	EnvVerifyKeyPath      = "CNB_VERIFICATION_KEY_PATH"
+	EnvUseDaemon          = "CNB_USE_DAEMON"       // defaults to false
+	EnvUseHelpers         = "CNB_USE_CRED_HELPERS" // defaults to false
+	EnvRunImage           = "CNB_RUN_IMAGE"
+	EnvPreviousImage      = "CNB_PREVIOUS_IMAGE"
+	EnvCacheImage         = "CNB_CACHE_IMAGE"
+	EnvCacheArchive       = "CNB_CACHE_ARCHIVE"
+	EnvCacheExport        = "CNB_CACHE_EXPORT"
+	EnvCacheLayout        = "CNB_CACHE_LAYOUT"
+	EnvCacheSeeds         = "CNB_CACHE_SEEDS"
+	EnvCacheBucket        = "CNB_CACHE_BUCKET"
+	EnvBucketEndpoint     = "CNB_CACHE_BUCKET_ENDPOINT" // defaults to the AWS S3 endpoint of the region
+	EnvBucketRegion       = "CNB_CACHE_BUCKET_REGION"   // defaults to AWS_REGION, then us-east-1
+	EnvCacheDir           = "CNB_CACHE_DIR"
+	EnvCacheCompression   = "CNB_CACHE_COMPRESSION" // defaults to none
+	EnvCacheMaxSize       = "CNB_CACHE_MAX_SIZE"    // defaults to unbounded
+	EnvLaunchCacheDir     = "CNB_LAUNCH_CACHE_DIR"
+	EnvLaunchCacheMaxSize = "CNB_LAUNCH_CACHE_MAX_SIZE" // defaults to unbounded
+	EnvRestoreWorkers     = "CNB_RESTORE_WORKERS"       // defaults to 4
+	EnvUID                = "CNB_USER_ID"
+	EnvGID                = "CNB_GROUP_ID"
+	EnvHashLayerContents  = "CNB_HASH_LAYER_CONTENTS" // defaults to false
+	EnvRegistryAuth       = "CNB_REGISTRY_AUTH"
+	EnvSkipLayers         = "CNB_ANALYZE_SKIP_LAYERS" // defaults to false
+	EnvProcessType        = "CNB_PROCESS_TYPE"
+	EnvProcessTypeLegacy  = "PACK_PROCESS_TYPE" // deprecated
+	EnvSourceDateEpoch    = "SOURCE_DATE_EPOCH"
 )
 
 func FlagAnalyzedPath(dir *string) {
@@ -60,6 +91,34 @@ func FlagBuildpacksDir(dir *string) {
 	flag.StringVar(dir, "buildpacks", envOrDefault(EnvBuildpacksDir, DefaultBuildpacksDir), "path to buildpacks directory")
 }
 
+func FlagCacheArchive(path *string) {
+	flag.StringVar(path, "archive", os.Getenv(EnvCacheArchive), "path to a cache archive to restore layers from")
+}
+
+func FlagCacheExport(path *string) {
+	flag.StringVar(path, "export", os.Getenv(EnvCacheExport), "path to write an archive of the committed cache to")
+}
+
+func FlagCacheBucket(bucket *string) {
+	flag.StringVar(bucket, "bucket", os.Getenv(EnvCacheBucket), "URL of a cache bucket, e.g. 's3://bucket/prefix'")
+}
+
+func FlagCacheBucketEndpoint(endpoint *string) {
+	flag.StringVar(endpoint, "bucket-endpoint", os.Getenv(EnvBucketEndpoint), "URL of the S3-compatible service storing the cache bucket")
+}
+
+func FlagCacheBucketRegion(region *string) {
+	flag.StringVar(region, "bucket-region", envOrDefault(EnvBucketRegion, os.Getenv("AWS_REGION")), "region of the cache bucket")
+}
+
+func FlagCacheSeeds(seeds *string) {
+	flag.StringVar(seeds, "seed", os.Getenv(EnvCacheSeeds), "comma-separated read-only caches, bucket URLs, cache directories or cache archives, to restore layers missing from the cache from")
+}
+
+func FlagCacheCompression(compression *string) {
+	flag.StringVar(compression, "compression", os.Getenv(EnvCacheCompression), "compression of layers added to the cache directory: none, gzip or zstd")
+}
+
 func FlagCacheDir(dir *string) {
 	flag.StringVar(dir, "path", os.Getenv(EnvCacheDir), "path to cache directory")
 }
@@ -68,6 +127,22 @@ func FlagCacheImage(image *string) {
 	flag.StringVar(image, "image", os.Getenv(EnvCacheImage), "cache image tag name")
 }
 
+func FlagCacheLayout(dir *string) {
+	flag.StringVar(dir, "layout", os.Getenv(EnvCacheLayout), "path to an OCI image layout directory to store the cache image in")
+}
+
+func FlagCacheMaxSize(size *string) {
+	flag.StringVar(size, "max-size", os.Getenv(EnvCacheMaxSize), "maximum size of the cache directory, e.g. '10G', evicting the least recently used layers")
+}
+
+func FlagDryRun(dryRun *bool) {
+	flag.BoolVar(dryRun, "dry-run", boolEnv(EnvDryRun), "report the changes an export would make without saving the image")
+}
+
+func FlagPreviewPath(path *string) {
+	flag.StringVar(path, "preview", envOrDefault(EnvPreviewPath, DefaultPreviewPath), "path to preview.toml, written instead of the report on a dry run")
+}
+
 func FlagGID(gid *int) {
 	flag.IntVar(gid, "gid", intEnv(EnvGID), "GID of user's group in the stack's build and run images")
 }
@@ -76,10 +151,22 @@ func FlagGroupPath(path *string) {
 	flag.StringVar(path, "group", envOrDefault(EnvGroupPath, DefaultGroupPath), "path to group.toml")
 }
 
+func FlagHashLayerContents(hash *bool) {
+	flag.BoolVar(hash, "hash-layer-contents", boolEnv(EnvHashLayerContents), "detect changed layers by the contents of their files rather than their modification times")
+}
+
+func FlagImageConfigPath(path *string) {
+	flag.StringVar(path, "image-config", os.Getenv(EnvImageConfigPath), "path to a TOML file with labels, env, working dir, user and exposed ports for the app image")
+}
+
 func FlagLaunchCacheDir(dir *string) {
 	flag.StringVar(dir, "launch-cache", os.Getenv(EnvLaunchCacheDir), "path to launch cache directory")
 }
 
+func FlagLaunchCacheMaxSize(size *string) {
+	flag.StringVar(size, "launch-cache-max-size", os.Getenv(EnvLaunchCacheMaxSize), "maximum size of the launch cache directory, e.g. '10G', evicting the least recently used layers")
+}
+
 func FlagLauncherPath(path *string) {
 	flag.StringVar(path, "launcher", DefaultLauncherPath, "path to launcher binary")
 }
@@ -100,14 +187,54 @@ func FlagPlatformDir(dir *string) {
 	flag.StringVar(dir, "platform", envOrDefault(EnvPlatformDir, DefaultPlatformDir), "path to platform directory")
 }
 
+func FlagPreviousImage(image *string) {
+	flag.StringVar(image, "previous-image", os.Getenv(EnvPreviousImage), "previous app image to restore cached launch layers missing from the cache from")
+}
+
+func FlagPruneBuildpacks(ids *string) {
+	flag.StringVar(ids, "prune-buildpack", "", "comma separated IDs of the buildpacks whose layers are pruned from the cache")
+}
+
+func FlagPruneLayers(names *string) {
+	flag.StringVar(names, "prune-layer", "", "comma separated names, or <buildpack ID>:<name>, of the layers pruned from the cache")
+}
+
+func FlagPruneOlderThan(age *time.Duration) {
+	flag.DurationVar(age, "prune-older-than", 0, "prune layers cached longer ago than this duration")
+}
+
+func FlagReportPath(path *string) {
+	flag.StringVar(path, "report", envOrDefault(EnvReportPath, DefaultReportPath), "path to report.toml")
+}
+
+func FlagRestoreWorkers(workers *int) {
+	flag.IntVar(workers, "workers", intEnv(EnvRestoreWorkers), "number of cached layers to retrieve and extract concurrently")
+}
+
 func FlagRunImage(image *string) {
 	flag.StringVar(image, "image", os.Getenv(EnvRunImage), "reference to run image")
 }
 
+func FlagSigningKeyPath(path *string) {
+	flag.StringVar(path, "signing-key", os.Getenv(EnvSigningKeyPath), "path to a PEM encoded ed25519 or ECDSA private key used to sign the app image")
+}
+
+func FlagSlicesPath(path *string) {
+	flag.StringVar(path, "slices", os.Getenv(EnvSlicesPath), "path to a TOML file with slices of the app directory to export as separate layers")
+}
+
+func FlagSourceDateEpoch(epoch *string) {
+	flag.StringVar(epoch, "source-date-epoch", os.Getenv(EnvSourceDateEpoch), "seconds since the unix epoch used for layer modification times and image creation time")
+}
+
 func FlagStackPath(path *string) {
 	flag.StringVar(path, "stack", envOrDefault(EnvStackPath, DefaultStackPath), "path to stack.toml")
 }
 
+func FlagStackID(id *string) {
+	flag.StringVar(id, "stack-id", os.Getenv(EnvStackID), "ID of the stack the build runs on")
+}
+
 func FlagUID(uid *int) {
 	flag.IntVar(uid, "uid", intEnv(EnvUID), "UID of user in the stack's build and run images")
 }
@@ -124,6 +251,10 @@ func FlagSkipLayers(skip *bool) {
 	flag.BoolVar(skip, "skip-layers", boolEnv(EnvSkipLayers), "do not provide layer metadata to buildpacks")
 }
 
+func FlagVerificationKeyPath(path *string) {
+	flag.StringVar(path, "verification-key", os.Getenv(EnvVerifyKeyPath), "path to a PEM encoded public key the previous image must be signed with for its layers to be reused")
+}
+
 func FlagVersion(version *bool) {
 	flag.BoolVar(version, "version", false, "show version")
 }
@@ -226,6 +357,131 @@ func boolEnv(k string) bool {
 	return b
 }
 
+// ParseSize parses a size in bytes with an optional binary unit suffix, such as '512M' or '10G'.
+// An empty size is zero.
+func ParseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	bytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse size '%s'", size)
+	}
+	return bytes, nil
+}
+
+// ParseSourceDateEpoch parses a number of seconds since the unix epoch. An empty epoch is the zero time.
+func ParseSourceDateEpoch(epoch string) (time.Time, error) {
+	if epoch == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid source date epoch '%s'", epoch)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// PrintEvictions logs the layers evicted from a size-bounded cache.
+func PrintEvictions(logger *log.Logger, name string, report cache.EvictionReport) {
+	for _, l := range report.Evicted {
+		logger.Printf("Evicted layer '%s' (%d bytes, last used %s) from cache '%s'", l.SHA, l.Size, l.LastUsed.Format(time.RFC3339), name)
+	}
+	if len(report.Evicted) > 0 {
+		logger.Printf("Cache '%s' is %d of a maximum %d bytes", name, report.Size, report.MaxSize)
+	}
+}
+
+// NewBucketCache returns the cache stored at bucketURL, signing requests with the credentials in the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+func NewBucketCache(bucketURL, endpoint, region string) (*cache.BucketCache, error) {
+	ops := []cache.BucketCacheOption{
+		cache.WithCredentials(cache.BucketCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}),
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse bucket endpoint '%s'", endpoint)
+		}
+		ops = append(ops, cache.WithEndpoint(u))
+	}
+	if region != "" {
+		ops = append(ops, cache.WithRegion(region))
+	}
+	return cache.NewBucketCache(bucketURL, ops...)
+}
+
+// NewDaemonImageCache returns the cache stored in the image tagged tag in the Docker daemon.
+func NewDaemonImageCache(tag string) (*cache.ImageCache, error) {
+	dockerClient, err := DockerClient()
+	if err != nil {
+		return nil, err
+	}
+	origCacheImage, err := local.NewImage(tag, dockerClient, local.FromBaseImage(tag))
+	if err != nil {
+		return nil, errors.Wrap(err, "accessing cache image")
+	}
+	emptyImage, err := local.NewImage(tag, dockerClient, local.WithPreviousImage(tag))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating new cache image")
+	}
+	return cache.NewImageCache(origCacheImage, emptyImage), nil
+}
+
+// NewLayoutImageCache returns the cache stored in the image of the OCI image layout directory dir.
+func NewLayoutImageCache(dir string) (*cache.ImageCache, error) {
+	origCacheImage, err := layout.NewImage(dir, layout.FromBaseImage(dir))
+	if err != nil {
+		return nil, errors.Wrap(err, "accessing cache image")
+	}
+	emptyImage, err := layout.NewImage(dir, layout.WithPreviousImage(dir))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating new cache image")
+	}
+	return cache.NewImageCache(origCacheImage, emptyImage), nil
+}
+
+// NewSeedCaches returns the read-only caches in a comma-separated list of bucket URLs, cache directories and
+// cache archive paths.
+func NewSeedCaches(list, bucketEndpoint, bucketRegion string) ([]cache.ReadableCache, error) {
+	var seeds []cache.ReadableCache
+	for _, seed := range strings.Split(list, ",") {
+		seed = strings.TrimSpace(seed)
+		switch {
+		case seed == "":
+			continue
+		case strings.HasPrefix(seed, "s3://"):
+			bucketCache, err := NewBucketCache(seed, bucketEndpoint, bucketRegion)
+			if err != nil {
+				return nil, err
+			}
+			seeds = append(seeds, bucketCache)
+		case isDir(seed):
+			volumeCache, err := cache.NewReadOnlyVolumeCache(seed)
+			if err != nil {
+				return nil, errors.Wrapf(err, "seed cache '%s'", seed)
+			}
+			seeds = append(seeds, volumeCache)
+		default:
+			archiveCache, err := cache.NewArchiveCache(seed)
+			if err != nil {
+				return nil, errors.Wrapf(err, "seed cache '%s'", seed)
+			}
+			seeds = append(seeds, archiveCache)
+		}
+	}
+	return seeds, nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
 func envOrDefault(key string, defaultVal string) string {
 	if envVal := os.Getenv(key); envVal != "" {
 		return envVal
@@ -2,7 +2,6 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,8 +9,6 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/buildpack/imgutil"
-	"github.com/buildpack/imgutil/local"
-	"github.com/buildpack/imgutil/remote"
 	"github.com/pkg/errors"
 
 	"github.com/buildpack/lifecycle"
@@ -19,6 +16,9 @@ import (
 	"github.com/buildpack/lifecycle/cmd"
 	"github.com/buildpack/lifecycle/image"
 	"github.com/buildpack/lifecycle/image/auth"
+	"github.com/buildpack/lifecycle/image/local"
+	"github.com/buildpack/lifecycle/image/remote"
+	"github.com/buildpack/lifecycle/image/signature"
 	"github.com/buildpack/lifecycle/metadata"
 )
 
@@ -31,12 +31,24 @@ var (
 	analyzedPath   string
 	stackPath      string
 	launchCacheDir string
+	launchCacheMax string
 	launcherPath   string
 	useDaemon      bool
 	useHelpers     bool
 	uid            int
 	gid            int
 	printVersion   bool
+	sourceEpoch    string
+	hashContents   bool
+	reportPath     string
+	imageConfig    string
+	slicesPath     string
+	signingKeyPath string
+	dryRun         bool
+	previewPath    string
+
+	// launchCache is the launch cache of the daemon image being exported, if any
+	launchCache *cache.VolumeCache
 )
 
 func init() {
@@ -47,12 +59,21 @@ func init() {
 	cmd.FlagAnalyzedPath(&analyzedPath)
 	cmd.FlagStackPath(&stackPath)
 	cmd.FlagLaunchCacheDir(&launchCacheDir)
+	cmd.FlagLaunchCacheMaxSize(&launchCacheMax)
 	cmd.FlagUseDaemon(&useDaemon)
 	cmd.FlagUseCredHelpers(&useHelpers)
 	cmd.FlagUID(&uid)
 	cmd.FlagGID(&gid)
 	cmd.FlagVersion(&printVersion)
 	cmd.FlagLauncherPath(&launcherPath)
+	cmd.FlagSourceDateEpoch(&sourceEpoch)
+	cmd.FlagHashLayerContents(&hashContents)
+	cmd.FlagReportPath(&reportPath)
+	cmd.FlagImageConfigPath(&imageConfig)
+	cmd.FlagSlicesPath(&slicesPath)
+	cmd.FlagSigningKeyPath(&signingKeyPath)
+	cmd.FlagDryRun(&dryRun)
+	cmd.FlagPreviewPath(&previewPath)
 }
 
 func main() {
@@ -75,6 +96,10 @@ func main() {
 		cmd.Exit(cmd.FailErrCode(errors.New("launch cache can only be used when exporting to a Docker daemon"), cmd.CodeInvalidArgs, "parse arguments"))
 	}
 
+	if signingKeyPath != "" && useDaemon {
+		cmd.Exit(cmd.FailErrCode(errors.New("images exported to a Docker daemon cannot be signed"), cmd.CodeInvalidArgs, "parse arguments"))
+	}
+
 	cmd.Exit(export())
 }
 
@@ -90,13 +115,47 @@ func export() error {
 	}
 	defer os.RemoveAll(artifactsDir)
 
+	sourceDateEpoch, err := cmd.ParseSourceDateEpoch(sourceEpoch)
+	if err != nil {
+		return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse source date epoch")
+	}
+
+	imageConfigMD, err := parseOptionalImageConfig(imageConfig)
+	if err != nil {
+		return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse image config")
+	}
+
+	var slices lifecycle.LaunchTOML
+	if slicesPath != "" {
+		if _, err := toml.DecodeFile(slicesPath, &slices); err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse slices")
+		}
+	}
+
 	exporter := &lifecycle.Exporter{
-		Buildpacks:   group.Group,
-		Out:          log.New(os.Stdout, "", 0),
-		Err:          log.New(os.Stderr, "", 0),
-		UID:          uid,
-		GID:          gid,
-		ArtifactsDir: artifactsDir,
+		Buildpacks:        group.Group,
+		Out:               log.New(os.Stdout, "", 0),
+		Err:               log.New(os.Stderr, "", 0),
+		UID:               uid,
+		GID:               gid,
+		ArtifactsDir:      artifactsDir,
+		SourceDateEpoch:   sourceDateEpoch,
+		HashLayerContents: hashContents,
+		ImageConfig:       imageConfigMD,
+		Slices:            slices.Slices,
+	}
+
+	if signingKeyPath != "" {
+		key, err := signature.ReadKey(signingKeyPath)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "read signing key")
+		}
+		exporter.Signer = &signature.Signer{
+			Key: key,
+			NewImage: func(ref string) (imgutil.Image, error) {
+				return remote.NewImage(ref, auth.DefaultEnvKeychain())
+			},
+		}
 	}
 
 	analyzedMD, err := parseOptionalAnalyzedMD(cmd.OutLogger, analyzedPath)
@@ -104,10 +163,14 @@ func export() error {
 		return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse analyzed metadata")
 	}
 
-	var registry string
-	if registry, err = image.EnsureSingleRegistry(imageNames...); err != nil {
+	registries, err := image.GroupByRegistry(imageNames...)
+	if err != nil {
 		return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse arguments")
 	}
+	if useDaemon {
+		// every tag is saved to the same daemon, regardless of registry
+		registries = []image.RegistryNames{{Registry: registries[0].Registry, Names: imageNames}}
+	}
 
 	var stackMD metadata.StackMetadata
 	_, err = toml.DecodeFile(stackPath, &stackMD)
@@ -115,105 +178,204 @@ func export() error {
 		cmd.OutLogger.Printf("no stack metadata found at path '%s', stack metadata will not be exported\n", stackPath)
 	}
 
-	if runImageRef == "" {
-		if stackMD.RunImage.Image == "" {
-			return cmd.FailErrCode(errors.New("-image is required when there is no stack metadata available"), cmd.CodeInvalidArgs, "parse arguments")
-		}
+	if runImageRef == "" && stackMD.RunImage.Image == "" {
+		return cmd.FailErrCode(errors.New("-image is required when there is no stack metadata available"), cmd.CodeInvalidArgs, "parse arguments")
+	}
 
-		runImageRef, err = runImageFromStackToml(stackMD, registry)
-		if err != nil {
-			return err
+	runImageRefs := map[string]string{}
+	for _, r := range registries {
+		runImageRefs[r.Registry] = runImageRef
+		if runImageRef == "" {
+			if runImageRefs[r.Registry], err = runImageFromStackToml(stackMD, r.Registry); err != nil {
+				return err
+			}
 		}
 	}
 
 	if useHelpers {
-		if err := lifecycle.SetupCredHelpers(filepath.Join(os.Getenv("HOME"), ".docker"), imageNames[0], runImageRef); err != nil {
+		refs := append([]string{}, imageNames...)
+		for _, r := range registries {
+			refs = append(refs, runImageRefs[r.Registry])
+		}
+		if err := lifecycle.SetupCredHelpers(filepath.Join(os.Getenv("HOME"), ".docker"), refs...); err != nil {
 			return cmd.FailErr(err, "setup credential helpers")
 		}
 	}
 
-	var appImage imgutil.Image
-	if useDaemon {
-		dockerClient, err := cmd.DockerClient()
+	launcherConfig := lifecycle.LauncherConfig{
+		Path: launcherPath,
+		Metadata: metadata.LauncherMetadata{
+			Version: cmd.Version,
+			Source: metadata.SourceMetadata{
+				Git: metadata.GitMetadata{
+					Repository: cmd.SCMRepository,
+					Commit:     cmd.SCMCommit,
+				},
+			},
+		},
+	}
+
+	if dryRun {
+		return preview(exporter, registries, runImageRefs, analyzedMD, launcherConfig, stackMD)
+	}
+
+	var exportErrs []error
+	saveFailed := false
+	for _, r := range registries {
+		appImage, err := newAppImage(r.Names[0], runImageRefs[r.Registry], analyzedMD)
 		if err != nil {
 			return err
 		}
 
-		var opts = []local.ImageOption{
-			local.FromBaseImage(runImageRef),
+		if useDaemon && launchCacheDir != "" {
+			if appImage, err = withLaunchCache(appImage); err != nil {
+				return err
+			}
 		}
 
-		if analyzedMD.Image != nil {
-			cmd.OutLogger.Printf("Reusing layers from image with id '%s'", analyzedMD.Image.Reference)
-			opts = append(opts, local.WithPreviousImage(analyzedMD.Image.Reference))
+		if err := exporter.Export(layersDir, appDir, appImage, analyzedMD.Metadata, r.Names[1:], launcherConfig, stackMD); err != nil {
+			if _, isSaveError := err.(imgutil.SaveError); isSaveError {
+				saveFailed = true
+			}
+			cmd.ErrLogger.Printf("Failed to export to registry '%s': %s\n", r.Registry, err)
+			exportErrs = append(exportErrs, err)
+		}
+		if launchCache != nil {
+			cmd.PrintEvictions(cmd.OutLogger, launchCacheDir, launchCache.EvictionReport())
 		}
+	}
 
-		appImage, err = local.NewImage(
-			imageNames[0],
-			dockerClient,
-			opts...,
-		)
+	if err := lifecycle.WriteTOML(reportPath, exporter.Report()); err != nil {
+		exportErrs = append(exportErrs, errors.Wrap(err, "write report"))
+	}
+
+	switch {
+	case len(exportErrs) == 0:
+		return nil
+	case saveFailed && len(exportErrs) == 1:
+		return cmd.FailErrCode(exportErrs[0], cmd.CodeFailedSave, "export")
+	case saveFailed:
+		return cmd.FailErrCode(&lifecycle.MultiError{Errors: exportErrs}, cmd.CodeFailedSave, "export")
+	case len(exportErrs) == 1:
+		return cmd.FailErr(exportErrs[0], "export")
+	default:
+		return cmd.FailErr(&lifecycle.MultiError{Errors: exportErrs}, "export")
+	}
+}
 
+func preview(exporter *lifecycle.Exporter, registries []image.RegistryNames, runImageRefs map[string]string, analyzedMD metadata.AnalyzedMetadata, launcherConfig lifecycle.LauncherConfig, stackMD metadata.StackMetadata) error {
+	var diffs struct {
+		Images []lifecycle.ExportDiff `toml:"image"`
+	}
+	for _, r := range registries {
+		appImage, err := newAppImage(r.Names[0], runImageRefs[r.Registry], analyzedMD)
 		if err != nil {
-			return cmd.FailErr(err, "access run image")
+			return err
 		}
 
-		if launchCacheDir != "" {
-			volumeCache, err := cache.NewVolumeCache(launchCacheDir)
-			if err != nil {
-				return cmd.FailErr(err, "create launch cache")
-			}
-			appImage = lifecycle.NewCachingImage(appImage, volumeCache)
+		previousImage, err := newPreviousImage(analyzedMD)
+		if err != nil {
+			return err
 		}
-	} else {
-		var opts = []remote.ImageOption{
-			remote.FromBaseImage(runImageRef),
+
+		diff, err := exporter.Preview(layersDir, appDir, appImage, previousImage, analyzedMD.Metadata, launcherConfig, stackMD)
+		if err != nil {
+			return cmd.FailErr(err, "preview export")
+		}
+		diffs.Images = append(diffs.Images, diff)
+	}
+
+	if err := lifecycle.WriteTOML(previewPath, diffs); err != nil {
+		return cmd.FailErr(err, "write preview")
+	}
+	return nil
+}
+
+func newPreviousImage(analyzedMD metadata.AnalyzedMetadata) (imgutil.Image, error) {
+	if analyzedMD.Image == nil {
+		return nil, nil
+	}
+	ref := analyzedMD.Image.Reference
+
+	if useDaemon {
+		dockerClient, err := cmd.DockerClient()
+		if err != nil {
+			return nil, err
+		}
+		previousImage, err := local.NewImage(ref, dockerClient, local.FromBaseImage(ref))
+		if err != nil {
+			return nil, cmd.FailErr(err, "access previous image")
+		}
+		return previousImage, nil
+	}
+
+	previousImage, err := remote.NewImage(ref, auth.DefaultEnvKeychain(), remote.FromBaseImage(ref))
+	if err != nil {
+		return nil, cmd.FailErr(err, "access previous image")
+	}
+	return previousImage, nil
+}
+
+func newAppImage(repoName, runImageRef string, analyzedMD metadata.AnalyzedMetadata) (imgutil.Image, error) {
+	if useDaemon {
+		dockerClient, err := cmd.DockerClient()
+		if err != nil {
+			return nil, err
+		}
+
+		var opts = []local.ImageOption{
+			local.FromBaseImage(runImageRef),
 		}
 
 		if analyzedMD.Image != nil {
-			cmd.OutLogger.Printf("Reusing layers from image '%s'", analyzedMD.Image.Reference)
-			analyzedRegistry, err := image.ParseRegistry(analyzedMD.Image.Reference)
-			if err != nil {
-				return cmd.FailErr(err, "parse analyzed registry")
-			}
-			if analyzedRegistry != registry {
-				return fmt.Errorf("analyzed image is on a different registry %s from the exported image %s", analyzedRegistry, registry)
-			}
-			opts = append(opts, remote.WithPreviousImage(analyzedMD.Image.Reference))
+			cmd.OutLogger.Printf("Reusing layers from image with id '%s'", analyzedMD.Image.Reference)
+			opts = append(opts, local.WithPreviousImage(analyzedMD.Image.Reference))
 		}
 
-		appImage, err = remote.NewImage(
-			imageNames[0],
-			auth.DefaultEnvKeychain(),
+		appImage, err := local.NewImage(
+			repoName,
+			dockerClient,
 			opts...,
 		)
 		if err != nil {
-			return cmd.FailErr(err, "access run image")
+			return nil, cmd.FailErr(err, "access run image")
 		}
+		return appImage, nil
 	}
 
-	launcherConfig := lifecycle.LauncherConfig{
-		Path: launcherPath,
-		Metadata: metadata.LauncherMetadata{
-			Version: cmd.Version,
-			Source: metadata.SourceMetadata{
-				Git: metadata.GitMetadata{
-					Repository: cmd.SCMRepository,
-					Commit:     cmd.SCMCommit,
-				},
-			},
-		},
+	var opts = []remote.ImageOption{
+		remote.FromBaseImage(runImageRef),
 	}
 
-	if err := exporter.Export(layersDir, appDir, appImage, analyzedMD.Metadata, imageNames[1:], launcherConfig, stackMD); err != nil {
-		if _, isSaveError := err.(*imgutil.SaveError); isSaveError {
-			return cmd.FailErrCode(err, cmd.CodeFailedSave, "export")
-		}
+	if analyzedMD.Image != nil {
+		// layers of a previous image on another registry are copied to this registry when the image is saved
+		cmd.OutLogger.Printf("Reusing layers from image '%s'", analyzedMD.Image.Reference)
+		opts = append(opts, remote.WithPreviousImage(analyzedMD.Image.Reference))
+	}
 
-		return cmd.FailErr(err, "export")
+	appImage, err := remote.NewImage(
+		repoName,
+		auth.DefaultEnvKeychain(),
+		opts...,
+	)
+	if err != nil {
+		return nil, cmd.FailErr(err, "access run image")
 	}
+	return appImage, nil
+}
 
-	return nil
+// withLaunchCache opens the launch cache and caches the layers added to appImage in it.
+// It is not used for dry runs, which must leave the launch cache untouched.
+func withLaunchCache(appImage imgutil.Image) (imgutil.Image, error) {
+	maxSize, err := cmd.ParseSize(launchCacheMax)
+	if err != nil {
+		return nil, cmd.FailErrCode(err, cmd.CodeInvalidArgs, "parse arguments")
+	}
+	launchCache, err = cache.NewVolumeCache(launchCacheDir, cache.WithMaxSize(maxSize), cache.WithUnreferencedLayers())
+	if err != nil {
+		return nil, cmd.FailErr(err, "create launch cache")
+	}
+	return lifecycle.NewCachingImage(appImage, launchCache), nil
 }
 
 func parseOptionalAnalyzedMD(logger *log.Logger, path string) (metadata.AnalyzedMetadata, error) {
@@ -232,6 +394,17 @@ func parseOptionalAnalyzedMD(logger *log.Logger, path string) (metadata.Analyzed
 	return analyzedMD, nil
 }
 
+func parseOptionalImageConfig(path string) (metadata.ImageConfigMetadata, error) {
+	var config metadata.ImageConfigMetadata
+	if path == "" {
+		return config, nil
+	}
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return metadata.ImageConfigMetadata{}, err
+	}
+	return config, nil
+}
+
 func runImageFromStackToml(stack metadata.StackMetadata, registry string) (string, error) {
 	runImageMirrors := []string{stack.RunImage.Image}
 	runImageMirrors = append(runImageMirrors, stack.RunImage.Mirrors...)
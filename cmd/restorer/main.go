@@ -7,31 +7,58 @@ import (
 	"log"
 	"os"
 
+	"github.com/buildpack/imgutil"
 	"github.com/buildpack/imgutil/remote"
 
 	"github.com/buildpack/lifecycle"
 	"github.com/buildpack/lifecycle/cache"
 	"github.com/buildpack/lifecycle/cmd"
 	"github.com/buildpack/lifecycle/image/auth"
+	"github.com/buildpack/lifecycle/image/local"
+	"github.com/buildpack/lifecycle/image/signature"
 )
 
 var (
-	cacheImageTag string
-	cacheDir      string
-	layersDir     string
-	groupPath     string
-	uid           int
-	gid           int
-	printVersion  bool
+	cacheImageTag  string
+	cacheDir       string
+	cacheLayout    string
+	cacheArchive   string
+	cacheBucket    string
+	cacheSeeds     string
+	bucketEndpoint string
+	bucketRegion   string
+	layersDir      string
+	buildpacksDir  string
+	groupPath      string
+	previousImage  string
+	stackID        string
+	workers        int
+	uid            int
+	gid            int
+	useDaemon      bool
+	verifyKey      string
+	printVersion   bool
 )
 
 func init() {
 	cmd.FlagLayersDir(&layersDir)
+	cmd.FlagBuildpacksDir(&buildpacksDir)
 	cmd.FlagCacheImage(&cacheImageTag)
 	cmd.FlagCacheDir(&cacheDir)
+	cmd.FlagCacheLayout(&cacheLayout)
+	cmd.FlagCacheArchive(&cacheArchive)
+	cmd.FlagCacheBucket(&cacheBucket)
+	cmd.FlagCacheSeeds(&cacheSeeds)
+	cmd.FlagCacheBucketEndpoint(&bucketEndpoint)
+	cmd.FlagCacheBucketRegion(&bucketRegion)
 	cmd.FlagGroupPath(&groupPath)
+	cmd.FlagPreviousImage(&previousImage)
+	cmd.FlagStackID(&stackID)
+	cmd.FlagRestoreWorkers(&workers)
 	cmd.FlagUID(&uid)
 	cmd.FlagGID(&gid)
+	cmd.FlagUseDaemon(&useDaemon)
+	cmd.FlagVerificationKeyPath(&verifyKey)
 	cmd.FlagVersion(&printVersion)
 }
 
@@ -48,8 +75,11 @@ func main() {
 	if flag.NArg() > 0 {
 		cmd.Exit(cmd.FailErrCode(errors.New("received unexpected args"), cmd.CodeInvalidArgs, "parse arguments"))
 	}
-	if cacheImageTag == "" && cacheDir == "" {
-		cmd.Exit(cmd.FailErrCode(errors.New("must supply either -image or -path"), cmd.CodeInvalidArgs, "parse arguments"))
+	if cacheImageTag == "" && cacheLayout == "" && cacheBucket == "" && cacheArchive == "" && cacheDir == "" {
+		cmd.Exit(cmd.FailErrCode(errors.New("must supply either -image, -layout, -bucket, -archive or -path"), cmd.CodeInvalidArgs, "parse arguments"))
+	}
+	if verifyKey != "" && useDaemon {
+		cmd.Exit(cmd.FailErrCode(errors.New("signatures of images in a Docker daemon cannot be verified"), cmd.CodeInvalidArgs, "parse arguments"))
 	}
 	cmd.Exit(restore())
 }
@@ -61,16 +91,64 @@ func restore() error {
 	}
 
 	restorer := &lifecycle.Restorer{
-		LayersDir:  layersDir,
-		Buildpacks: group.Group,
-		Out:        log.New(os.Stdout, "", 0),
-		Err:        log.New(os.Stderr, "", 0),
-		UID:        uid,
-		GID:        gid,
+		LayersDir:     layersDir,
+		BuildpacksDir: buildpacksDir,
+		Buildpacks:    group.Group,
+		StackID:       stackID,
+		Out:           log.New(os.Stdout, "", 0),
+		Err:           log.New(os.Stderr, "", 0),
+		UID:           uid,
+		GID:           gid,
+		Workers:       workers,
+	}
+
+	if verifyKey != "" {
+		key, err := signature.ReadPublicKey(verifyKey)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "read verification key")
+		}
+		restorer.Verifier = &signature.Verifier{
+			Key: key,
+			NewImage: func(ref string) (imgutil.Image, error) {
+				return remote.NewImage(ref, auth.DefaultEnvKeychain(), remote.FromBaseImage(ref))
+			},
+		}
+	}
+
+	if previousImage != "" && useDaemon {
+		dockerClient, err := cmd.DockerClient()
+		if err != nil {
+			return cmd.FailErr(err, "create docker client")
+		}
+		restorer.PreviousImage, err = local.NewImage(
+			previousImage,
+			dockerClient,
+			local.FromBaseImage(previousImage),
+		)
+		if err != nil {
+			return cmd.FailErr(err, "access previous image")
+		}
+		defer restorer.PreviousImage.(*local.Image).Cleanup()
+	} else if previousImage != "" {
+		restorer.PreviousImage, err = remote.NewImage(
+			previousImage,
+			auth.DefaultEnvKeychain(),
+			remote.FromBaseImage(previousImage),
+		)
+		if err != nil {
+			return cmd.FailErr(err, "access previous image")
+		}
 	}
 
 	var cacheStore lifecycle.Cache
-	if cacheImageTag != "" {
+	if cacheImageTag != "" && useDaemon {
+		imageCache, err := cmd.NewDaemonImageCache(cacheImageTag)
+		if err != nil {
+			return cmd.FailErr(err, "create daemon image cache")
+		}
+		defer imageCache.Cleanup()
+		cacheStore = imageCache
+	} else if cacheImageTag != "" {
 		origCacheImage, err := remote.NewImage(
 			cacheImageTag,
 			auth.DefaultEnvKeychain(),
@@ -93,6 +171,23 @@ func restore() error {
 			origCacheImage,
 			emptyImage,
 		)
+	} else if cacheLayout != "" {
+		cacheStore, err = cmd.NewLayoutImageCache(cacheLayout)
+		if err != nil {
+			return cmd.FailErr(err, "create layout image cache")
+		}
+	} else if cacheBucket != "" {
+		var err error
+		cacheStore, err = cmd.NewBucketCache(cacheBucket, bucketEndpoint, bucketRegion)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "create bucket cache")
+		}
+	} else if cacheArchive != "" {
+		var err error
+		cacheStore, err = cache.NewArchiveCache(cacheArchive)
+		if err != nil {
+			return cmd.FailErr(err, "open cache archive")
+		}
 	} else {
 		var err error
 		cacheStore, err = cache.NewVolumeCache(cacheDir)
@@ -101,6 +196,14 @@ func restore() error {
 		}
 	}
 
+	if cacheSeeds != "" {
+		seeds, err := cmd.NewSeedCaches(cacheSeeds, bucketEndpoint, bucketRegion)
+		if err != nil {
+			return cmd.FailErrCode(err, cmd.CodeInvalidArgs, "create seed caches")
+		}
+		cacheStore = cache.NewLayeredCache(cacheStore, seeds...)
+	}
+
 	if err := restorer.Restore(cacheStore); err != nil {
 		return cmd.FailErrCode(err, cmd.CodeFailed, "restore")
 	}
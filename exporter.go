@@ -3,13 +3,21 @@ package lifecycle
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/buildpack/imgutil"
 	"github.com/buildpack/imgutil/local"
 	"github.com/buildpack/imgutil/remote"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/pkg/errors"
 
 	"github.com/buildpack/lifecycle/archive"
@@ -18,11 +26,83 @@ import (
 )
 
 type Exporter struct {
-	Buildpacks   []Buildpack
-	ArtifactsDir string
-	In           []byte
-	Out, Err     *log.Logger
-	UID, GID     int
+	Buildpacks      []Buildpack
+	ArtifactsDir    string
+	In              []byte
+	Out, Err        *log.Logger
+	UID, GID        int
+	SourceDateEpoch time.Time
+	// HashLayerContents fingerprints layers by the contents of their files rather than by their modification
+	// times. It is implied by SourceDateEpoch, since pinned modification times do not change with the contents.
+	HashLayerContents bool
+	ImageConfig       metadata.ImageConfigMetadata
+	Slices            []Slice
+	Signer            ImageSigner
+
+	writtenLayers map[string]writtenLayer
+	report        ExportReport
+}
+
+// writtenLayer is a layer this exporter has digested, and written to path unless it was streamed.
+type writtenLayer struct {
+	metadata.LayerMetadata
+	path string
+}
+
+// layerStreamer is implemented by images that read the contents of added layers when they are saved, so that
+// layers can be streamed into them rather than written to the artifacts directory first.
+type layerStreamer interface {
+	AddLayerFromOpener(diffID string, size int64, open func() (io.ReadCloser, error)) error
+}
+
+// createdAtSetter is implemented by images that allow the creation time in their config to be set explicitly.
+type createdAtSetter interface {
+	SetCreatedAt(time.Time) error
+}
+
+// ImageSigner signs the digest of a saved image.
+type ImageSigner interface {
+	Sign(repoName, digest string) error
+}
+
+// userSetter is implemented by images that allow the user in their config to be set.
+type userSetter interface {
+	SetUser(string) error
+}
+
+// exposedPortsSetter is implemented by images that allow the exposed ports in their config to be set.
+type exposedPortsSetter interface {
+	SetExposedPorts(...string) error
+}
+
+const (
+	LayerStatusAdded   = "added"
+	LayerStatusReused  = "reused"
+	LayerStatusRemoved = "removed"
+)
+
+type ExportReport struct {
+	Images []ImageReport `toml:"image"`
+}
+
+type ImageReport struct {
+	Tags     []TagReport               `toml:"tags"`
+	ImageID  string                    `toml:"image-id,omitempty"`
+	Digest   string                    `toml:"digest,omitempty"`
+	RunImage metadata.RunImageMetadata `toml:"run-image"`
+	Layers   []LayerReport             `toml:"layers"`
+}
+
+type TagReport struct {
+	Name   string `toml:"name"`
+	Status string `toml:"status"`
+}
+
+type LayerReport struct {
+	ID     string `toml:"id"`
+	SHA    string `toml:"sha"`
+	Size   int64  `toml:"size,omitempty"`
+	Status string `toml:"status"`
 }
 
 type LauncherConfig struct {
@@ -39,71 +119,125 @@ func (e *Exporter) Export(
 	launcherConfig LauncherConfig,
 	stack metadata.StackMetadata,
 ) error {
+	report, err := e.build(layersDir, appDir, workingImage, origMetadata, launcherConfig, stack)
+	if err != nil {
+		return err
+	}
+	return e.saveImage(workingImage, additionalNames, report)
+}
+
+// build adds the layers, labels and config of the app image to workingImage without saving it.
+func (e *Exporter) build(
+	layersDir,
+	appDir string,
+	workingImage imgutil.Image,
+	origMetadata metadata.LayersMetadata,
+	launcherConfig LauncherConfig,
+	stack metadata.StackMetadata,
+) (*ImageReport, error) {
 	var err error
 
 	meta := metadata.LayersMetadata{}
 
+	imageConfig, err := e.validateImageConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid image config")
+	}
+	if !imageConfig.IsZero() {
+		meta.ImageConfig = &imageConfig
+	}
+
 	meta.RunImage.TopLayer, err = workingImage.TopLayer()
 	if err != nil {
-		return errors.Wrap(err, "get run image top layer SHA")
+		return nil, errors.Wrap(err, "get run image top layer SHA")
 	}
 
 	identifier, err := workingImage.Identifier()
 	if err != nil {
-		return errors.Wrap(err, "get run image id or digest")
+		return nil, errors.Wrap(err, "get run image id or digest")
 	}
 
 	meta.RunImage.Reference = identifier.String()
 	meta.Stack = stack
 
-	meta.App.SHA, err = e.addLayer(workingImage, &layer{path: appDir, identifier: "app"}, origMetadata.App.SHA)
+	report := &ImageReport{RunImage: meta.RunImage}
+
+	buildMD := &BuildMetadata{}
+	if _, err := toml.DecodeFile(metadata.MetadataFilePath(layersDir), buildMD); err != nil {
+		return nil, errors.Wrap(err, "read build metadata")
+	}
+
+	var appLayer identifiableLayer = &layer{path: appDir, identifier: "app"}
+	var sliceLayers []*sliceLayer
+	slices := append(append([]Slice{}, e.Slices...), buildMD.Slices...)
+	if len(slices) > 0 {
+		appLayer, sliceLayers, err = appSlices(appDir, slices)
+		if err != nil {
+			return nil, errors.Wrap(err, "slicing app directory")
+		}
+	}
+
+	meta.App, err = e.addLayer(workingImage, appLayer, origMetadata.App, report)
 	if err != nil {
-		return errors.Wrap(err, "exporting app layer")
+		return nil, errors.Wrap(err, "exporting app layer")
 	}
 
-	meta.Config.SHA, err = e.addLayer(workingImage, &layer{path: filepath.Join(layersDir, "config"), identifier: "config"}, origMetadata.Config.SHA)
+	previousSlices := map[string]metadata.LayerMetadata{}
+	for _, sliceMD := range origMetadata.Slices {
+		previousSlices[Slice{Paths: sliceMD.Paths}.ID()] = sliceMD.LayerMetadata
+	}
+	for i, sl := range sliceLayers {
+		sliceMD, err := e.addLayer(workingImage, sl, previousSlices[sl.Identifier()], report)
+		if err != nil {
+			return nil, errors.Wrapf(err, "exporting layer '%s'", sl.Identifier())
+		}
+		meta.Slices = append(meta.Slices, metadata.SliceLayerMetadata{LayerMetadata: sliceMD, Paths: slices[i].Paths})
+	}
+
+	meta.Config, err = e.addLayer(workingImage, &layer{path: filepath.Join(layersDir, "config"), identifier: "config"}, origMetadata.Config, report)
 	if err != nil {
-		return errors.Wrap(err, "exporting config layer")
+		return nil, errors.Wrap(err, "exporting config layer")
 	}
 
-	meta.Launcher.SHA, err = e.addLayer(workingImage, &layer{path: launcherConfig.Path, identifier: "launcher"}, origMetadata.Launcher.SHA)
+	meta.Launcher, err = e.addLayer(workingImage, &layer{path: launcherConfig.Path, identifier: "launcher"}, origMetadata.Launcher, report)
 	if err != nil {
-		return errors.Wrap(err, "exporting launcher layer")
+		return nil, errors.Wrap(err, "exporting launcher layer")
 	}
 
 	for _, bp := range e.Buildpacks {
 		bpDir, err := readBuildpackLayersDir(layersDir, bp)
 		if err != nil {
-			return errors.Wrapf(err, "reading layers for buildpack '%s'", bp.ID)
+			return nil, errors.Wrapf(err, "reading layers for buildpack '%s'", bp.ID)
 		}
 		bpMD := metadata.BuildpackLayersMetadata{ID: bp.ID, Version: bp.Version, Layers: map[string]metadata.BuildpackLayerMetadata{}}
 
 		for _, layer := range bpDir.findLayers(launch) {
 			lmd, err := layer.read()
 			if err != nil {
-				return errors.Wrapf(err, "reading '%s' metadata", layer.Identifier())
+				return nil, errors.Wrapf(err, "reading '%s' metadata", layer.Identifier())
 			}
 
 			if layer.hasLocalContents() {
 				origLayerMetadata := origMetadata.MetadataForBuildpack(bp.ID).Layers[layer.name()]
-				lmd.SHA, err = e.addLayer(workingImage, &layer, origLayerMetadata.SHA)
+				lmd.LayerMetadata, err = e.addLayer(workingImage, &layer, origLayerMetadata.LayerMetadata, report)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			} else {
 				if lmd.Cache {
-					return fmt.Errorf("layer '%s' is cache=true but has no contents", layer.Identifier())
+					return nil, fmt.Errorf("layer '%s' is cache=true but has no contents", layer.Identifier())
 				}
 				origLayerMetadata, ok := origMetadata.MetadataForBuildpack(bp.ID).Layers[layer.name()]
 				if !ok {
-					return fmt.Errorf("cannot reuse '%s', previous image has no metadata for layer '%s'", layer.Identifier(), layer.Identifier())
+					return nil, fmt.Errorf("cannot reuse '%s', previous image has no metadata for layer '%s'", layer.Identifier(), layer.Identifier())
 				}
 
 				e.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), origLayerMetadata.SHA)
 				if err := workingImage.ReuseLayer(origLayerMetadata.SHA); err != nil {
-					return errors.Wrapf(err, "reusing layer: '%s'", layer.Identifier())
+					return nil, errors.Wrapf(err, "reusing layer: '%s'", layer.Identifier())
 				}
-				lmd.SHA = origLayerMetadata.SHA
+				lmd.LayerMetadata = origLayerMetadata.LayerMetadata
+				report.addLayer(layer.Identifier(), lmd.LayerMetadata, LayerStatusReused)
 			}
 			bpMD.Layers[layer.name()] = lmd
 		}
@@ -113,64 +247,262 @@ func (e *Exporter) Export(
 			for _, ml := range malformedLayers {
 				ids = append(ids, ml.Identifier())
 			}
-			return fmt.Errorf("failed to parse metadata for layers '%s'", ids)
+			return nil, fmt.Errorf("failed to parse metadata for layers '%s'", ids)
 		}
 
 		meta.Buildpacks = append(meta.Buildpacks, bpMD)
 	}
 
+	if err := e.applyImageConfig(workingImage, imageConfig); err != nil {
+		return nil, err
+	}
+
 	data, err := json.Marshal(meta)
 	if err != nil {
-		return errors.Wrap(err, "marshall metadata")
+		return nil, errors.Wrap(err, "marshall metadata")
 	}
 
 	if err = workingImage.SetLabel(metadata.LayerMetadataLabel, string(data)); err != nil {
-		return errors.Wrap(err, "set app image metadata label")
+		return nil, errors.Wrap(err, "set app image metadata label")
 	}
 
-	buildMD := &BuildMetadata{}
-	if _, err := toml.DecodeFile(metadata.MetadataFilePath(layersDir), buildMD); err != nil {
-		return errors.Wrap(err, "read build metadata")
-	}
-
-	if err := e.addBuildMetadataLabel(workingImage, buildMD.BOM, launcherConfig.Metadata); err != nil {
-		return errors.Wrapf(err, "add build metadata label")
+	if err := e.addBuildMetadataLabel(workingImage, buildMD.BOM, buildMD.Processes, launcherConfig.Metadata); err != nil {
+		return nil, errors.Wrapf(err, "add build metadata label")
 	}
 
 	if err = workingImage.SetEnv(cmd.EnvLayersDir, layersDir); err != nil {
-		return errors.Wrapf(err, "set app image env %s", cmd.EnvLayersDir)
+		return nil, errors.Wrapf(err, "set app image env %s", cmd.EnvLayersDir)
 	}
 
 	if err = workingImage.SetEnv(cmd.EnvAppDir, appDir); err != nil {
-		return errors.Wrapf(err, "set app image env %s", cmd.EnvAppDir)
+		return nil, errors.Wrapf(err, "set app image env %s", cmd.EnvAppDir)
 	}
 
 	if err = workingImage.SetEntrypoint(launcherConfig.Path); err != nil {
-		return errors.Wrap(err, "setting entrypoint")
+		return nil, errors.Wrap(err, "setting entrypoint")
 	}
 
 	if err = workingImage.SetCmd(); err != nil { // Note: Command intentionally empty
-		return errors.Wrap(err, "setting cmd")
+		return nil, errors.Wrap(err, "setting cmd")
+	}
+
+	if err := e.setCreatedAt(workingImage); err != nil {
+		return nil, errors.Wrap(err, "setting created time")
 	}
 
-	return e.saveImage(workingImage, additionalNames)
+	return report, nil
 }
 
-func (e *Exporter) addLayer(image imgutil.Image, layer identifiableLayer, previousSHA string) (string, error) {
+// Report returns the outcome of every image this exporter has attempted to save.
+func (e *Exporter) Report() ExportReport {
+	return e.report
+}
+
+func (e *Exporter) addLayer(image imgutil.Image, layer identifiableLayer, previous metadata.LayerMetadata, report *ImageReport) (metadata.LayerMetadata, error) {
+	fingerprint, err := archive.FilteredFingerprint(layer.Path(), e.UID, e.GID, e.modTime(), e.hashContents(), layerFilter(layer))
+	if err != nil {
+		return metadata.LayerMetadata{}, errors.Wrapf(err, "fingerprinting layer '%s'", layer.Identifier())
+	}
+	if previous.SHA != "" && previous.Fingerprint == fingerprint {
+		e.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), previous.SHA)
+		report.addLayer(layer.Identifier(), previous, LayerStatusReused)
+		return previous, image.ReuseLayer(previous.SHA)
+	}
+
+	streamer, stream := image.(layerStreamer)
+	written, err := e.writeLayerTar(layer, fingerprint, stream)
+	if err != nil {
+		return metadata.LayerMetadata{}, errors.Wrapf(err, "exporting layer '%s'", layer.Identifier())
+	}
+	if written.SHA == previous.SHA {
+		e.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), written.SHA)
+		report.addLayer(layer.Identifier(), written.LayerMetadata, LayerStatusReused)
+		return written.LayerMetadata, image.ReuseLayer(previous.SHA)
+	}
+	e.Out.Printf("Exporting layer '%s' with SHA %s\n", layer.Identifier(), written.SHA)
+	report.addLayer(layer.Identifier(), written.LayerMetadata, LayerStatusAdded)
+	if written.path == "" {
+		return written.LayerMetadata, streamer.AddLayerFromOpener(written.SHA, written.Size, e.layerOpener(layer))
+	}
+	return written.LayerMetadata, image.AddLayer(written.path)
+}
+
+// writeLayerTar writes the layer to the artifacts directory, or only digests it when stream is true, unless
+// a previous export by this exporter already did so with the same fingerprint.
+func (e *Exporter) writeLayerTar(layer identifiableLayer, fingerprint string, stream bool) (writtenLayer, error) {
+	if written, ok := e.writtenLayers[layer.Identifier()]; ok && written.Fingerprint == fingerprint && (stream || written.path != "") {
+		return written, nil
+	}
+
+	if stream {
+		cw := &countingWriter{w: ioutil.Discard}
+		sha, err := archive.WriteLayer(cw, layer.Path(), e.UID, e.GID, e.modTime(), layerFilter(layer))
+		if err != nil {
+			return writtenLayer{}, err
+		}
+		return e.recordWrittenLayer(layer, writtenLayer{
+			LayerMetadata: metadata.LayerMetadata{SHA: sha, Fingerprint: fingerprint, Size: cw.n},
+		}), nil
+	}
+
 	tarPath := filepath.Join(e.ArtifactsDir, escapeID(layer.Identifier())+".tar")
-	sha, err := archive.WriteTarFile(layer.Path(), tarPath, e.UID, e.GID)
+	sha, err := archive.WriteFilteredTarFile(layer.Path(), tarPath, e.UID, e.GID, e.modTime(), layerFilter(layer))
 	if err != nil {
-		return "", errors.Wrapf(err, "exporting layer '%s'", layer.Identifier())
+		return writtenLayer{}, err
 	}
-	if sha == previousSHA {
-		e.Out.Printf("Reusing layer '%s' with SHA %s\n", layer.Identifier(), sha)
-		return sha, image.ReuseLayer(previousSHA)
+	fi, err := os.Stat(tarPath)
+	if err != nil {
+		return writtenLayer{}, err
 	}
-	e.Out.Printf("Exporting layer '%s' with SHA %s\n", layer.Identifier(), sha)
-	return sha, image.AddLayer(tarPath)
+
+	return e.recordWrittenLayer(layer, writtenLayer{
+		LayerMetadata: metadata.LayerMetadata{SHA: sha, Fingerprint: fingerprint, Size: fi.Size()},
+		path:          tarPath,
+	}), nil
+}
+
+func (e *Exporter) recordWrittenLayer(layer identifiableLayer, written writtenLayer) writtenLayer {
+	if e.writtenLayers == nil {
+		e.writtenLayers = map[string]writtenLayer{}
+	}
+	e.writtenLayers[layer.Identifier()] = written
+	return written
+}
+
+// layerOpener returns a function that streams a new tar of the layer each time it is called. The layer's
+// path and filter are read now, since layers may be loop variables that change before the image is saved.
+func (e *Exporter) layerOpener(layer identifiableLayer) func() (io.ReadCloser, error) {
+	path, include := layer.Path(), layerFilter(layer)
+	return func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := archive.WriteLayer(pw, path, e.UID, e.GID, e.modTime(), include)
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	}
+}
+
+func layerFilter(layer identifiableLayer) archive.Filter {
+	if fl, ok := layer.(filteredLayer); ok {
+		return fl.Filter()
+	}
+	return nil
+}
+
+func (e *Exporter) modTime() time.Time {
+	if e.SourceDateEpoch.IsZero() {
+		return archive.NormalizedDateTime
+	}
+	return e.SourceDateEpoch
+}
+
+func (e *Exporter) hashContents() bool {
+	return e.HashLayerContents || !e.SourceDateEpoch.IsZero()
+}
+
+func (e *Exporter) setCreatedAt(image imgutil.Image) error {
+	if e.SourceDateEpoch.IsZero() {
+		return nil
+	}
+	setter, ok := image.(createdAtSetter)
+	if !ok {
+		e.Out.Printf("Warning: image '%s' does not support setting the created time, it will not be reproducible\n", image.Name())
+		return nil
+	}
+	return setter.SetCreatedAt(e.SourceDateEpoch)
+}
+
+// validateImageConfig rejects platform config that would override values owned by the lifecycle and
+// normalizes exposed ports to the '<port>/<protocol>' form.
+func (e *Exporter) validateImageConfig() (metadata.ImageConfigMetadata, error) {
+	config := e.ImageConfig
+	for _, label := range []string{metadata.LayerMetadataLabel, metadata.BuildMetadataLabel} {
+		if _, ok := config.Labels[label]; ok {
+			return metadata.ImageConfigMetadata{}, fmt.Errorf("label '%s' is reserved by the lifecycle", label)
+		}
+	}
+	for _, env := range []string{cmd.EnvLayersDir, cmd.EnvAppDir} {
+		if _, ok := config.Env[env]; ok {
+			return metadata.ImageConfigMetadata{}, fmt.Errorf("env var '%s' is reserved by the lifecycle", env)
+		}
+	}
+	if len(config.ExposedPorts) > 0 {
+		ports := make([]string, 0, len(config.ExposedPorts))
+		for _, p := range config.ExposedPorts {
+			port, err := normalizePort(p)
+			if err != nil {
+				return metadata.ImageConfigMetadata{}, err
+			}
+			ports = append(ports, port)
+		}
+		config.ExposedPorts = ports
+	}
+	return config, nil
+}
+
+func normalizePort(port string) (string, error) {
+	parts := strings.SplitN(port, "/", 2)
+	protocol := "tcp"
+	if len(parts) == 2 {
+		protocol = strings.ToLower(parts[1])
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 || n > 65535 || (protocol != "tcp" && protocol != "udp") {
+		return "", fmt.Errorf("invalid exposed port '%s'", port)
+	}
+	return fmt.Sprintf("%d/%s", n, protocol), nil
+}
+
+func (e *Exporter) applyImageConfig(image imgutil.Image, config metadata.ImageConfigMetadata) error {
+	for _, key := range sortedKeys(config.Labels) {
+		if err := image.SetLabel(key, config.Labels[key]); err != nil {
+			return errors.Wrapf(err, "set app image label %s", key)
+		}
+	}
+
+	for _, key := range sortedKeys(config.Env) {
+		if err := image.SetEnv(key, config.Env[key]); err != nil {
+			return errors.Wrapf(err, "set app image env %s", key)
+		}
+	}
+
+	if config.WorkingDir != "" {
+		if err := image.SetWorkingDir(config.WorkingDir); err != nil {
+			return errors.Wrap(err, "setting working dir")
+		}
+	}
+
+	if config.User != "" {
+		setter, ok := image.(userSetter)
+		if !ok {
+			e.Out.Printf("Warning: image '%s' does not support setting the user, it will be ignored\n", image.Name())
+		} else if err := setter.SetUser(config.User); err != nil {
+			return errors.Wrap(err, "setting user")
+		}
+	}
+
+	if len(config.ExposedPorts) > 0 {
+		setter, ok := image.(exposedPortsSetter)
+		if !ok {
+			e.Out.Printf("Warning: image '%s' does not support setting exposed ports, they will be ignored\n", image.Name())
+		} else if err := setter.SetExposedPorts(config.ExposedPorts...); err != nil {
+			return errors.Wrap(err, "setting exposed ports")
+		}
+	}
+	return nil
 }
 
-func (e *Exporter) addBuildMetadataLabel(image imgutil.Image, plan []BOMEntry, launcherMD metadata.LauncherMetadata) error {
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *Exporter) addBuildMetadataLabel(image imgutil.Image, plan []BOMEntry, processes []Process, launcherMD metadata.LauncherMetadata) error {
 	var bps []metadata.BuildpackMetadata
 	for _, bp := range e.Buildpacks {
 		bps = append(bps, metadata.BuildpackMetadata{
@@ -179,10 +511,21 @@ func (e *Exporter) addBuildMetadataLabel(image imgutil.Image, plan []BOMEntry, l
 		})
 	}
 
+	var procs []metadata.ProcessMetadata
+	for _, p := range processes {
+		procs = append(procs, metadata.ProcessMetadata{
+			Type:    p.Type,
+			Command: p.Command,
+			Args:    p.Args,
+			Direct:  p.Direct,
+		})
+	}
+
 	buildJSON, err := json.Marshal(metadata.BuildMetadata{
 		BOM:        plan,
 		Buildpacks: bps,
 		Launcher:   launcherMD,
+		Processes:  procs,
 	})
 	if err != nil {
 		return errors.Wrap(err, "parse build metadata")
@@ -195,18 +538,27 @@ func (e *Exporter) addBuildMetadataLabel(image imgutil.Image, plan []BOMEntry, l
 	return nil
 }
 
-func (e *Exporter) saveImage(image imgutil.Image, additionalNames []string) error {
+func (e *Exporter) saveImage(image imgutil.Image, additionalNames []string, report *ImageReport) error {
+	defer func() {
+		e.report.Images = append(e.report.Images, *report)
+	}()
+
 	var saveErr error
 	if err := image.Save(additionalNames...); err != nil {
 		var ok bool
 		if saveErr, ok = err.(imgutil.SaveError); !ok {
+			for _, n := range append([]string{image.Name()}, additionalNames...) {
+				report.Tags = append(report.Tags, TagReport{Name: n, Status: err.Error()})
+			}
 			return errors.Wrap(err, "saving image")
 		}
 	}
 
 	e.Out.Println("*** Images:")
 	for _, n := range append([]string{image.Name()}, additionalNames...) {
-		e.Out.Printf("      %s - %s\n", n, getSaveStatus(saveErr, n))
+		status := getSaveStatus(saveErr, n)
+		e.Out.Printf("      %s - %s\n", n, status)
+		report.Tags = append(report.Tags, TagReport{Name: n, Status: status})
 	}
 
 	id, idErr := image.Identifier()
@@ -217,21 +569,68 @@ func (e *Exporter) saveImage(image imgutil.Image, additionalNames []string) erro
 		return idErr
 	}
 
-	e.logReference(id)
+	e.logReference(id, report)
+
+	if e.Signer != nil {
+		if err := e.signImage(id, append([]string{image.Name()}, additionalNames...), saveErr); err != nil {
+			if saveErr != nil {
+				return &MultiError{Errors: []error{err, saveErr}}
+			}
+			return err
+		}
+	}
 	return saveErr
 }
 
-func (e *Exporter) logReference(identifier imgutil.Identifier) {
+// signImage signs the image digest once for each repository the image was successfully saved to.
+func (e *Exporter) signImage(identifier imgutil.Identifier, names []string, saveErr error) error {
+	digestID, ok := identifier.(remote.DigestIdentifier)
+	if !ok {
+		e.Out.Printf("Warning: image '%s' has no digest, it will not be signed\n", identifier.String())
+		return nil
+	}
+	digest := digestID.Digest.DigestStr()
+
+	signed := map[string]bool{}
+	for _, n := range names {
+		if getSaveStatus(saveErr, n) != "succeeded" {
+			continue
+		}
+		ref, err := name.ParseReference(n, name.WeakValidation)
+		if err != nil {
+			return err
+		}
+		repo := ref.Context().Name()
+		if signed[repo] {
+			continue
+		}
+		if err := e.Signer.Sign(n, digest); err != nil {
+			return errors.Wrapf(err, "signing image '%s'", n)
+		}
+		signed[repo] = true
+		e.Out.Printf("*** Signed: %s@%s\n", repo, digest)
+	}
+	return nil
+}
+
+func (e *Exporter) logReference(identifier imgutil.Identifier, report *ImageReport) {
 	switch v := identifier.(type) {
 	case local.IDIdentifier:
 		e.Out.Printf("\n*** Image ID: %s\n", v.String())
+		report.ImageID = v.String()
 	case remote.DigestIdentifier:
 		e.Out.Printf("\n*** Digest: %s\n", v.Digest.DigestStr())
+		report.Digest = v.Digest.DigestStr()
 	default:
 		e.Out.Printf("\n*** Reference: %s\n", v.String())
+		report.ImageID = v.String()
 	}
 }
 
+func (r *ImageReport) addLayer(id string, md metadata.LayerMetadata, status string) {
+	r.Layers = append(r.Layers, LayerReport{ID: id, SHA: md.SHA, Size: md.Size, Status: status})
+}
+
 type MultiError struct {
 	Errors []error
 }
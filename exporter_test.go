@@ -3,6 +3,8 @@ package lifecycle_test
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +13,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,10 +21,14 @@ import (
 	"github.com/buildpack/imgutil/local"
 	"github.com/buildpack/imgutil/remote"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 
 	"github.com/buildpack/lifecycle"
+	"github.com/buildpack/lifecycle/archive"
+	"github.com/buildpack/lifecycle/image/layout"
 	"github.com/buildpack/lifecycle/metadata"
 	h "github.com/buildpack/lifecycle/testhelpers"
 )
@@ -202,6 +209,206 @@ func testExporter(t *testing.T, when spec.G, it spec.S) {
 				assertReuseLayerLog(t, stdout, "launcher", launcherLayerSHA)
 			})
 
+			when("the previous metadata has a matching fingerprint", func() {
+				it.Before(func() {
+					fingerprint, err := archive.Fingerprint(appDir, uid, gid, archive.NormalizedDateTime, false)
+					h.AssertNil(t, err)
+
+					fakeImageMetadata.App = metadata.LayerMetadata{SHA: "sha256:orig-app-sha", Fingerprint: fingerprint}
+					fakeAppImage.AddPreviousLayer("sha256:orig-app-sha", "")
+				})
+
+				it("reuses the layer without writing a tar", func() {
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					h.AssertContains(t, fakeAppImage.ReusedLayers(), "sha256:orig-app-sha")
+					assertReuseLayerLog(t, stdout, "app", "orig-app-sha")
+					if _, err := os.Stat(filepath.Join(exporter.ArtifactsDir, "app.tar")); !os.IsNotExist(err) {
+						t.Fatalf("expected app layer tar not to be written: %v", err)
+					}
+				})
+
+				it("saves the fingerprint to the metadata label", func() {
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+					h.AssertNil(t, err)
+
+					var meta metadata.LayersMetadata
+					h.AssertNil(t, json.Unmarshal([]byte(metadataJSON), &meta))
+					h.AssertEq(t, meta.App, fakeImageMetadata.App)
+				})
+			})
+
+			when("the previous metadata has a stale fingerprint", func() {
+				it.Before(func() {
+					fakeImageMetadata.App = metadata.LayerMetadata{SHA: "sha256:orig-app-sha", Fingerprint: "sha256:stale"}
+				})
+
+				it("exports the layer and records the new fingerprint", func() {
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					assertAddLayerLog(t, stdout, "app", fakeAppImage.AppLayerPath())
+
+					metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+					h.AssertNil(t, err)
+
+					var meta metadata.LayersMetadata
+					h.AssertNil(t, json.Unmarshal([]byte(metadataJSON), &meta))
+					fingerprint, err := archive.Fingerprint(appDir, uid, gid, archive.NormalizedDateTime, false)
+					h.AssertNil(t, err)
+					h.AssertEq(t, meta.App.Fingerprint, fingerprint)
+				})
+			})
+
+			when("the contents of a layer change without changing its size or modification times", func() {
+				var epoch = time.Unix(1500000000, 0)
+
+				changeContents := func(modTime time.Time) {
+					t.Helper()
+					fingerprint, err := archive.Fingerprint(appDir, uid, gid, modTime, false)
+					h.AssertNil(t, err)
+					fakeImageMetadata.App = metadata.LayerMetadata{SHA: "sha256:orig-app-sha", Fingerprint: fingerprint}
+					fakeAppImage.AddPreviousLayer("sha256:orig-app-sha", "")
+
+					file := filepath.Join(appDir, ".hidden.txt")
+					fi, err := os.Stat(file)
+					h.AssertNil(t, err)
+					h.AssertNil(t, ioutil.WriteFile(file, []byte("SOME-hidden-text\n"), 0644))
+					h.AssertNil(t, os.Chtimes(file, fi.ModTime(), fi.ModTime()))
+				}
+
+				it.Before(func() {
+					appDir = filepath.Join(layersDir, "app")
+				})
+
+				it("exports the layer when the source date epoch is set", func() {
+					changeContents(epoch)
+					exporter.SourceDateEpoch = epoch
+
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					assertTarFileContents(t, fakeAppImage.AppLayerPath(), filepath.Join(appDir, ".hidden.txt"), "SOME-hidden-text\n")
+				})
+
+				it("exports the layer and records its content fingerprint when layer contents are hashed", func() {
+					changeContents(archive.NormalizedDateTime)
+					exporter.HashLayerContents = true
+
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					assertTarFileContents(t, fakeAppImage.AppLayerPath(), filepath.Join(appDir, ".hidden.txt"), "SOME-hidden-text\n")
+					metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+					h.AssertNil(t, err)
+					var meta metadata.LayersMetadata
+					h.AssertNil(t, json.Unmarshal([]byte(metadataJSON), &meta))
+					fingerprint, err := archive.Fingerprint(appDir, uid, gid, archive.NormalizedDateTime, true)
+					h.AssertNil(t, err)
+					h.AssertEq(t, meta.App.Fingerprint, fingerprint)
+				})
+			})
+
+			when("#Preview", func() {
+				it("does not add layers to or save the image", func() {
+					_, err := exporter.Preview(layersDir, appDir, fakeAppImage, fakeOriginalImage, fakeImageMetadata, launcherConfig, stack)
+					h.AssertNil(t, err)
+
+					h.AssertEq(t, fakeAppImage.NumberOfAddedLayers(), 0)
+					h.AssertEq(t, len(fakeAppImage.ReusedLayers()), 0)
+					h.AssertEq(t, fakeAppImage.IsSaved(), false)
+					h.AssertEq(t, len(exporter.Report().Images), 0)
+				})
+
+				it("reports added, reused and removed layers", func() {
+					layer4 := fakeImageMetadata.Buildpacks[1].Layers["layer4"]
+					layer4.Launch = true
+					fakeImageMetadata.Buildpacks[1].Layers["layer4"] = layer4
+
+					diff, err := exporter.Preview(layersDir, appDir, fakeAppImage, fakeOriginalImage, fakeImageMetadata, launcherConfig, stack)
+					h.AssertNil(t, err)
+
+					statuses := map[string]string{}
+					var uploadBytes int64
+					for _, l := range diff.Layers {
+						statuses[l.ID] = l.Status
+						if l.Status == "added" {
+							uploadBytes += l.Size
+						}
+					}
+					h.AssertEq(t, statuses, map[string]string{
+						"app":                                    "added",
+						"config":                                 "added",
+						"launcher":                               "reused",
+						"buildpack.id:launch-layer-no-local-dir": "reused",
+						"buildpack.id:new-launch-layer":          "added",
+						"other.buildpack.id:local-reusable-layer": "reused",
+						"other.buildpack.id:new-launch-layer":     "added",
+						"other.buildpack.id:layer4":               "removed",
+					})
+					if uploadBytes == 0 || diff.UploadBytes != uploadBytes {
+						t.Fatalf("expected upload bytes to be the size of the added layers (%d), got %d", uploadBytes, diff.UploadBytes)
+					}
+				})
+
+				it("reports changed labels and processes", func() {
+					h.AssertNil(t, fakeOriginalImage.SetLabel("io.buildpacks.build.metadata", `{
+					  "processes": [
+					    {"type": "web", "command": "npm", "args": ["run", "serve"]},
+					    {"type": "worker", "command": "npm run worker"}
+					  ]
+					}`))
+					exporter.ImageConfig = metadata.ImageConfigMetadata{Labels: map[string]string{"some.label": "some-value"}}
+
+					diff, err := exporter.Preview(layersDir, appDir, fakeAppImage, fakeOriginalImage, fakeImageMetadata, launcherConfig, stack)
+					h.AssertNil(t, err)
+
+					h.AssertEq(t, diff.Processes, []lifecycle.ChangeDiff{
+						{Key: "web", Status: "changed", Previous: "npm run serve", Current: "npm start"},
+						{Key: "worker", Status: "removed", Previous: "npm run worker"},
+					})
+
+					statuses := map[string]string{}
+					for _, l := range diff.Labels {
+						statuses[l.Key] = l.Status
+					}
+					h.AssertEq(t, statuses, map[string]string{
+						"io.buildpacks.build.metadata":     "changed",
+						"io.buildpacks.lifecycle.metadata": "changed",
+						"some.label":                       "added",
+					})
+				})
+
+				it("treats everything as added when there is no previous image", func() {
+					diff, err := exporter.Preview(layersDir, appDir, fakeAppImage, nil, fakeImageMetadata, launcherConfig, stack)
+					h.AssertNil(t, err)
+
+					for _, l := range diff.Labels {
+						h.AssertEq(t, l.Status, "added")
+					}
+					h.AssertEq(t, diff.Processes, []lifecycle.ChangeDiff{{Key: "web", Status: "added", Current: "npm start"}})
+				})
+
+				it("does not warn about config the image supports", func() {
+					exporter.SourceDateEpoch = time.Unix(1565000000, 0)
+					exporter.ImageConfig = metadata.ImageConfigMetadata{User: "some-user", ExposedPorts: []string{"8080"}}
+
+					_, err := exporter.Preview(layersDir, appDir, fakeAppImage, fakeOriginalImage, fakeImageMetadata, launcherConfig, stack)
+					h.AssertNil(t, err)
+
+					if strings.Contains(stdout.String(), "Warning:") {
+						t.Fatalf("expected no warnings, got:\n%s", stdout.String())
+					}
+				})
+
+				it("prints the diff", func() {
+					_, err := exporter.Preview(layersDir, appDir, fakeAppImage, fakeOriginalImage, fakeImageMetadata, launcherConfig, stack)
+					h.AssertNil(t, err)
+
+					h.AssertStringContains(t, stdout.String(), "*** Layers:\n      app - added\n")
+					h.AssertStringContains(t, stdout.String(), "*** Upload size: ")
+				})
+			})
+
 			it("reuses launch layers when only layer.toml is present", func() {
 				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
 
@@ -372,7 +579,15 @@ func testExporter(t *testing.T, when spec.G, it spec.S) {
         "commit": "asdf1234"
       }
     }
-  }
+  },
+  "processes": [
+    {
+      "type": "web",
+      "command": "npm start",
+      "args": null,
+      "direct": false
+    }
+  ]
 }
 `
 					h.AssertJSONEq(t, expectedJSON, metadataJSON)
@@ -454,7 +669,15 @@ type = "Apache-2.0"
         "commit": "asdf1234"
       }
     }
-  }
+  },
+  "processes": [
+    {
+      "type": "web",
+      "command": "npm start",
+      "args": null,
+      "direct": false
+    }
+  ]
 }
 `
 
@@ -489,7 +712,15 @@ type = "Apache-2.0"
         "commit": "asdf1234"
       }
     }
-  }
+  },
+  "processes": [
+    {
+      "type": "web",
+      "command": "npm start",
+      "args": null,
+      "direct": false
+    }
+  ]
 }
 `
 				h.AssertJSONEq(t, expectedJSON, metadataJSON)
@@ -554,6 +785,61 @@ type = "Apache-2.0"
 				})
 			})
 
+			when("a signer is set", func() {
+				var (
+					signer           *fakeSigner
+					fakeRemoteDigest = "sha256:c27a27006b74a056bed5d9edcebc394783880abe8691a8c87c78b7cffa6fa5ad"
+				)
+
+				it.Before(func() {
+					signer = &fakeSigner{}
+					exporter.Signer = signer
+				})
+
+				when("the image has a digest", func() {
+					it.Before(func() {
+						digestRef, err := name.NewDigest("some-repo/app-image@" + fakeRemoteDigest)
+						h.AssertNil(t, err)
+						fakeAppImage.SetIdentifier(remote.DigestIdentifier{Digest: digestRef})
+					})
+
+					it("signs the digest once for each repository", func() {
+						names := append(additionalNames, "some-repo/other-app-image:latest")
+						h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, names, launcherConfig, stack))
+
+						h.AssertEq(t, signer.signed, []string{
+							"some-repo/app-image@" + fakeRemoteDigest,
+							"some-repo/other-app-image:latest@" + fakeRemoteDigest,
+						})
+						h.AssertStringContains(t, stdout.String(), "*** Signed: index.docker.io/some-repo/app-image@"+fakeRemoteDigest)
+					})
+
+					it("does not sign tags that failed to save", func() {
+						names := []string{"not.a.tag@reference"}
+						err := exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, names, launcherConfig, stack)
+						h.AssertError(t, err, "failed to write image to the following tags")
+
+						h.AssertEq(t, signer.signed, []string{"some-repo/app-image@" + fakeRemoteDigest})
+					})
+
+					it("fails when signing fails", func() {
+						signer.err = errors.New("some-error")
+
+						h.AssertError(t,
+							exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack),
+							"signing image 'some-repo/app-image': some-error",
+						)
+					})
+				})
+
+				it("warns when the image has no digest", func() {
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					h.AssertEq(t, len(signer.signed), 0)
+					h.AssertStringContains(t, stdout.String(), "Warning: image 'some-image-id' has no digest, it will not be signed")
+				})
+			})
+
 			when("image has an ID identifier", func() {
 				it("outputs the image ID", func() {
 					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
@@ -615,6 +901,79 @@ type = "Apache-2.0"
 						),
 					)
 				})
+
+				it("reports the status of each tag", func() {
+					failingName := "not.a.tag@reference"
+
+					err := exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, append(additionalNames, failingName), launcherConfig, stack)
+					h.AssertError(t, err, "failed to write image to the following tags")
+
+					report := exporter.Report()
+					h.AssertEq(t, len(report.Images), 1)
+					h.AssertEq(t, report.Images[0].Tags, []lifecycle.TagReport{
+						{Name: fakeAppImage.Name(), Status: "succeeded"},
+						{Name: additionalNames[0], Status: "succeeded"},
+						{Name: additionalNames[1], Status: "succeeded"},
+						{Name: failingName, Status: "could not parse reference"},
+					})
+				})
+			})
+
+			when("#Report", func() {
+				it("reports the image, run image and every exported layer", func() {
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					report := exporter.Report()
+					h.AssertEq(t, len(report.Images), 1)
+					imageReport := report.Images[0]
+
+					h.AssertEq(t, imageReport.ImageID, "some-image-id")
+					h.AssertEq(t, imageReport.Digest, "")
+					h.AssertEq(t, imageReport.RunImage, metadata.RunImageMetadata{TopLayer: "some-top-layer-sha", Reference: "some-image-id"})
+					h.AssertEq(t, imageReport.Tags, []lifecycle.TagReport{
+						{Name: fakeAppImage.Name(), Status: "succeeded"},
+						{Name: additionalNames[0], Status: "succeeded"},
+						{Name: additionalNames[1], Status: "succeeded"},
+					})
+
+					layers := map[string]lifecycle.LayerReport{}
+					for _, l := range imageReport.Layers {
+						layers[l.ID] = l
+					}
+					h.AssertEq(t, len(layers), len(imageReport.Layers))
+
+					appLayerPath := fakeAppImage.AppLayerPath()
+					appLayerInfo, err := os.Stat(appLayerPath)
+					h.AssertNil(t, err)
+					h.AssertEq(t, layers["app"], lifecycle.LayerReport{
+						ID:     "app",
+						SHA:    "sha256:" + h.ComputeSHA256ForFile(t, appLayerPath),
+						Size:   appLayerInfo.Size(),
+						Status: lifecycle.LayerStatusAdded,
+					})
+					h.AssertEq(t, layers["launcher"].Status, lifecycle.LayerStatusReused)
+					h.AssertEq(t, layers["buildpack.id:launch-layer-no-local-dir"], lifecycle.LayerReport{
+						ID:     "buildpack.id:launch-layer-no-local-dir",
+						SHA:    "sha256:orig-launch-layer-no-local-dir-sha",
+						Status: lifecycle.LayerStatusReused,
+					})
+					h.AssertEq(t, layers["buildpack.id:new-launch-layer"].Status, lifecycle.LayerStatusAdded)
+					h.AssertEq(t, layers["other.buildpack.id:local-reusable-layer"].Status, lifecycle.LayerStatusReused)
+				})
+
+				it("records the layer size in the metadata label", func() {
+					h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, fakeImageMetadata, additionalNames, launcherConfig, stack))
+
+					metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+					h.AssertNil(t, err)
+
+					var meta metadata.LayersMetadata
+					h.AssertNil(t, json.Unmarshal([]byte(metadataJSON), &meta))
+
+					appLayerInfo, err := os.Stat(fakeAppImage.AppLayerPath())
+					h.AssertNil(t, err)
+					h.AssertEq(t, meta.App.Size, appLayerInfo.Size())
+				})
 			})
 
 			when("previous image metadata is missing buildpack for reused layer", func() {
@@ -831,6 +1190,437 @@ type = "Apache-2.0"
 			})
 		})
 
+		when("the same layers are exported to more than one image", func() {
+			it.Before(func() {
+				h.RecursiveCopy(t, filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers"), layersDir)
+				var err error
+				appDir, err = filepath.Abs(filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers", "app"))
+				h.AssertNil(t, err)
+			})
+
+			it("does not rewrite unchanged layer tars", func() {
+				otherImage := fakes.NewImage("other.registry.io/app-image", "some-top-layer-sha", local.IDIdentifier{ImageID: "other-image-id"})
+				defer otherImage.Cleanup()
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+
+				appTar := filepath.Join(exporter.ArtifactsDir, "app.tar")
+				past := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+				h.AssertNil(t, os.Chtimes(appTar, past, past))
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, otherImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+
+				fi, err := os.Stat(appTar)
+				h.AssertNil(t, err)
+				h.AssertEq(t, fi.ModTime().UTC(), past)
+				h.AssertEq(t, h.ComputeSHA256ForFile(t, otherImage.AppLayerPath()), h.ComputeSHA256ForFile(t, fakeAppImage.AppLayerPath()))
+			})
+
+			it("streams layers into images that read them when saved without writing tars", func() {
+				subject := *exporter
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+				fileMD, err := metadata.GetLayersMetdata(fakeAppImage)
+				h.AssertNil(t, err)
+
+				subject.ArtifactsDir = filepath.Join(filepath.Dir(layersDir), "streamed-artifacts")
+				h.AssertNil(t, os.MkdirAll(subject.ArtifactsDir, 0755))
+
+				imageDir := filepath.Join(filepath.Dir(layersDir), "streamed-app-image")
+				runImage, err := layout.NewImage(imageDir)
+				h.AssertNil(t, err)
+				h.AssertNil(t, runImage.AddLayer(launcherConfig.Path))
+				h.AssertNil(t, runImage.Save())
+				appImage, err := layout.NewImage(imageDir, layout.FromBaseImage(imageDir))
+				h.AssertNil(t, err)
+				h.AssertNil(t, subject.Export(layersDir, appDir, appImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+
+				tars, err := filepath.Glob(filepath.Join(subject.ArtifactsDir, "*.tar"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, len(tars), 0)
+
+				streamedMD, err := metadata.GetLayersMetdata(appImage)
+				h.AssertNil(t, err)
+				h.AssertEq(t, streamedMD.App, fileMD.App)
+				savedImage, err := layout.NewImage(imageDir, layout.FromBaseImage(imageDir))
+				h.AssertNil(t, err)
+				rc, err := savedImage.GetLayer(streamedMD.App.SHA)
+				h.AssertNil(t, err)
+				defer rc.Close()
+				hasher := sha256.New()
+				_, err = io.Copy(hasher, rc)
+				h.AssertNil(t, err)
+				h.AssertEq(t, "sha256:"+hex.EncodeToString(hasher.Sum(nil)), fileMD.App.SHA)
+			})
+		})
+
+		when("a source date epoch is set", func() {
+			var epoch = time.Date(2019, time.August, 1, 12, 0, 0, 0, time.UTC)
+
+			it.Before(func() {
+				h.RecursiveCopy(t, filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers"), layersDir)
+				var err error
+				appDir, err = filepath.Abs(filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers", "app"))
+				h.AssertNil(t, err)
+
+				exporter.SourceDateEpoch = epoch
+			})
+
+			it("uses the epoch as the modification time of layer entries", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				r, err := os.Open(fakeAppImage.AppLayerPath())
+				h.AssertNil(t, err)
+				defer r.Close()
+
+				tr := tar.NewReader(r)
+				for {
+					header, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					h.AssertNil(t, err)
+					if !header.ModTime.Equal(epoch) {
+						t.Fatalf("expected '%s' to have modification time %s, got %s", header.Name, epoch, header.ModTime)
+					}
+				}
+			})
+
+			it("sets the image created time when the image supports it", func() {
+				image := &createdAtImage{Image: fakeAppImage}
+				h.AssertNil(t, exporter.Export(layersDir, appDir, image, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				h.AssertEq(t, image.createdAt, epoch)
+			})
+
+			it("gives images exported from the same layers the epoch as their created time and the same digest", func() {
+				imagesDir, err := ioutil.TempDir("", "lifecycle.exporter.images")
+				h.AssertNil(t, err)
+				defer os.RemoveAll(imagesDir)
+
+				runImageDir := filepath.Join(imagesDir, "run-image")
+				runImage, err := layout.NewImage(runImageDir)
+				h.AssertNil(t, err)
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(imagesDir, "run-layer.tar"), []byte("some-run-layer"), 0644))
+				h.AssertNil(t, runImage.AddLayer(filepath.Join(imagesDir, "run-layer.tar")))
+				h.AssertNil(t, runImage.Save())
+
+				var digests []string
+				for _, name := range []string{"first-app-image", "second-app-image"} {
+					appImage, err := layout.NewImage(filepath.Join(imagesDir, name), layout.FromBaseImage(runImageDir))
+					h.AssertNil(t, err)
+					subject := *exporter
+					h.AssertNil(t, subject.Export(layersDir, appDir, appImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+
+					createdAt, err := appImage.CreatedAt()
+					h.AssertNil(t, err)
+					h.AssertEq(t, createdAt, epoch)
+					id, err := appImage.Identifier()
+					h.AssertNil(t, err)
+					digests = append(digests, id.String())
+				}
+				h.AssertEq(t, digests[0], digests[1])
+			})
+
+			it("warns when the image does not support setting the created time", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				h.AssertStringContains(t, stdout.String(), "Warning: image 'some-repo/app-image' does not support setting the created time")
+			})
+
+			it("produces identical layers when the same inputs are exported twice", func() {
+				otherImage := fakes.NewImage("some-repo/other-app-image", "some-top-layer-sha", local.IDIdentifier{ImageID: "some-image-id"})
+				defer otherImage.Cleanup()
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+				h.AssertNil(t, exporter.Export(layersDir, appDir, otherImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+
+				firstLabel, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+				h.AssertNil(t, err)
+				secondLabel, err := otherImage.Label("io.buildpacks.lifecycle.metadata")
+				h.AssertNil(t, err)
+				h.AssertJSONEq(t, firstLabel, secondLabel)
+
+				h.AssertEq(t, h.ComputeSHA256ForFile(t, otherImage.AppLayerPath()), h.ComputeSHA256ForFile(t, fakeAppImage.AppLayerPath()))
+				h.AssertEq(t, h.ComputeSHA256ForFile(t, otherImage.ConfigLayerPath()), h.ComputeSHA256ForFile(t, fakeAppImage.ConfigLayerPath()))
+			})
+		})
+
+		when("the platform supplies image config", func() {
+			it.Before(func() {
+				h.RecursiveCopy(t, filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers"), layersDir)
+				var err error
+				appDir, err = filepath.Abs(filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers", "app"))
+				h.AssertNil(t, err)
+
+				exporter.ImageConfig = metadata.ImageConfigMetadata{
+					Labels:       map[string]string{"some.label": "some-value"},
+					Env:          map[string]string{"SOME_ENV": "some-env-value"},
+					WorkingDir:   "/some/working/dir",
+					User:         "some-user",
+					ExposedPorts: []string{"8080", "53/UDP"},
+				}
+			})
+
+			it("sets the labels, env and working dir", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				val, err := fakeAppImage.Label("some.label")
+				h.AssertNil(t, err)
+				h.AssertEq(t, val, "some-value")
+
+				val, err = fakeAppImage.Env("SOME_ENV")
+				h.AssertNil(t, err)
+				h.AssertEq(t, val, "some-env-value")
+
+				h.AssertEq(t, fakeAppImage.WorkingDir(), "/some/working/dir")
+			})
+
+			it("sets the user and exposed ports when the image supports it", func() {
+				image := &configurableImage{Image: fakeAppImage}
+				h.AssertNil(t, exporter.Export(layersDir, appDir, image, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				h.AssertEq(t, image.user, "some-user")
+				h.AssertEq(t, image.exposedPorts, []string{"8080/tcp", "53/udp"})
+			})
+
+			it("sets the user and exposed ports in the config of a saved image", func() {
+				imageDir := filepath.Join(filepath.Dir(layersDir), "app-image")
+				runImage, err := layout.NewImage(imageDir)
+				h.AssertNil(t, err)
+				h.AssertNil(t, runImage.AddLayer(launcherConfig.Path))
+				h.AssertNil(t, runImage.Save())
+				appImage, err := layout.NewImage(imageDir, layout.FromBaseImage(imageDir))
+				h.AssertNil(t, err)
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, appImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+
+				config := layoutConfig(t, imageDir)
+				h.AssertEq(t, config.Config.User, "some-user")
+				h.AssertEq(t, config.Config.ExposedPorts, map[string]struct{}{"8080/tcp": {}, "53/udp": {}})
+			})
+
+			it("warns when the image does not support setting the user or exposed ports", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				h.AssertStringContains(t, stdout.String(), "Warning: image 'some-repo/app-image' does not support setting the user")
+				h.AssertStringContains(t, stdout.String(), "Warning: image 'some-repo/app-image' does not support setting exposed ports")
+			})
+
+			it("records no image config in the metadata label when none is supplied", func() {
+				exporter.ImageConfig = metadata.ImageConfigMetadata{}
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+				h.AssertNil(t, err)
+				if strings.Contains(metadataJSON, "imageConfig") {
+					t.Fatalf("expected '%s' not to contain an image config", metadataJSON)
+				}
+			})
+
+			it("records the image config in the metadata label", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+				h.AssertNil(t, err)
+
+				var md metadata.LayersMetadata
+				h.AssertNil(t, json.Unmarshal([]byte(metadataJSON), &md))
+				h.AssertEq(t, md.ImageConfig, &metadata.ImageConfigMetadata{
+					Labels:       map[string]string{"some.label": "some-value"},
+					Env:          map[string]string{"SOME_ENV": "some-env-value"},
+					WorkingDir:   "/some/working/dir",
+					User:         "some-user",
+					ExposedPorts: []string{"8080/tcp", "53/udp"},
+				})
+			})
+
+			it("does not allow lifecycle labels to be overridden", func() {
+				exporter.ImageConfig.Labels["io.buildpacks.lifecycle.metadata"] = "{}"
+
+				h.AssertError(t,
+					exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack),
+					"label 'io.buildpacks.lifecycle.metadata' is reserved by the lifecycle",
+				)
+			})
+
+			it("does not allow lifecycle env vars to be overridden", func() {
+				exporter.ImageConfig.Env["CNB_APP_DIR"] = "/other"
+
+				h.AssertError(t,
+					exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack),
+					"env var 'CNB_APP_DIR' is reserved by the lifecycle",
+				)
+			})
+
+			it("fails for an invalid exposed port", func() {
+				exporter.ImageConfig.ExposedPorts = []string{"8080/sctp"}
+
+				h.AssertError(t,
+					exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack),
+					"invalid exposed port '8080/sctp'",
+				)
+			})
+		})
+
+		when("the app directory is sliced", func() {
+			it.Before(func() {
+				h.RecursiveCopy(t, filepath.Join("testdata", "exporter", "previous-image-not-exist", "layers"), layersDir)
+				appDir = filepath.Join(filepath.Dir(layersDir), "sliced-app")
+				h.AssertNil(t, os.MkdirAll(filepath.Join(appDir, "vendor", "lib"), 0777))
+				h.AssertNil(t, os.MkdirAll(filepath.Join(appDir, "assets"), 0777))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(appDir, "vendor", "lib", "some-lib.js"), []byte("some-lib"), 0666))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(appDir, "assets", "logo.png"), []byte("some-logo"), 0666))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(appDir, "assets", "style.css"), []byte("some-style"), 0666))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(appDir, "main.go"), []byte("some-code"), 0666))
+
+				exporter.Slices = []lifecycle.Slice{
+					{Paths: []string{"vendor"}},
+					{Paths: []string{"assets/*.png"}},
+				}
+			})
+
+			it("exports each slice as a separate layer", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				appLayerPath := fakeAppImage.AppLayerPath()
+				assertTarFileContents(t, appLayerPath, filepath.Join(appDir, "main.go"), "some-code")
+				assertTarFileContents(t, appLayerPath, filepath.Join(appDir, "assets", "style.css"), "some-style")
+				assertTarFileNotContains(t, appLayerPath, filepath.Join(appDir, "vendor", "lib", "some-lib.js"))
+				assertTarFileNotContains(t, appLayerPath, filepath.Join(appDir, "assets", "logo.png"))
+
+				sliceLayerPath, err := fakeAppImage.FindLayerWithPath(filepath.Join(appDir, "vendor", "lib", "some-lib.js"))
+				h.AssertNil(t, err)
+				assertTarFileContents(t, sliceLayerPath, filepath.Join(appDir, "vendor", "lib", "some-lib.js"), "some-lib")
+				assertTarFileNotContains(t, sliceLayerPath, filepath.Join(appDir, "main.go"))
+				assertAddLayerLog(t, stdout, lifecycle.Slice{Paths: []string{"vendor"}}.ID(), sliceLayerPath)
+
+				sliceLayerPath, err = fakeAppImage.FindLayerWithPath(filepath.Join(appDir, "assets", "logo.png"))
+				h.AssertNil(t, err)
+				assertTarFileContents(t, sliceLayerPath, filepath.Join(appDir, "assets", "logo.png"), "some-logo")
+				assertTarFileNotContains(t, sliceLayerPath, filepath.Join(appDir, "assets", "style.css"))
+				assertAddLayerLog(t, stdout, lifecycle.Slice{Paths: []string{"assets/*.png"}}.ID(), sliceLayerPath)
+			})
+
+			it("saves the slice SHAs to the metadata label", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				metadataJSON, err := fakeAppImage.Label("io.buildpacks.lifecycle.metadata")
+				h.AssertNil(t, err)
+
+				var md metadata.LayersMetadata
+				h.AssertNil(t, json.Unmarshal([]byte(metadataJSON), &md))
+				h.AssertEq(t, len(md.Slices), 2)
+
+				sliceLayerPath, err := fakeAppImage.FindLayerWithPath(filepath.Join(appDir, "vendor", "lib", "some-lib.js"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, md.Slices[0].SHA, "sha256:"+h.ComputeSHA256ForFile(t, sliceLayerPath))
+				h.AssertEq(t, md.Slices[0].Paths, []string{"vendor"})
+				h.AssertEq(t, md.Slices[1].Paths, []string{"assets/*.png"})
+			})
+
+			it("reuses unchanged slices independently of the app layer", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+				previousMD, err := metadata.GetLayersMetdata(fakeAppImage)
+				h.AssertNil(t, err)
+
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(appDir, "main.go"), []byte("some-other-code"), 0666))
+
+				otherImage := fakes.NewImage("some-repo/other-app-image", "some-top-layer-sha", local.IDIdentifier{ImageID: "some-image-id"})
+				defer otherImage.Cleanup()
+				for _, sha := range []string{previousMD.Config.SHA, previousMD.Launcher.SHA, previousMD.Slices[0].SHA, previousMD.Slices[1].SHA} {
+					otherImage.AddPreviousLayer(sha, "")
+				}
+				for _, bp := range previousMD.Buildpacks {
+					for _, layer := range bp.Layers {
+						otherImage.AddPreviousLayer(layer.SHA, "")
+					}
+				}
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, otherImage, previousMD, nil, launcherConfig, stack))
+
+				h.AssertContains(t, otherImage.ReusedLayers(), previousMD.Slices[0].SHA, previousMD.Slices[1].SHA)
+				assertTarFileContents(t, otherImage.AppLayerPath(), filepath.Join(appDir, "main.go"), "some-other-code")
+			})
+
+			it("fails when two slices have the same paths", func() {
+				exporter.Slices = []lifecycle.Slice{
+					{Paths: []string{"vendor", "assets/*.png"}},
+					{Paths: []string{"assets/*.png", "vendor"}},
+				}
+
+				h.AssertError(t,
+					exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, nil, launcherConfig, stack),
+					"duplicate slice with paths 'assets/*.png', 'vendor'",
+				)
+			})
+
+			it("identifies slices unambiguously by their paths", func() {
+				h.AssertEq(t,
+					lifecycle.Slice{Paths: []string{"vendor", "assets"}}.ID(),
+					lifecycle.Slice{Paths: []string{"assets", "vendor"}}.ID(),
+				)
+				joined := lifecycle.Slice{Paths: []string{"vendor,assets"}}
+				separate := lifecycle.Slice{Paths: []string{"vendor", "assets"}}
+				if joined.ID() == separate.ID() {
+					t.Fatal("expected slices with different paths to have different IDs")
+				}
+			})
+
+			it("matches slices with the previous image by their paths", func() {
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, nil, launcherConfig, stack))
+				previousMD, err := metadata.GetLayersMetdata(fakeAppImage)
+				h.AssertNil(t, err)
+
+				exporter.Slices = []lifecycle.Slice{
+					{Paths: []string{"assets/*.png"}},
+					{Paths: []string{"vendor"}},
+				}
+				otherImage := fakes.NewImage("some-repo/other-app-image", "some-top-layer-sha", local.IDIdentifier{ImageID: "some-image-id"})
+				defer otherImage.Cleanup()
+				for _, sha := range []string{previousMD.App.SHA, previousMD.Config.SHA, previousMD.Launcher.SHA, previousMD.Slices[0].SHA, previousMD.Slices[1].SHA} {
+					otherImage.AddPreviousLayer(sha, "")
+				}
+				for _, bp := range previousMD.Buildpacks {
+					for _, layer := range bp.Layers {
+						otherImage.AddPreviousLayer(layer.SHA, "")
+					}
+				}
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, otherImage, previousMD, nil, launcherConfig, stack))
+
+				h.AssertContains(t, otherImage.ReusedLayers(), previousMD.Slices[0].SHA, previousMD.Slices[1].SHA)
+				md, err := metadata.GetLayersMetdata(otherImage)
+				h.AssertNil(t, err)
+				h.AssertEq(t, md.Slices[0].SHA, previousMD.Slices[1].SHA)
+				h.AssertEq(t, md.Slices[1].SHA, previousMD.Slices[0].SHA)
+			})
+
+			it("uses slices declared by buildpacks", func() {
+				exporter.Slices = nil
+				h.AssertNil(t, ioutil.WriteFile(
+					filepath.Join(layersDir, "config", "metadata.toml"),
+					[]byte("[[slices]]\npaths = [\"vendor\"]\n"),
+					0666,
+				))
+
+				h.AssertNil(t, exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack))
+
+				assertTarFileNotContains(t, fakeAppImage.AppLayerPath(), filepath.Join(appDir, "vendor", "lib", "some-lib.js"))
+				sliceLayerPath, err := fakeAppImage.FindLayerWithPath(filepath.Join(appDir, "vendor", "lib", "some-lib.js"))
+				h.AssertNil(t, err)
+				assertTarFileContents(t, sliceLayerPath, filepath.Join(appDir, "vendor", "lib", "some-lib.js"), "some-lib")
+			})
+
+			it("fails for an invalid slice path", func() {
+				exporter.Slices = []lifecycle.Slice{{Paths: []string{"["}}}
+
+				h.AssertError(t,
+					exporter.Export(layersDir, appDir, fakeAppImage, metadata.LayersMetadata{}, additionalNames, launcherConfig, stack),
+					"invalid slice path '['",
+				)
+			})
+		})
+
 		when("buildpack requires an escaped id", func() {
 			var (
 				fakeOriginalImage *fakes.Image
@@ -970,6 +1760,67 @@ type = "Apache-2.0"
 	})
 }
 
+// layoutConfig reads the config of the image saved to the OCI layout in dir.
+func layoutConfig(t *testing.T, dir string) v1.ConfigFile {
+	t.Helper()
+	readBlob := func(path string, v interface{}) {
+		t.Helper()
+		b, err := ioutil.ReadFile(path)
+		h.AssertNil(t, err)
+		h.AssertNil(t, json.Unmarshal(b, v))
+	}
+	blob := func(digest v1.Hash) string {
+		return filepath.Join(dir, "blobs", digest.Algorithm, digest.Hex)
+	}
+
+	var index v1.IndexManifest
+	readBlob(filepath.Join(dir, "index.json"), &index)
+	var manifest v1.Manifest
+	readBlob(blob(index.Manifests[0].Digest), &manifest)
+	var config v1.ConfigFile
+	readBlob(blob(manifest.Config.Digest), &config)
+	return config
+}
+
+type createdAtImage struct {
+	*fakes.Image
+	createdAt time.Time
+}
+
+func (i *createdAtImage) SetCreatedAt(t time.Time) error {
+	i.createdAt = t
+	return nil
+}
+
+type fakeSigner struct {
+	signed []string
+	err    error
+}
+
+func (s *fakeSigner) Sign(repoName, digest string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.signed = append(s.signed, repoName+"@"+digest)
+	return nil
+}
+
+type configurableImage struct {
+	*fakes.Image
+	user         string
+	exposedPorts []string
+}
+
+func (i *configurableImage) SetUser(user string) error {
+	i.user = user
+	return nil
+}
+
+func (i *configurableImage) SetExposedPorts(ports ...string) error {
+	i.exposedPorts = ports
+	return nil
+}
+
 func assertAddLayerLog(t *testing.T, stdout bytes.Buffer, name, layerPath string) {
 	t.Helper()
 	layerSHA := h.ComputeSHA256ForFile(t, layerPath)
@@ -993,6 +1844,13 @@ func assertTarFileContents(t *testing.T, tarfile, path, expected string) {
 	h.AssertEq(t, contents, expected)
 }
 
+func assertTarFileNotContains(t *testing.T, tarfile, path string) {
+	t.Helper()
+	if exist, _ := tarFileContext(t, tarfile, path); exist {
+		t.Fatalf("%s exists in %s", path, tarfile)
+	}
+}
+
 func tarFileContext(t *testing.T, tarfile, path string) (exist bool, contents string) {
 	t.Helper()
 	r, err := os.Open(tarfile)
@@ -5,18 +5,19 @@ require (
 	github.com/buildpack/imgutil v0.0.0-20190726132853-1f31ed20483a
 	github.com/docker/docker v0.7.3-0.20190307005417-54dddadc7d5d
 	github.com/docker/go-connections v0.4.0
-	github.com/docker/go-units v0.4.0 // indirect
+	github.com/docker/go-units v0.4.0
 	github.com/golang/mock v1.3.1
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/google/go-cmp v0.3.0
 	github.com/google/go-containerregistry v0.0.0-20190503220729-1c6c7f61e8a5
+	github.com/klauspost/compress v1.9.8
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/pkg/errors v0.8.1
 	github.com/sclevine/spec v1.2.0
 	github.com/sclevine/yj v0.0.0-20190506050358-d9a48607cc5c
 	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4 // indirect
 	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80 // indirect
-	golang.org/x/sys v0.0.0-20190804053845-51ab0e2deafa // indirect
+	golang.org/x/sys v0.0.0-20190804053845-51ab0e2deafa
 	golang.org/x/text v0.3.2 // indirect
 	golang.org/x/tools v0.0.0-20190808195139-e713427fea3f
 	google.golang.org/appengine v1.5.0 // indirect
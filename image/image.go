@@ -30,25 +30,29 @@ func ParseRegistry(imageName string) (string, error) {
 	return ref.Context().RegistryStr(), nil
 }
 
-func EnsureSingleRegistry(repoNames ...string) (string, error) {
-	set := make(map[string]interface{})
+type RegistryNames struct {
+	Registry string
+	Names    []string
+}
 
-	var (
-		err      error
-		registry string
-	)
+// GroupByRegistry groups repoNames by registry, preserving the order in which each registry is first seen.
+func GroupByRegistry(repoNames ...string) ([]RegistryNames, error) {
+	var groups []RegistryNames
+	index := map[string]int{}
 
 	for _, repoName := range repoNames {
-		registry, err = ParseRegistry(repoName)
+		registry, err := ParseRegistry(repoName)
 		if err != nil {
-			return "", errors.Wrapf(err, "parsing registry from repo '%s'", repoName)
+			return nil, errors.Wrapf(err, "parsing registry from repo '%s'", repoName)
 		}
-		set[registry] = nil
-	}
-
-	if len(set) != 1 {
-		return "", errors.New("exporting to multiple registries is unsupported")
+		i, ok := index[registry]
+		if !ok {
+			i = len(groups)
+			index[registry] = i
+			groups = append(groups, RegistryNames{Registry: registry})
+		}
+		groups[i].Names = append(groups[i].Names, repoName)
 	}
 
-	return registry, nil
+	return groups, nil
 }
@@ -70,20 +70,35 @@ func testImage(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
-	when("#EnsureSingleRegistry", func() {
+	when("#GroupByRegistry", func() {
 		when("multiple registries are provided", func() {
-			it("errors as unsupported", func() {
-				_, err := image.EnsureSingleRegistry("some/repo", "gcr.io/other-repo:latest", "example.com/final-repo")
-				h.AssertError(t, err, "exporting to multiple registries is unsupported")
+			it("groups names by registry in the order registries are first seen", func() {
+				groups, err := image.GroupByRegistry("some/repo", "gcr.io/other-repo:latest", "example.com/final-repo", "some/repo:other-tag")
+				h.AssertNil(t, err)
+
+				h.AssertEq(t, groups, []image.RegistryNames{
+					{Registry: "index.docker.io", Names: []string{"some/repo", "some/repo:other-tag"}},
+					{Registry: "gcr.io", Names: []string{"gcr.io/other-repo:latest"}},
+					{Registry: "example.com", Names: []string{"example.com/final-repo"}},
+				})
 			})
 		})
 
 		when("a single registry is provided", func() {
-			it("does not return an error and", func() {
-				registry, err := image.EnsureSingleRegistry("gcr.io/some/repo", "gcr.io/other-repo:latest", "gcr.io/final-repo")
+			it("returns a single group", func() {
+				groups, err := image.GroupByRegistry("gcr.io/some/repo", "gcr.io/other-repo:latest", "gcr.io/final-repo")
 				h.AssertNil(t, err)
 
-				h.AssertEq(t, registry, "gcr.io")
+				h.AssertEq(t, groups, []image.RegistryNames{
+					{Registry: "gcr.io", Names: []string{"gcr.io/some/repo", "gcr.io/other-repo:latest", "gcr.io/final-repo"}},
+				})
+			})
+		})
+
+		when("a name cannot be parsed", func() {
+			it("returns an error", func() {
+				_, err := image.GroupByRegistry("gcr.io/some/repo", "as@ohd@as@op")
+				h.AssertError(t, err, "parsing registry from repo 'as@ohd@as@op'")
 			})
 		})
 	})
@@ -0,0 +1,513 @@
+// Package layout implements images stored in an OCI image layout directory, holding a single image. Layers are
+// stored uncompressed, so that the digest of each layer blob is its diff ID.
+package layout
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/buildpack/imgutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/archive"
+)
+
+const (
+	indexFile     = "index.json"
+	layoutFile    = "oci-layout"
+	layoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+)
+
+type Image struct {
+	path     string
+	prev     *Image
+	found    bool
+	manifest v1.Manifest
+	digest   v1.Hash
+	config   v1.ConfigFile
+	layers   []layer
+	// createdAt is the creation time recorded when the image is saved, if it is not the time it is saved.
+	createdAt time.Time
+}
+
+// layer is a layer of an image, opened from a file added to the image or from a blob of a layout.
+type layer struct {
+	diffID v1.Hash
+	open   func() (io.ReadCloser, error)
+}
+
+type ImageOption func(image *Image) (*Image, error)
+
+// WithPreviousImage allows the layers of the image in the layout at path to be reused.
+func WithPreviousImage(path string) ImageOption {
+	return func(i *Image) (*Image, error) {
+		prev := &Image{path: path}
+		if err := prev.load(); err != nil {
+			return i, err
+		}
+		i.prev = prev
+		return i, nil
+	}
+}
+
+// FromBaseImage starts the image from the image in the layout at path, if there is one.
+func FromBaseImage(path string) ImageOption {
+	return func(i *Image) (*Image, error) {
+		base := &Image{path: path}
+		if err := base.load(); err != nil {
+			return i, err
+		}
+		if !base.found {
+			return i, nil
+		}
+		i.config = base.config
+		i.layers = base.layers
+		i.digest = base.digest
+		if base.path == i.path {
+			i.found, i.manifest = true, base.manifest
+		}
+		return i, nil
+	}
+}
+
+// NewImage returns an image that is saved to the layout at path.
+func NewImage(path string, ops ...ImageOption) (imgutil.Image, error) {
+	image := &Image{
+		path: path,
+		config: v1.ConfigFile{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+			RootFS:       v1.RootFS{Type: "layers"},
+		},
+	}
+
+	var err error
+	for _, op := range ops {
+		image, err = op(image)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return image, nil
+}
+
+// load reads the image in the layout, leaving it not found if the layout has no image.
+func (i *Image) load() error {
+	index, err := readIndex(i.path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(index.Manifests) == 0 {
+		return nil
+	}
+
+	i.digest = index.Manifests[0].Digest
+	if err := readJSONBlob(i.path, i.digest, &i.manifest); err != nil {
+		return errors.Wrapf(err, "reading manifest of image '%s'", i.path)
+	}
+	if err := readJSONBlob(i.path, i.manifest.Config.Digest, &i.config); err != nil {
+		return errors.Wrapf(err, "reading config of image '%s'", i.path)
+	}
+	if len(i.config.RootFS.DiffIDs) != len(i.manifest.Layers) {
+		return errors.Errorf("image '%s' has %d layers and %d diff IDs", i.path, len(i.manifest.Layers), len(i.config.RootFS.DiffIDs))
+	}
+	i.layers = nil
+	for n, diffID := range i.config.RootFS.DiffIDs {
+		i.layers = append(i.layers, layer{diffID: diffID, open: i.blobOpener(i.manifest.Layers[n].Digest)})
+	}
+	i.found = true
+	return nil
+}
+
+func (i *Image) Name() string {
+	return i.path
+}
+
+func (i *Image) Rename(name string) {
+	i.path = name
+}
+
+func (i *Image) Found() bool {
+	return i.found
+}
+
+func (i *Image) Label(key string) (string, error) {
+	return i.config.Config.Labels[key], nil
+}
+
+func (i *Image) SetLabel(key, val string) error {
+	if i.config.Config.Labels == nil {
+		i.config.Config.Labels = map[string]string{}
+	}
+	i.config.Config.Labels[key] = val
+	return nil
+}
+
+func (i *Image) Env(key string) (string, error) {
+	for _, env := range i.config.Config.Env {
+		if strings.HasPrefix(env, key+"=") {
+			return strings.TrimPrefix(env, key+"="), nil
+		}
+	}
+	return "", nil
+}
+
+func (i *Image) SetEnv(key, val string) error {
+	for n, env := range i.config.Config.Env {
+		if strings.HasPrefix(env, key+"=") {
+			i.config.Config.Env[n] = key + "=" + val
+			return nil
+		}
+	}
+	i.config.Config.Env = append(i.config.Config.Env, key+"="+val)
+	return nil
+}
+
+func (i *Image) SetEntrypoint(ep ...string) error {
+	i.config.Config.Entrypoint = ep
+	return nil
+}
+
+func (i *Image) SetWorkingDir(dir string) error {
+	i.config.Config.WorkingDir = dir
+	return nil
+}
+
+func (i *Image) SetCmd(cmd ...string) error {
+	i.config.Config.Cmd = cmd
+	return nil
+}
+
+func (i *Image) SetUser(user string) error {
+	i.config.Config.User = user
+	return nil
+}
+
+// SetExposedPorts replaces the exposed ports of the image with ports in the '<port>/<protocol>' form.
+func (i *Image) SetExposedPorts(ports ...string) error {
+	i.config.Config.ExposedPorts = map[string]struct{}{}
+	for _, p := range ports {
+		i.config.Config.ExposedPorts[p] = struct{}{}
+	}
+	return nil
+}
+
+func (i *Image) Rebase(string, imgutil.Image) error {
+	return errors.New("rebasing an OCI layout image is not supported")
+}
+
+func (i *Image) TopLayer() (string, error) {
+	if len(i.layers) == 0 {
+		return "", fmt.Errorf("image '%s' has no layers", i.path)
+	}
+	return i.layers[len(i.layers)-1].diffID.String(), nil
+}
+
+func (i *Image) CreatedAt() (time.Time, error) {
+	return i.config.Created.Time, nil
+}
+
+// SetCreatedAt sets the creation time recorded when the image is saved, instead of the time it is saved.
+func (i *Image) SetCreatedAt(t time.Time) error {
+	i.createdAt = t
+	return nil
+}
+
+// Identifier returns the digest of the manifest of the saved image, or of the base image before it is saved.
+func (i *Image) Identifier() (imgutil.Identifier, error) {
+	if i.digest.Hex == "" {
+		return nil, errors.Errorf("image '%s' has not been saved", i.path)
+	}
+	return i.digest, nil
+}
+
+// GetLayer returns the uncompressed contents of the layer with diff ID sha.
+func (i *Image) GetLayer(sha string) (io.ReadCloser, error) {
+	for _, l := range i.layers {
+		if l.diffID.String() == sha {
+			return l.open()
+		}
+	}
+	return nil, fmt.Errorf("image '%s' does not contain layer with diff ID '%s'", i.path, sha)
+}
+
+func (i *Image) AddLayer(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "AddLayer: open layer: %s", path)
+	}
+	defer f.Close()
+	diffID, _, err := v1.SHA256(f)
+	if err != nil {
+		return errors.Wrapf(err, "AddLayer: calculate checksum: %s", path)
+	}
+	i.layers = append(i.layers, layer{diffID: diffID, open: func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}})
+	return nil
+}
+
+// AddLayerFromOpener adds the layer with the given diff ID, reading its contents from open when the
+// image is saved. The contents are checked against the diff ID as they are written to the layout.
+func (i *Image) AddLayerFromOpener(diffID string, size int64, open func() (io.ReadCloser, error)) error {
+	hash, err := v1.NewHash(diffID)
+	if err != nil {
+		return errors.Wrapf(err, "AddLayerFromOpener: parse diff ID: %s", diffID)
+	}
+	i.layers = append(i.layers, layer{diffID: hash, open: open})
+	return nil
+}
+
+func (i *Image) ReuseLayer(sha string) error {
+	if i.prev == nil {
+		return errors.New("no previous image provided to reuse layers from")
+	}
+	for _, l := range i.prev.layers {
+		if l.diffID.String() == sha {
+			i.layers = append(i.layers, l)
+			return nil
+		}
+	}
+	return fmt.Errorf("SHA %s was not found in %s", sha, i.prev.path)
+}
+
+// Save writes the blobs of the image to the layout and then replaces the index of the layout, so that the
+// layout holds either the previous or the new image if saving fails.
+func (i *Image) Save(additionalNames ...string) error {
+	if err := i.save(); err != nil {
+		saveErr := imgutil.SaveError{}
+		for _, n := range append([]string{i.Name()}, additionalNames...) {
+			saveErr.Errors = append(saveErr.Errors, imgutil.SaveDiagnostic{ImageName: n, Cause: err})
+		}
+		return saveErr
+	}
+	if len(additionalNames) > 0 {
+		saveErr := imgutil.SaveError{}
+		for _, n := range additionalNames {
+			saveErr.Errors = append(saveErr.Errors, imgutil.SaveDiagnostic{ImageName: n, Cause: errors.New("OCI layout images have no additional names")})
+		}
+		return saveErr
+	}
+	return nil
+}
+
+func (i *Image) save() error {
+	if err := os.MkdirAll(filepath.Join(i.path, "blobs", "sha256"), 0755); err != nil {
+		return errors.Wrap(err, "creating layout")
+	}
+	if err := ioutil.WriteFile(filepath.Join(i.path, layoutFile), []byte(layoutVersion), 0644); err != nil {
+		return errors.Wrap(err, "creating layout")
+	}
+
+	manifest := v1.Manifest{SchemaVersion: 2, MediaType: types.OCIManifestSchema1}
+	config := i.config
+	config.Created = v1.Time{Time: time.Now().UTC()}
+	if !i.createdAt.IsZero() {
+		config.Created = v1.Time{Time: i.createdAt.UTC()}
+	}
+	config.RootFS = v1.RootFS{Type: "layers"}
+	for _, l := range i.layers {
+		size, err := writeLayerBlob(i.path, l)
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{MediaType: types.OCIUncompressedLayer, Size: size, Digest: l.diffID})
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, l.diffID)
+	}
+
+	var err error
+	if manifest.Config, err = writeJSONBlob(i.path, types.OCIConfigJSON, config); err != nil {
+		return errors.Wrap(err, "writing config")
+	}
+	desc, err := writeJSONBlob(i.path, types.OCIManifestSchema1, manifest)
+	if err != nil {
+		return errors.Wrap(err, "writing manifest")
+	}
+	index := v1.IndexManifest{SchemaVersion: 2, Manifests: []v1.Descriptor{desc}}
+	if err := writeIndex(i.path, index); err != nil {
+		return err
+	}
+
+	i.found, i.manifest, i.digest, i.config = true, manifest, desc.Digest, config
+	for n, l := range i.layers {
+		i.layers[n].open = i.blobOpener(l.diffID)
+	}
+	return nil
+}
+
+// Delete removes the image from the layout, along with its blobs that the image in the layout no longer uses.
+func (i *Image) Delete() error {
+	if !i.found {
+		return nil
+	}
+	index, err := readIndex(i.path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	var kept []v1.Descriptor
+	for _, desc := range index.Manifests {
+		if desc.Digest != i.digest {
+			kept = append(kept, desc)
+		}
+	}
+	if len(kept) != len(index.Manifests) {
+		index.Manifests = kept
+		if err := writeIndex(i.path, index); err != nil {
+			return err
+		}
+	}
+
+	used := map[v1.Hash]bool{}
+	for _, desc := range index.Manifests {
+		manifest := v1.Manifest{}
+		if err := readJSONBlob(i.path, desc.Digest, &manifest); err != nil {
+			return errors.Wrapf(err, "reading manifest of image '%s'", i.path)
+		}
+		used[desc.Digest], used[manifest.Config.Digest] = true, true
+		for _, l := range manifest.Layers {
+			used[l.Digest] = true
+		}
+	}
+	blobs := []v1.Hash{i.digest, i.manifest.Config.Digest}
+	for _, l := range i.manifest.Layers {
+		blobs = append(blobs, l.Digest)
+	}
+	for _, digest := range blobs {
+		if used[digest] {
+			continue
+		}
+		if err := os.Remove(blobPath(i.path, digest)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "deleting blob '%s'", digest)
+		}
+	}
+	i.found = false
+	return nil
+}
+
+// blobOpener opens a layer blob of the layout, decompressing it if it was compressed by another tool.
+func (i *Image) blobOpener(digest v1.Hash) func() (io.ReadCloser, error) {
+	path := blobPath(i.path, digest)
+	return func() (io.ReadCloser, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := archive.Decompress(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{rc, file}, nil
+	}
+}
+
+func blobPath(dir string, digest v1.Hash) string {
+	return filepath.Join(dir, "blobs", digest.Algorithm, digest.Hex)
+}
+
+func readIndex(dir string) (v1.IndexManifest, error) {
+	index := v1.IndexManifest{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		return index, errors.Wrapf(err, "reading index of layout '%s'", dir)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, errors.Wrapf(err, "parsing index of layout '%s'", dir)
+	}
+	return index, nil
+}
+
+func writeIndex(dir string, index v1.IndexManifest) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "serializing index")
+	}
+	if err := writeFileAtomic(filepath.Join(dir, indexFile), bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "writing index of layout '%s'", dir)
+	}
+	return nil
+}
+
+func readJSONBlob(dir string, digest v1.Hash, v interface{}) error {
+	data, err := ioutil.ReadFile(blobPath(dir, digest))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSONBlob(dir string, mediaType types.MediaType, v interface{}) (v1.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	digest := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+	if err := writeFileAtomic(blobPath(dir, digest), bytes.NewReader(data)); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{MediaType: mediaType, Size: int64(len(data)), Digest: digest}, nil
+}
+
+// writeLayerBlob writes a layer to the layout unless it is already there, and returns the size of the blob.
+func writeLayerBlob(dir string, l layer) (int64, error) {
+	path := blobPath(dir, l.diffID)
+	if fi, err := os.Stat(path); err == nil {
+		return fi.Size(), nil
+	}
+	rc, err := l.open()
+	if err != nil {
+		return 0, errors.Wrapf(err, "opening layer '%s'", l.diffID)
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	if err := writeFileAtomic(path, io.TeeReader(rc, hasher)); err != nil {
+		return 0, errors.Wrapf(err, "writing layer '%s'", l.diffID)
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != l.diffID.Hex {
+		os.Remove(path)
+		return 0, errors.Errorf("layer '%s' has diff ID 'sha256:%s'", l.diffID, actual)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func writeFileAtomic(path string, r io.Reader) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
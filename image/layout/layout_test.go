@@ -0,0 +1,195 @@
+package layout_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/image/layout"
+	"github.com/buildpack/lifecycle/metadata"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestLayout(t *testing.T) {
+	spec.Run(t, "Layout", testLayout, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testLayout(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir    string
+		layoutDir string
+	)
+
+	writeLayer := func(name, contents string) (string, string) {
+		t.Helper()
+		path := filepath.Join(tmpDir, name+".tar")
+		h.AssertNil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		return path, "sha256:" + h.ComputeSHA256ForFile(t, path)
+	}
+
+	blobs := func() []string {
+		t.Helper()
+		fis, err := ioutil.ReadDir(filepath.Join(layoutDir, "blobs", "sha256"))
+		h.AssertNil(t, err)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, "sha256:"+fi.Name())
+		}
+		return names
+	}
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "lifecycle.image.layout")
+		h.AssertNil(t, err)
+		layoutDir = filepath.Join(tmpDir, "layout")
+	})
+
+	it.After(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	when("the layout does not exist", func() {
+		it("is not found", func() {
+			image, err := layout.NewImage(layoutDir, layout.FromBaseImage(layoutDir))
+			h.AssertNil(t, err)
+			h.AssertEq(t, image.Found(), false)
+			label, err := image.Label("some-label")
+			h.AssertNil(t, err)
+			h.AssertEq(t, label, "")
+		})
+	})
+
+	when("#Save", func() {
+		it("writes an image that can be read back", func() {
+			path, sha := writeLayer("some-layer", "some-contents")
+			image, err := layout.NewImage(layoutDir)
+			h.AssertNil(t, err)
+			h.AssertNil(t, image.SetLabel("some-label", "some-value"))
+			h.AssertNil(t, image.AddLayer(path))
+			h.AssertNil(t, image.Save())
+			id, err := image.Identifier()
+			h.AssertNil(t, err)
+
+			saved, err := layout.NewImage(layoutDir, layout.FromBaseImage(layoutDir))
+			h.AssertNil(t, err)
+			h.AssertEq(t, saved.Found(), true)
+			savedID, err := saved.Identifier()
+			h.AssertNil(t, err)
+			h.AssertEq(t, savedID.String(), id.String())
+			label, err := saved.Label("some-label")
+			h.AssertNil(t, err)
+			h.AssertEq(t, label, "some-value")
+			top, err := saved.TopLayer()
+			h.AssertNil(t, err)
+			h.AssertEq(t, top, sha)
+
+			rc, err := saved.GetLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			contents, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "some-contents")
+			h.AssertContains(t, blobs(), sha)
+		})
+	})
+
+	when("#ReuseLayer", func() {
+		it("reuses layers of the previous image", func() {
+			keptPath, keptSHA := writeLayer("kept-layer", "kept-contents")
+			droppedPath, droppedSHA := writeLayer("dropped-layer", "dropped-contents")
+			prev, err := layout.NewImage(layoutDir)
+			h.AssertNil(t, err)
+			h.AssertNil(t, prev.AddLayer(keptPath))
+			h.AssertNil(t, prev.AddLayer(droppedPath))
+			h.AssertNil(t, prev.Save())
+
+			image, err := layout.NewImage(layoutDir, layout.WithPreviousImage(layoutDir))
+			h.AssertNil(t, err)
+			h.AssertNil(t, image.ReuseLayer(keptSHA))
+			h.AssertError(t, image.ReuseLayer("sha256:"+h.RandString(64)), "was not found in")
+			h.AssertNil(t, image.Save())
+
+			saved, err := layout.NewImage(layoutDir, layout.FromBaseImage(layoutDir))
+			h.AssertNil(t, err)
+			_, err = saved.GetLayer(droppedSHA)
+			h.AssertError(t, err, "does not contain layer")
+			h.AssertContains(t, blobs(), keptSHA, droppedSHA)
+		})
+
+		it("fails without a previous image", func() {
+			image, err := layout.NewImage(layoutDir)
+			h.AssertNil(t, err)
+			h.AssertError(t, image.ReuseLayer("sha256:"+h.RandString(64)), "no previous image provided to reuse layers from")
+		})
+	})
+
+	when("#Delete", func() {
+		it("removes the blobs that the saved image no longer uses", func() {
+			keptPath, keptSHA := writeLayer("kept-layer", "kept-contents")
+			droppedPath, droppedSHA := writeLayer("dropped-layer", "dropped-contents")
+			prev, err := layout.NewImage(layoutDir)
+			h.AssertNil(t, err)
+			h.AssertNil(t, prev.AddLayer(keptPath))
+			h.AssertNil(t, prev.AddLayer(droppedPath))
+			h.AssertNil(t, prev.Save())
+
+			image, err := layout.NewImage(layoutDir, layout.WithPreviousImage(layoutDir))
+			h.AssertNil(t, err)
+			h.AssertNil(t, image.ReuseLayer(keptSHA))
+			h.AssertNil(t, image.Save())
+			h.AssertNil(t, prev.Delete())
+
+			h.AssertEq(t, len(blobs()), 3) // the kept layer, the config and the manifest
+			h.AssertContains(t, blobs(), keptSHA)
+			for _, blob := range blobs() {
+				if blob == droppedSHA {
+					t.Fatal("expected the dropped layer to be deleted")
+				}
+			}
+		})
+	})
+
+	when("the layout stores a cache", func() {
+		it("keeps the cache metadata in a label", func() {
+			path, sha := writeLayer("some-layer", "some-contents")
+			newCache := func() *cache.ImageCache {
+				t.Helper()
+				origImage, err := layout.NewImage(layoutDir, layout.FromBaseImage(layoutDir))
+				h.AssertNil(t, err)
+				newImage, err := layout.NewImage(layoutDir, layout.WithPreviousImage(layoutDir))
+				h.AssertNil(t, err)
+				return cache.NewImageCache(origImage, newImage)
+			}
+
+			c := newCache()
+			h.AssertNil(t, c.AddLayerFile(sha, path))
+			meta := cache.Metadata{Buildpacks: []metadata.BuildpackLayersMetadata{{
+				ID:     "some.buildpack.id",
+				Layers: map[string]metadata.BuildpackLayerMetadata{"some-layer": {LayerMetadata: metadata.LayerMetadata{SHA: sha}}},
+			}}}
+			h.AssertNil(t, c.SetMetadata(meta))
+			h.AssertNil(t, c.Commit())
+
+			c = newCache()
+			retrieved, err := c.RetrieveMetadata()
+			h.AssertNil(t, err)
+			h.AssertEq(t, retrieved, meta)
+			h.AssertNil(t, c.ReuseLayer(sha))
+			h.AssertNil(t, c.SetMetadata(retrieved))
+			h.AssertNil(t, c.Commit())
+
+			rc, err := newCache().RetrieveLayer(sha)
+			h.AssertNil(t, err)
+			defer rc.Close()
+			contents, err := ioutil.ReadAll(rc)
+			h.AssertNil(t, err)
+			h.AssertEq(t, string(contents), "some-contents")
+		})
+	})
+}
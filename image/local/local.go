@@ -0,0 +1,626 @@
+// Package local implements images stored in a Docker daemon. It follows the daemon images of imgutil, adding
+// the parts of the image config the exporter sets that imgutil does not support.
+package local
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildpack/imgutil"
+	"github.com/buildpack/imgutil/local"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+type Image struct {
+	repoName      string
+	docker        *client.Client
+	inspect       types.ImageInspect
+	layerPaths    []string
+	prevName      string
+	easyAddLayers []string
+	// streamedLayers are the layers added by diff ID whose contents are read when the image is saved.
+	streamedLayers map[string]streamedLayer
+	exportMu       sync.Mutex
+	exported       map[string]*exportedImage
+	// createdAt is the creation time recorded when the image is saved, if it is not the time it is saved.
+	createdAt time.Time
+}
+
+// exportedImage is an image exported from the daemon, with the file of each layer keyed by its diff ID.
+type exportedImage struct {
+	dir       string
+	layersMap map[string]string
+}
+
+// streamedLayer is a layer whose contents are read from open when the image is saved.
+type streamedLayer struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+type ImageOption func(image *Image) (*Image, error)
+
+// WithPreviousImage allows the layers of the image named imageName to be reused.
+func WithPreviousImage(imageName string) ImageOption {
+	return func(i *Image) (*Image, error) {
+		if _, err := inspectOptionalImage(i.docker, imageName); err != nil {
+			return i, err
+		}
+		i.prevName = imageName
+		return i, nil
+	}
+}
+
+// FromBaseImage starts the image from the image named imageName, if there is one.
+func FromBaseImage(imageName string) ImageOption {
+	return func(i *Image) (*Image, error) {
+		inspect, err := inspectOptionalImage(i.docker, imageName)
+		if err != nil {
+			return i, err
+		}
+		i.inspect = inspect
+		i.layerPaths = make([]string, len(i.inspect.RootFS.Layers))
+		return i, nil
+	}
+}
+
+// NewImage returns an image that is saved to the daemon as repoName.
+func NewImage(repoName string, dockerClient *client.Client, ops ...ImageOption) (imgutil.Image, error) {
+	inspect := defaultInspect()
+	image := &Image{
+		docker:     dockerClient,
+		repoName:   repoName,
+		inspect:    inspect,
+		layerPaths: make([]string, len(inspect.RootFS.Layers)),
+	}
+
+	var err error
+	for _, op := range ops {
+		image, err = op(image)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return image, nil
+}
+
+func (i *Image) Label(key string) (string, error) {
+	return i.inspect.Config.Labels[key], nil
+}
+
+func (i *Image) Env(key string) (string, error) {
+	for _, env := range i.inspect.Config.Env {
+		if strings.HasPrefix(env, key+"=") {
+			return strings.TrimPrefix(env, key+"="), nil
+		}
+	}
+	return "", nil
+}
+
+// Rename names the image. Layers of an image already saved as name on the same base are reused by the daemon
+// rather than loaded again.
+func (i *Image) Rename(name string) {
+	i.easyAddLayers = nil
+	if prevInspect, _, err := i.docker.ImageInspectWithRaw(context.Background(), name); err == nil {
+		if i.sameBase(prevInspect) {
+			i.easyAddLayers = prevInspect.RootFS.Layers[len(i.inspect.RootFS.Layers):]
+		}
+	}
+	i.repoName = name
+}
+
+func (i *Image) sameBase(prevInspect types.ImageInspect) bool {
+	if len(prevInspect.RootFS.Layers) < len(i.inspect.RootFS.Layers) {
+		return false
+	}
+	for n, baseLayer := range i.inspect.RootFS.Layers {
+		if baseLayer != prevInspect.RootFS.Layers[n] {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *Image) Name() string {
+	return i.repoName
+}
+
+func (i *Image) Found() bool {
+	return i.inspect.ID != ""
+}
+
+func (i *Image) Identifier() (imgutil.Identifier, error) {
+	return local.IDIdentifier{
+		ImageID: strings.TrimPrefix(i.inspect.ID, "sha256:"),
+	}, nil
+}
+
+func (i *Image) CreatedAt() (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, i.inspect.Created)
+}
+
+// SetCreatedAt sets the creation time recorded when the image is saved, instead of the time it is saved.
+func (i *Image) SetCreatedAt(t time.Time) error {
+	i.createdAt = t
+	return nil
+}
+
+func (i *Image) Rebase(string, imgutil.Image) error {
+	return errors.New("rebasing a daemon image is not supported")
+}
+
+func (i *Image) SetLabel(key, val string) error {
+	if i.inspect.Config.Labels == nil {
+		i.inspect.Config.Labels = map[string]string{}
+	}
+	i.inspect.Config.Labels[key] = val
+	return nil
+}
+
+func (i *Image) SetEnv(key, val string) error {
+	i.inspect.Config.Env = append(i.inspect.Config.Env, fmt.Sprintf("%s=%s", key, val))
+	return nil
+}
+
+func (i *Image) SetWorkingDir(dir string) error {
+	i.inspect.Config.WorkingDir = dir
+	return nil
+}
+
+func (i *Image) SetUser(user string) error {
+	i.inspect.Config.User = user
+	return nil
+}
+
+// SetExposedPorts replaces the exposed ports of the image with ports in the '<port>/<protocol>' form.
+func (i *Image) SetExposedPorts(ports ...string) error {
+	i.inspect.Config.ExposedPorts = nat.PortSet{}
+	for _, p := range ports {
+		i.inspect.Config.ExposedPorts[nat.Port(p)] = struct{}{}
+	}
+	return nil
+}
+
+func (i *Image) SetEntrypoint(ep ...string) error {
+	i.inspect.Config.Entrypoint = ep
+	return nil
+}
+
+func (i *Image) SetCmd(cmd ...string) error {
+	i.inspect.Config.Cmd = cmd
+	return nil
+}
+
+func (i *Image) TopLayer() (string, error) {
+	all := i.inspect.RootFS.Layers
+	if len(all) == 0 {
+		return "", fmt.Errorf("image '%s' has no layers", i.repoName)
+	}
+	return all[len(all)-1], nil
+}
+
+func (i *Image) GetLayer(sha string) (io.ReadCloser, error) {
+	exported, err := i.exportImageOnce(i.repoName)
+	if err != nil {
+		return nil, err
+	}
+	layerID, ok := exported.layersMap[sha]
+	if !ok {
+		return nil, fmt.Errorf("image '%s' does not contain layer with diff ID '%s'", i.repoName, sha)
+	}
+	return os.Open(filepath.Join(exported.dir, layerID))
+}
+
+func (i *Image) AddLayer(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "AddLayer: open layer: %s", path)
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return errors.Wrapf(err, "AddLayer: calculate checksum: %s", path)
+	}
+	sha := hex.EncodeToString(hasher.Sum(nil))
+
+	i.inspect.RootFS.Layers = append(i.inspect.RootFS.Layers, "sha256:"+sha)
+	i.layerPaths = append(i.layerPaths, path)
+	i.easyAddLayers = nil
+	return nil
+}
+
+// AddLayerFromOpener adds the layer with the given diff ID and size, reading its contents from open
+// when the image is saved rather than from a file.
+func (i *Image) AddLayerFromOpener(diffID string, size int64, open func() (io.ReadCloser, error)) error {
+	if i.streamedLayers == nil {
+		i.streamedLayers = map[string]streamedLayer{}
+	}
+	i.streamedLayers[diffID] = streamedLayer{size: size, open: open}
+
+	i.inspect.RootFS.Layers = append(i.inspect.RootFS.Layers, diffID)
+	i.layerPaths = append(i.layerPaths, diffID)
+	i.easyAddLayers = nil
+	return nil
+}
+
+func (i *Image) ReuseLayer(sha string) error {
+	if len(i.easyAddLayers) > 0 && i.easyAddLayers[0] == sha {
+		i.inspect.RootFS.Layers = append(i.inspect.RootFS.Layers, sha)
+		i.layerPaths = append(i.layerPaths, "")
+		i.easyAddLayers = i.easyAddLayers[1:]
+		return nil
+	}
+
+	if i.prevName == "" {
+		return errors.New("no previous image provided to reuse layers from")
+	}
+	exported, err := i.exportImageOnce(i.prevName)
+	if err != nil {
+		return err
+	}
+	reuseLayer, ok := exported.layersMap[sha]
+	if !ok {
+		return fmt.Errorf("SHA %s was not found in %s", sha, i.repoName)
+	}
+	return i.AddLayer(filepath.Join(exported.dir, reuseLayer))
+}
+
+func (i *Image) Save(additionalNames ...string) error {
+	inspect, err := i.doSave()
+	if err != nil {
+		saveErr := imgutil.SaveError{}
+		for _, n := range append([]string{i.Name()}, additionalNames...) {
+			saveErr.Errors = append(saveErr.Errors, imgutil.SaveDiagnostic{ImageName: n, Cause: err})
+		}
+		return saveErr
+	}
+	i.inspect = inspect
+
+	var errs []imgutil.SaveDiagnostic
+	for _, n := range additionalNames {
+		if err := i.docker.ImageTag(context.Background(), i.repoName, n); err != nil {
+			errs = append(errs, imgutil.SaveDiagnostic{ImageName: n, Cause: err})
+		}
+	}
+	if len(errs) > 0 {
+		return imgutil.SaveError{Errors: errs}
+	}
+	return nil
+}
+
+// doSave loads the image into the daemon as a tar holding its config and the layers that are not reused.
+func (i *Image) doSave() (types.ImageInspect, error) {
+	ctx := context.Background()
+	done := make(chan error)
+
+	t, err := name.NewTag(i.repoName, name.WeakValidation)
+	if err != nil {
+		return types.ImageInspect{}, err
+	}
+	repoName := t.String()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		res, err := i.docker.ImageLoad(ctx, pr, true)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		defer res.Body.Close()
+		io.Copy(ioutil.Discard, res.Body)
+		done <- nil
+	}()
+
+	tw := tar.NewWriter(pw)
+	defer tw.Close()
+
+	configFile, err := i.newConfigFile()
+	if err != nil {
+		return types.ImageInspect{}, errors.Wrap(err, "generate config file")
+	}
+	id := fmt.Sprintf("%x", sha256.Sum256(configFile))
+	if err := addTextToTar(tw, id+".json", configFile); err != nil {
+		return types.ImageInspect{}, err
+	}
+
+	var layerPaths []string
+	for _, path := range i.layerPaths {
+		if path == "" {
+			layerPaths = append(layerPaths, "")
+			continue
+		}
+		layerName := fmt.Sprintf("/%x.tar", sha256.Sum256([]byte(path)))
+		if l, ok := i.streamedLayers[path]; ok {
+			err = addStreamToTar(tw, layerName, l)
+		} else {
+			err = addFileToTar(tw, layerName, path)
+		}
+		if err != nil {
+			return types.ImageInspect{}, err
+		}
+		layerPaths = append(layerPaths, layerName)
+	}
+
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{
+			"Config":   id + ".json",
+			"RepoTags": []string{repoName},
+			"Layers":   layerPaths,
+		},
+	})
+	if err != nil {
+		return types.ImageInspect{}, err
+	}
+	if err := addTextToTar(tw, "manifest.json", manifest); err != nil {
+		return types.ImageInspect{}, err
+	}
+
+	tw.Close()
+	pw.Close()
+	if err := <-done; err != nil {
+		return types.ImageInspect{}, errors.Wrapf(err, "load image '%s'", i.repoName)
+	}
+
+	if err := i.forgetExport(i.repoName); err != nil {
+		return types.ImageInspect{}, errors.Wrapf(err, "remove export of image '%s'", i.repoName)
+	}
+
+	inspect, _, err := i.docker.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return types.ImageInspect{}, errors.Wrapf(err, "save image '%s'", i.repoName)
+		}
+		return types.ImageInspect{}, err
+	}
+	return inspect, nil
+}
+
+func (i *Image) newConfigFile() ([]byte, error) {
+	createdAt := time.Now()
+	if !i.createdAt.IsZero() {
+		createdAt = i.createdAt
+	}
+	imgConfig := map[string]interface{}{
+		"os":      "linux",
+		"created": createdAt.UTC().Format(time.RFC3339),
+		"config":  i.inspect.Config,
+		"rootfs": map[string][]string{
+			"diff_ids": i.inspect.RootFS.Layers,
+		},
+		"history": make([]struct{}, len(i.inspect.RootFS.Layers)),
+	}
+	return json.Marshal(imgConfig)
+}
+
+func (i *Image) Delete() error {
+	if !i.Found() {
+		return nil
+	}
+	options := types.ImageRemoveOptions{
+		Force:         true,
+		PruneChildren: true,
+	}
+	_, err := i.docker.ImageRemove(context.Background(), i.inspect.ID, options)
+	return err
+}
+
+// exportImageOnce exports imageName from the daemon the first time its layers are needed, and keeps the export
+// until the image is saved under that name or cleaned up.
+func (i *Image) exportImageOnce(imageName string) (*exportedImage, error) {
+	i.exportMu.Lock()
+	defer i.exportMu.Unlock()
+	if exported, ok := i.exported[imageName]; ok {
+		return exported, nil
+	}
+	exported, err := exportImage(i.docker, imageName)
+	if err != nil {
+		return nil, err
+	}
+	if i.exported == nil {
+		i.exported = map[string]*exportedImage{}
+	}
+	i.exported[imageName] = exported
+	return exported, nil
+}
+
+// forgetExport removes the export of imageName, which no longer matches the image in the daemon.
+func (i *Image) forgetExport(imageName string) error {
+	i.exportMu.Lock()
+	defer i.exportMu.Unlock()
+	exported, ok := i.exported[imageName]
+	if !ok {
+		return nil
+	}
+	delete(i.exported, imageName)
+	return os.RemoveAll(exported.dir)
+}
+
+// Cleanup removes the images exported from the daemon to read or reuse their layers.
+func (i *Image) Cleanup() error {
+	i.exportMu.Lock()
+	defer i.exportMu.Unlock()
+	var err error
+	for name, exported := range i.exported {
+		if rmErr := os.RemoveAll(exported.dir); rmErr != nil {
+			err = rmErr
+		}
+		delete(i.exported, name)
+	}
+	return err
+}
+
+// exportImage saves the image from the daemon to a temporary directory, which is removed if the export fails.
+func exportImage(docker *client.Client, imageName string) (exported *exportedImage, err error) {
+	tarFile, err := docker.ImageSave(context.Background(), []string{imageName})
+	if err != nil {
+		return nil, err
+	}
+	defer tarFile.Close()
+
+	tmpDir, err := ioutil.TempDir("", "lifecycle.local.image.")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temp dir")
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	if err := untar(tarFile, tmpDir); err != nil {
+		return nil, err
+	}
+
+	var manifest []struct {
+		Config string
+		Layers []string
+	}
+	if err := readJSON(filepath.Join(tmpDir, "manifest.json"), &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest) != 1 {
+		return nil, fmt.Errorf("manifest.json had unexpected number of entries: %d", len(manifest))
+	}
+
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := readJSON(filepath.Join(tmpDir, manifest[0].Config), &config); err != nil {
+		return nil, err
+	}
+	if len(manifest[0].Layers) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("layers and diff IDs do not match, there are %d layers and %d diffIDs", len(manifest[0].Layers), len(config.RootFS.DiffIDs))
+	}
+
+	layersMap := make(map[string]string, len(manifest[0].Layers))
+	for n, diffID := range config.RootFS.DiffIDs {
+		layersMap[diffID] = manifest[0].Layers[n]
+	}
+	return &exportedImage{dir: tmpDir, layersMap: layersMap}, nil
+}
+
+func readJSON(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+func addTextToTar(tw *tar.Writer, name string, contents []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+func addFileToTar(tw *tar.Writer, name string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: fi.Size()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func addStreamToTar(tw *tar.Writer, name string, l streamedLayer) error {
+	rc, err := l.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: l.size}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, rc)
+	return err
+}
+
+func untar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, hdr.FileInfo().Mode())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(fh, tr); err != nil {
+				fh.Close()
+				return err
+			}
+			fh.Close()
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown file type in tar %d", hdr.Typeflag)
+		}
+	}
+}
+
+func inspectOptionalImage(docker *client.Client, imageName string) (types.ImageInspect, error) {
+	inspect, _, err := docker.ImageInspectWithRaw(context.Background(), imageName)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return defaultInspect(), nil
+		}
+		return types.ImageInspect{}, errors.Wrapf(err, "verifying image '%s'", imageName)
+	}
+	return inspect, nil
+}
+
+func defaultInspect() types.ImageInspect {
+	return types.ImageInspect{
+		Config: &container.Config{},
+	}
+}
@@ -0,0 +1,374 @@
+// Package remote implements images stored in a registry. It follows the registry images of imgutil, adding
+// the parts of the image config the exporter sets that imgutil does not support.
+package remote
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/buildpack/imgutil"
+	"github.com/buildpack/imgutil/remote"
+	"github.com/buildpack/lifecycle/image/auth"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	ggcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+type Image struct {
+	keychain   authn.Keychain
+	repoName   string
+	image      v1.Image
+	prevLayers []v1.Layer
+	// createdAt is the creation time recorded when the image is saved, if it is not the time it is saved.
+	createdAt time.Time
+}
+
+type ImageOption func(*Image) (*Image, error)
+
+// WithPreviousImage allows the layers of the image named imageName to be reused.
+func WithPreviousImage(imageName string) ImageOption {
+	return func(i *Image) (*Image, error) {
+		prevImage, err := newV1Image(i.keychain, imageName)
+		if err != nil {
+			return nil, err
+		}
+		prevLayers, err := prevImage.Layers()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get layers for previous image with repo name '%s'", imageName)
+		}
+		i.prevLayers = prevLayers
+		return i, nil
+	}
+}
+
+// FromBaseImage starts the image from the image named imageName, if there is one.
+func FromBaseImage(imageName string) ImageOption {
+	return func(i *Image) (*Image, error) {
+		var err error
+		i.image, err = newV1Image(i.keychain, imageName)
+		if err != nil {
+			return nil, err
+		}
+		return i, nil
+	}
+}
+
+// NewImage returns an image that is saved to the registry as repoName.
+func NewImage(repoName string, keychain authn.Keychain, ops ...ImageOption) (imgutil.Image, error) {
+	image, err := emptyImage()
+	if err != nil {
+		return nil, err
+	}
+	ri := &Image{
+		keychain: keychain,
+		repoName: repoName,
+		image:    image,
+	}
+	for _, op := range ops {
+		ri, err = op(ri)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ri, nil
+}
+
+// newV1Image returns the image named repoName, or an empty image if the registry does not have it.
+func newV1Image(keychain authn.Keychain, repoName string) (v1.Image, error) {
+	ref, auth, err := auth.ReferenceForRepoName(keychain, repoName)
+	if err != nil {
+		return nil, err
+	}
+	image, err := ggcrremote.Image(ref, ggcrremote.WithAuth(auth), ggcrremote.WithTransport(http.DefaultTransport))
+	if err != nil {
+		if transportErr, ok := err.(*transport.Error); ok && len(transportErr.Errors) > 0 {
+			switch transportErr.Errors[0].Code {
+			case transport.UnauthorizedErrorCode, transport.ManifestUnknownErrorCode:
+				return emptyImage()
+			}
+		}
+		return nil, fmt.Errorf("connect to repo store '%s': %s", repoName, err.Error())
+	}
+	return image, nil
+}
+
+func emptyImage() (v1.Image, error) {
+	return random.Image(0, 0)
+}
+
+func (i *Image) configFile() (*v1.ConfigFile, error) {
+	cfg, err := i.image.ConfigFile()
+	if err != nil || cfg == nil {
+		return nil, fmt.Errorf("failed to get config file for image '%s'", i.repoName)
+	}
+	return cfg, nil
+}
+
+// mutateConfig applies change to a copy of the config of the image.
+func (i *Image) mutateConfig(change func(config *v1.Config)) error {
+	cfg, err := i.configFile()
+	if err != nil {
+		return err
+	}
+	config := *cfg.Config.DeepCopy()
+	change(&config)
+	i.image, err = mutate.Config(i.image, config)
+	return err
+}
+
+func (i *Image) Label(key string) (string, error) {
+	cfg, err := i.configFile()
+	if err != nil {
+		return "", err
+	}
+	return cfg.Config.Labels[key], nil
+}
+
+func (i *Image) Env(key string) (string, error) {
+	cfg, err := i.configFile()
+	if err != nil {
+		return "", err
+	}
+	for _, env := range cfg.Config.Env {
+		if strings.HasPrefix(env, key+"=") {
+			return strings.TrimPrefix(env, key+"="), nil
+		}
+	}
+	return "", nil
+}
+
+func (i *Image) Rename(name string) {
+	i.repoName = name
+}
+
+func (i *Image) Name() string {
+	return i.repoName
+}
+
+func (i *Image) Found() bool {
+	ref, auth, err := auth.ReferenceForRepoName(i.keychain, i.repoName)
+	if err != nil {
+		return false
+	}
+	_, err = ggcrremote.Image(ref, ggcrremote.WithAuth(auth), ggcrremote.WithTransport(http.DefaultTransport))
+	return err == nil
+}
+
+func (i *Image) Identifier() (imgutil.Identifier, error) {
+	hash, err := i.image.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get digest for image '%s': %s", i.repoName, err)
+	}
+	digestRef, err := name.NewDigest(i.repoName+"@"+hash.String(), name.WeakValidation)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating digest reference")
+	}
+	return remote.DigestIdentifier{Digest: digestRef}, nil
+}
+
+func (i *Image) CreatedAt() (time.Time, error) {
+	cfg, err := i.image.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get createdAt time for image '%s': %s", i.repoName, err)
+	}
+	return cfg.Created.UTC(), nil
+}
+
+// SetCreatedAt sets the creation time recorded when the image is saved, instead of the time it is saved.
+func (i *Image) SetCreatedAt(t time.Time) error {
+	i.createdAt = t
+	return nil
+}
+
+func (i *Image) Rebase(string, imgutil.Image) error {
+	return errors.New("rebasing a registry image is not supported")
+}
+
+func (i *Image) SetLabel(key, val string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		if config.Labels == nil {
+			config.Labels = map[string]string{}
+		}
+		config.Labels[key] = val
+	})
+}
+
+func (i *Image) SetEnv(key, val string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		for n, env := range config.Env {
+			if strings.HasPrefix(env, key+"=") {
+				config.Env[n] = key + "=" + val
+				return
+			}
+		}
+		config.Env = append(config.Env, key+"="+val)
+	})
+}
+
+func (i *Image) SetWorkingDir(dir string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		config.WorkingDir = dir
+	})
+}
+
+func (i *Image) SetUser(user string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		config.User = user
+	})
+}
+
+// SetExposedPorts replaces the exposed ports of the image with ports in the '<port>/<protocol>' form.
+func (i *Image) SetExposedPorts(ports ...string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		config.ExposedPorts = map[string]struct{}{}
+		for _, p := range ports {
+			config.ExposedPorts[p] = struct{}{}
+		}
+	})
+}
+
+func (i *Image) SetEntrypoint(ep ...string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		config.Entrypoint = ep
+	})
+}
+
+func (i *Image) SetCmd(cmd ...string) error {
+	return i.mutateConfig(func(config *v1.Config) {
+		config.Cmd = cmd
+	})
+}
+
+func (i *Image) TopLayer() (string, error) {
+	all, err := i.image.Layers()
+	if err != nil {
+		return "", err
+	}
+	if len(all) == 0 {
+		return "", fmt.Errorf("image %s has no layers", i.Name())
+	}
+	diffID, err := all[len(all)-1].DiffID()
+	if err != nil {
+		return "", err
+	}
+	return diffID.String(), nil
+}
+
+func (i *Image) GetLayer(sha string) (io.ReadCloser, error) {
+	layers, err := i.image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	layer, err := findLayerWithSha(layers, sha)
+	if err != nil {
+		return nil, err
+	}
+	return layer.Uncompressed()
+}
+
+func (i *Image) AddLayer(path string) error {
+	layer, err := tarball.LayerFromFile(path)
+	if err != nil {
+		return err
+	}
+	i.image, err = mutate.AppendLayers(i.image, layer)
+	if err != nil {
+		return errors.Wrap(err, "add layer")
+	}
+	return nil
+}
+
+// AddLayerFromOpener adds the layer with the given diff ID, reading its contents from open each time
+// they are needed rather than from a file. The size is not needed by registry images.
+func (i *Image) AddLayerFromOpener(diffID string, size int64, open func() (io.ReadCloser, error)) error {
+	layer, err := tarball.LayerFromOpener(open)
+	if err != nil {
+		return err
+	}
+	actual, err := layer.DiffID()
+	if err != nil {
+		return errors.Wrap(err, "get diff ID for layer")
+	}
+	if actual.String() != diffID {
+		return fmt.Errorf("layer has diff ID '%s', expected '%s'", actual, diffID)
+	}
+	i.image, err = mutate.AppendLayers(i.image, layer)
+	if err != nil {
+		return errors.Wrap(err, "add layer")
+	}
+	return nil
+}
+
+func (i *Image) ReuseLayer(sha string) error {
+	layer, err := findLayerWithSha(i.prevLayers, sha)
+	if err != nil {
+		return err
+	}
+	i.image, err = mutate.AppendLayers(i.image, layer)
+	return err
+}
+
+func findLayerWithSha(layers []v1.Layer, sha string) (v1.Layer, error) {
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, errors.Wrap(err, "get diff ID for previous image layer")
+		}
+		if sha == diffID.String() {
+			return layer, nil
+		}
+	}
+	return nil, fmt.Errorf(`previous image did not have layer with sha '%s'`, sha)
+}
+
+func (i *Image) Save(additionalNames ...string) error {
+	createdAt := time.Now()
+	if !i.createdAt.IsZero() {
+		createdAt = i.createdAt
+	}
+	var err error
+	i.image, err = mutate.CreatedAt(i.image, v1.Time{Time: createdAt})
+	if err != nil {
+		return errors.Wrap(err, "set creation time")
+	}
+
+	var diagnostics []imgutil.SaveDiagnostic
+	for _, n := range append([]string{i.repoName}, additionalNames...) {
+		if err := i.doSave(n); err != nil {
+			diagnostics = append(diagnostics, imgutil.SaveDiagnostic{ImageName: n, Cause: err})
+		}
+	}
+	if len(diagnostics) > 0 {
+		return imgutil.SaveError{Errors: diagnostics}
+	}
+	return nil
+}
+
+func (i *Image) doSave(imageName string) error {
+	ref, auth, err := auth.ReferenceForRepoName(i.keychain, imageName)
+	if err != nil {
+		return err
+	}
+	return ggcrremote.Write(ref, i.image, ggcrremote.WithAuth(auth))
+}
+
+func (i *Image) Delete() error {
+	id, err := i.Identifier()
+	if err != nil {
+		return err
+	}
+	ref, auth, err := auth.ReferenceForRepoName(i.keychain, id.String())
+	if err != nil {
+		return err
+	}
+	return ggcrremote.Delete(ref, ggcrremote.WithAuth(auth))
+}
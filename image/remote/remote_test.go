@@ -0,0 +1,149 @@
+package remote_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	ggcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/image/remote"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestRemote(t *testing.T) {
+	spec.Run(t, "Remote", testRemote, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+func testRemote(t *testing.T, when spec.G, it spec.S) {
+	var (
+		server   *httptest.Server
+		repoName string
+	)
+
+	it.Before(func() {
+		server = httptest.NewServer(registry.New())
+		u, err := url.Parse(server.URL)
+		h.AssertNil(t, err)
+		repoName = u.Host + "/some/image"
+	})
+
+	it.After(func() {
+		server.Close()
+	})
+
+	when("#SetCreatedAt", func() {
+		it("records the time as the creation time of the saved image", func() {
+			img, err := remote.NewImage(repoName, authn.DefaultKeychain)
+			h.AssertNil(t, err)
+			h.AssertNil(t, img.SetLabel("some-key", "some-value"))
+
+			createdAt := time.Unix(1565000000, 0).UTC()
+			h.AssertNil(t, img.(*remote.Image).SetCreatedAt(createdAt))
+			h.AssertNil(t, img.Save())
+
+			saved, err := remote.NewImage(repoName, authn.DefaultKeychain, remote.FromBaseImage(repoName))
+			h.AssertNil(t, err)
+			actual, err := saved.CreatedAt()
+			h.AssertNil(t, err)
+			h.AssertEq(t, actual, createdAt)
+			label, err := saved.Label("some-key")
+			h.AssertNil(t, err)
+			h.AssertEq(t, label, "some-value")
+		})
+	})
+
+	when("#SetUser and #SetExposedPorts", func() {
+		it("records the user and replaces the exposed ports in the saved image config", func() {
+			img, err := remote.NewImage(repoName, authn.DefaultKeychain)
+			h.AssertNil(t, err)
+			h.AssertNil(t, img.(*remote.Image).SetExposedPorts("80/tcp"))
+			h.AssertNil(t, img.(*remote.Image).SetUser("some-user"))
+			h.AssertNil(t, img.(*remote.Image).SetExposedPorts("8080/tcp", "53/udp"))
+			h.AssertNil(t, img.Save())
+
+			ref, err := name.ParseReference(repoName, name.WeakValidation)
+			h.AssertNil(t, err)
+			saved, err := ggcrremote.Image(ref)
+			h.AssertNil(t, err)
+			cfg, err := saved.ConfigFile()
+			h.AssertNil(t, err)
+			h.AssertEq(t, cfg.Config.User, "some-user")
+			h.AssertEq(t, cfg.Config.ExposedPorts, map[string]struct{}{"8080/tcp": {}, "53/udp": {}})
+		})
+	})
+
+	when("#AddLayerFromOpener", func() {
+		var (
+			layer  []byte
+			diffID string
+			open   func() (io.ReadCloser, error)
+		)
+
+		it.Before(func() {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			h.AssertNil(t, tw.WriteHeader(&tar.Header{Name: "some-file", Mode: 0644, Size: 12}))
+			_, err := tw.Write([]byte("some-content"))
+			h.AssertNil(t, err)
+			h.AssertNil(t, tw.Close())
+			layer = buf.Bytes()
+			diffID = fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+			open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(layer)), nil
+			}
+		})
+
+		it("adds the layer read from the opener to the saved image", func() {
+			img, err := remote.NewImage(repoName, authn.DefaultKeychain)
+			h.AssertNil(t, err)
+			h.AssertNil(t, img.(*remote.Image).AddLayerFromOpener(diffID, int64(len(layer)), open))
+			h.AssertNil(t, img.Save())
+
+			saved, err := remote.NewImage(repoName, authn.DefaultKeychain, remote.FromBaseImage(repoName))
+			h.AssertNil(t, err)
+			topLayer, err := saved.TopLayer()
+			h.AssertNil(t, err)
+			h.AssertEq(t, topLayer, diffID)
+		})
+
+		it("fails when the layer does not have the given diff ID", func() {
+			img, err := remote.NewImage(repoName, authn.DefaultKeychain)
+			h.AssertNil(t, err)
+			h.AssertError(t,
+				img.(*remote.Image).AddLayerFromOpener("sha256:"+strings.Repeat("0", 64), int64(len(layer)), open),
+				"expected 'sha256:"+strings.Repeat("0", 64)+"'",
+			)
+		})
+	})
+
+	when("#Save", func() {
+		it("records the time the image is saved when no creation time is set", func() {
+			img, err := remote.NewImage(repoName, authn.DefaultKeychain)
+			h.AssertNil(t, err)
+			before := time.Now().Add(-time.Second)
+			h.AssertNil(t, img.Save())
+
+			saved, err := remote.NewImage(repoName, authn.DefaultKeychain, remote.FromBaseImage(repoName))
+			h.AssertNil(t, err)
+			actual, err := saved.CreatedAt()
+			h.AssertNil(t, err)
+			if actual.Before(before) {
+				t.Fatalf("expected creation time after %s, got %s", before, actual)
+			}
+		})
+	})
+}
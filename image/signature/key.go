@@ -0,0 +1,107 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Key signs payloads with an ed25519 or ECDSA private key.
+type Key struct {
+	signer crypto.Signer
+}
+
+// PublicKey verifies payloads signed by the matching Key.
+type PublicKey struct {
+	key crypto.PublicKey
+}
+
+// ReadKey reads a PEM encoded PKCS #8 or SEC 1 private key.
+func ReadKey(path string) (*Key, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing private key '%s'", path)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &Key{signer: k}, nil
+	case *ecdsa.PrivateKey:
+		return &Key{signer: k}, nil
+	default:
+		return nil, errors.Errorf("private key '%s' must be an ed25519 or ECDSA key", path)
+	}
+}
+
+// ReadPublicKey reads a PEM encoded PKIX public key.
+func ReadPublicKey(path string) (*PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing public key '%s'", path)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return &PublicKey{key: key}, nil
+	default:
+		return nil, errors.Errorf("public key '%s' must be an ed25519 or ECDSA key", path)
+	}
+}
+
+func (k *Key) Sign(payload []byte) ([]byte, error) {
+	if _, ok := k.signer.(ed25519.PrivateKey); ok {
+		return k.signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return k.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (k *PublicKey) Verify(payload, sig []byte) error {
+	var valid bool
+	switch key := k.key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		valid = ecdsa.VerifyASN1(key, digest[:], sig)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading key '%s'", path)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("key '%s' is not PEM encoded", path)
+	}
+	return block, nil
+}
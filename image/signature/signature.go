@@ -0,0 +1,127 @@
+package signature
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/buildpack/imgutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+const (
+	SignatureLabel = "io.buildpacks.lifecycle.signature"
+	PayloadLabel   = "io.buildpacks.lifecycle.signature.payload"
+)
+
+// Payload is the signed statement that an image digest was produced for a repository.
+type Payload struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+}
+
+// NewImageFunc returns the image stored under ref. Signers are given an empty image to write to,
+// verifiers the existing image.
+type NewImageFunc func(ref string) (imgutil.Image, error)
+
+// Signer stores signatures as images in the repository of the signed image, tagged '<algorithm>-<hex>.sig'.
+type Signer struct {
+	Key      *Key
+	NewImage NewImageFunc
+}
+
+// Verifier checks signatures written by a Signer.
+type Verifier struct {
+	Key      *PublicKey
+	NewImage NewImageFunc
+}
+
+// Tag returns the reference the signature of digest is stored under in the repository of repoName.
+func Tag(repoName, digest string) (string, error) {
+	ref, err := name.ParseReference(repoName, name.WeakValidation)
+	if err != nil {
+		return "", err
+	}
+	return ref.Context().Name() + ":" + strings.Replace(digest, ":", "-", 1) + ".sig", nil
+}
+
+func (s *Signer) Sign(repoName, digest string) error {
+	payload, err := newPayload(repoName, digest)
+	if err != nil {
+		return err
+	}
+	sig, err := s.Key.Sign(payload)
+	if err != nil {
+		return errors.Wrap(err, "signing payload")
+	}
+
+	tag, err := Tag(repoName, digest)
+	if err != nil {
+		return err
+	}
+	image, err := s.NewImage(tag)
+	if err != nil {
+		return errors.Wrapf(err, "create signature image '%s'", tag)
+	}
+	if err := image.SetLabel(PayloadLabel, string(payload)); err != nil {
+		return err
+	}
+	if err := image.SetLabel(SignatureLabel, base64.StdEncoding.EncodeToString(sig)); err != nil {
+		return err
+	}
+	if err := image.Save(); err != nil {
+		return errors.Wrapf(err, "save signature image '%s'", tag)
+	}
+	return nil
+}
+
+func (v *Verifier) Verify(repoName, digest string) error {
+	tag, err := Tag(repoName, digest)
+	if err != nil {
+		return err
+	}
+	image, err := v.NewImage(tag)
+	if err != nil {
+		return errors.Wrapf(err, "access signature image '%s'", tag)
+	}
+	if !image.Found() {
+		return errors.Errorf("no signature found at '%s'", tag)
+	}
+
+	payload, err := image.Label(PayloadLabel)
+	if err != nil {
+		return err
+	}
+	encoded, err := image.Label(SignatureLabel)
+	if err != nil {
+		return err
+	}
+	if encoded == "" {
+		return errors.Errorf("no signature found at '%s'", tag)
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.Wrap(err, "decoding signature")
+	}
+	if err := v.Key.Verify([]byte(payload), sig); err != nil {
+		return err
+	}
+
+	expected, err := newPayload(repoName, digest)
+	if err != nil {
+		return err
+	}
+	if payload != string(expected) {
+		return errors.Errorf("signature at '%s' is not for '%s@%s'", tag, repoName, digest)
+	}
+	return nil
+}
+
+func newPayload(repoName, digest string) ([]byte, error) {
+	ref, err := name.ParseReference(repoName, name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Payload{Repository: ref.Context().Name(), Digest: digest})
+}
@@ -0,0 +1,173 @@
+package signature_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildpack/imgutil"
+	"github.com/buildpack/imgutil/fakes"
+	"github.com/buildpack/imgutil/remote"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+
+	"github.com/buildpack/lifecycle/image/signature"
+	h "github.com/buildpack/lifecycle/testhelpers"
+)
+
+func TestSignature(t *testing.T) {
+	spec.Run(t, "Signature", testSignature, spec.Report(report.Terminal{}))
+}
+
+func testSignature(t *testing.T, when spec.G, it spec.S) {
+	var (
+		tmpDir   string
+		images   map[string]*fakes.Image
+		newImage signature.NewImageFunc
+		digest   = "sha256:c27a27006b74a056bed5d9edcebc394783880abe8691a8c87c78b7cffa6fa5ad"
+	)
+
+	it.Before(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "signature-test")
+		h.AssertNil(t, err)
+
+		images = map[string]*fakes.Image{}
+		newImage = func(ref string) (imgutil.Image, error) {
+			if _, ok := images[ref]; !ok {
+				images[ref] = fakes.NewImage(ref, "", remote.DigestIdentifier{})
+			}
+			return images[ref], nil
+		}
+	})
+
+	it.After(func() {
+		for _, image := range images {
+			image.Cleanup()
+		}
+		h.AssertNil(t, os.RemoveAll(tmpDir))
+	})
+
+	writePEM := func(name, blockType string, der []byte) string {
+		t.Helper()
+		path := filepath.Join(tmpDir, name)
+		h.AssertNil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+
+	writeKeys := func(private, public interface{}) (string, string) {
+		t.Helper()
+		privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+		h.AssertNil(t, err)
+		publicDER, err := x509.MarshalPKIXPublicKey(public)
+		h.AssertNil(t, err)
+		return writePEM("key.pem", "PRIVATE KEY", privateDER), writePEM("key.pub", "PUBLIC KEY", publicDER)
+	}
+
+	ed25519Keys := func() (string, string) {
+		t.Helper()
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		h.AssertNil(t, err)
+		return writeKeys(private, public)
+	}
+
+	ecdsaKeys := func() (string, string) {
+		t.Helper()
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		h.AssertNil(t, err)
+		return writeKeys(private, &private.PublicKey)
+	}
+
+	for _, keys := range []struct {
+		name     string
+		generate func() (string, string)
+	}{{"ed25519", ed25519Keys}, {"ecdsa", ecdsaKeys}} {
+		keys := keys
+		when("using an "+keys.name+" key", func() {
+			var (
+				signer   *signature.Signer
+				verifier *signature.Verifier
+			)
+
+			it.Before(func() {
+				privatePath, publicPath := keys.generate()
+				key, err := signature.ReadKey(privatePath)
+				h.AssertNil(t, err)
+				publicKey, err := signature.ReadPublicKey(publicPath)
+				h.AssertNil(t, err)
+
+				signer = &signature.Signer{Key: key, NewImage: newImage}
+				verifier = &signature.Verifier{Key: publicKey, NewImage: newImage}
+			})
+
+			it("stores the signature in the repository of the image", func() {
+				h.AssertNil(t, signer.Sign("some-registry.io/some-repo:some-tag", digest))
+
+				image, ok := images["some-registry.io/some-repo:sha256-c27a27006b74a056bed5d9edcebc394783880abe8691a8c87c78b7cffa6fa5ad.sig"]
+				if !ok {
+					t.Fatalf("expected signature image to be created, got %v", images)
+				}
+				h.AssertEq(t, image.IsSaved(), true)
+
+				payload, err := image.Label(signature.PayloadLabel)
+				h.AssertNil(t, err)
+				h.AssertJSONEq(t, payload, `{"repository":"some-registry.io/some-repo","digest":"`+digest+`"}`)
+			})
+
+			it("verifies a signature it wrote", func() {
+				h.AssertNil(t, signer.Sign("some-registry.io/some-repo:some-tag", digest))
+				h.AssertNil(t, verifier.Verify("some-registry.io/some-repo:other-tag", digest))
+			})
+
+			it("fails when there is no signature", func() {
+				h.AssertError(t, verifier.Verify("some-registry.io/some-repo", digest), "no signature found at")
+			})
+
+			it("fails when the signature was made with another key", func() {
+				otherPrivate, _ := keys.generate()
+				otherKey, err := signature.ReadKey(otherPrivate)
+				h.AssertNil(t, err)
+				other := &signature.Signer{Key: otherKey, NewImage: newImage}
+				h.AssertNil(t, other.Sign("some-registry.io/some-repo", digest))
+
+				h.AssertError(t, verifier.Verify("some-registry.io/some-repo", digest), "invalid signature")
+			})
+
+			it("fails when the payload was modified", func() {
+				h.AssertNil(t, signer.Sign("some-registry.io/some-repo", digest))
+				tag, err := signature.Tag("some-registry.io/some-repo", digest)
+				h.AssertNil(t, err)
+				h.AssertNil(t, images[tag].SetLabel(signature.PayloadLabel, `{"repository":"some-registry.io/other-repo","digest":"`+digest+`"}`))
+
+				h.AssertError(t, verifier.Verify("some-registry.io/some-repo", digest), "invalid signature")
+			})
+		})
+	}
+
+	when("#ReadKey", func() {
+		it("reads SEC 1 ECDSA keys", func() {
+			private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			h.AssertNil(t, err)
+			der, err := x509.MarshalECPrivateKey(private)
+			h.AssertNil(t, err)
+
+			_, err = signature.ReadKey(writePEM("ec.pem", "EC PRIVATE KEY", der))
+			h.AssertNil(t, err)
+		})
+
+		it("fails for a file that is not PEM encoded", func() {
+			path := filepath.Join(tmpDir, "not-a-key")
+			h.AssertNil(t, ioutil.WriteFile(path, []byte("some-data"), 0600))
+
+			_, err := signature.ReadKey(path)
+			h.AssertError(t, err, "is not PEM encoded")
+		})
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -62,9 +63,15 @@ func cached(l bpLayer) bool {
 }
 
 func (bd *bpLayersDir) findLayers(f func(layer bpLayer) bool) []bpLayer {
+	var names []string
+	for name := range bd.layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	var selectedLayers []bpLayer
-	for _, l := range bd.layers {
-		if f(l) {
+	for _, name := range names {
+		if l := bd.layers[name]; f(l) {
 			selectedLayers = append(selectedLayers, l)
 		}
 	}
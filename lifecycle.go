@@ -32,6 +32,9 @@ type buildpackInfo struct {
 	Version  string `toml:"version"`
 	Name     string `toml:"name"`
 	ClearEnv bool   `toml:"clear-env,omitempty"`
+
+	// CacheAcrossVersions lets the buildpack receive layers cached by other versions of itself.
+	CacheAcrossVersions bool `toml:"cache-across-versions,omitempty"`
 }
 
 func (bp buildpackTOML) String() string {
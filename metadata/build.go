@@ -6,6 +6,14 @@ type BuildMetadata struct {
 	BOM        interface{}         `json:"bom"`
 	Buildpacks []BuildpackMetadata `json:"buildpacks"`
 	Launcher   LauncherMetadata    `json:"launcher"`
+	Processes  []ProcessMetadata   `json:"processes,omitempty"`
+}
+
+type ProcessMetadata struct {
+	Type    string   `json:"type"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Direct  bool     `json:"direct"`
 }
 
 type BuildpackMetadata struct {
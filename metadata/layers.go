@@ -3,6 +3,7 @@ package metadata
 import (
 	"encoding/json"
 	"path"
+	"time"
 
 	"github.com/buildpack/imgutil"
 	"github.com/pkg/errors"
@@ -10,13 +11,18 @@ import (
 
 const LayerMetadataLabel = "io.buildpacks.lifecycle.metadata"
 
+// StackIDLabel is the label of run images, and of the app images built on them, naming their stack.
+const StackIDLabel = "io.buildpacks.stack.id"
+
 type LayersMetadata struct {
-	App        LayerMetadata             `json:"app" toml:"app"`
-	Config     LayerMetadata             `json:"config" toml:"config"`
-	Launcher   LayerMetadata             `json:"launcher" toml:"launcher"`
-	Buildpacks []BuildpackLayersMetadata `json:"buildpacks" toml:"buildpacks"`
-	RunImage   RunImageMetadata          `json:"runImage" toml:"run-image"`
-	Stack      StackMetadata             `json:"stack" toml:"stack"`
+	App         LayerMetadata             `json:"app" toml:"app"`
+	Slices      []SliceLayerMetadata      `json:"slices,omitempty" toml:"slices,omitempty"`
+	Config      LayerMetadata             `json:"config" toml:"config"`
+	Launcher    LayerMetadata             `json:"launcher" toml:"launcher"`
+	Buildpacks  []BuildpackLayersMetadata `json:"buildpacks" toml:"buildpacks"`
+	RunImage    RunImageMetadata          `json:"runImage" toml:"run-image"`
+	Stack       StackMetadata             `json:"stack" toml:"stack"`
+	ImageConfig *ImageConfigMetadata      `json:"imageConfig,omitempty" toml:"image-config,omitempty"`
 }
 
 type AnalyzedMetadata struct {
@@ -30,7 +36,15 @@ type ImageIdentifier struct {
 }
 
 type LayerMetadata struct {
-	SHA string `json:"sha" toml:"sha"`
+	SHA         string `json:"sha" toml:"sha"`
+	Fingerprint string `json:"fingerprint,omitempty" toml:"fingerprint,omitempty"`
+	Size        int64  `json:"size,omitempty" toml:"size,omitempty"`
+}
+
+// SliceLayerMetadata describes a layer exported from the files of the app directory matching Paths.
+type SliceLayerMetadata struct {
+	LayerMetadata
+	Paths []string `json:"paths" toml:"paths"`
 }
 
 type BuildpackLayersMetadata struct {
@@ -42,6 +56,7 @@ type BuildpackLayersMetadata struct {
 type BuildpackLayerMetadata struct {
 	LayerMetadata
 	BuildpackLayerMetadataFile
+	CacheLayerMetadata
 }
 
 type BuildpackLayerMetadataFile struct {
@@ -51,6 +66,18 @@ type BuildpackLayerMetadataFile struct {
 	Cache  bool        `json:"cache" toml:"cache"`
 }
 
+// CacheLayerMetadata describes how a layer is stored in a cache. It is never written to layer TOML files.
+type CacheLayerMetadata struct {
+	// Relative is set when the layer is archived relative to its layer directory. Layers cached without it
+	// are archived by absolute path.
+	Relative bool `json:"relative,omitempty" toml:"-"`
+	// LaunchSHA is the SHA the layer would have in the app image, so that a restored launch layer can be matched
+	// to the app image metadata.
+	LaunchSHA string `json:"launchSHA,omitempty" toml:"-"`
+	// CachedAt is when the contents of the layer were first cached.
+	CachedAt *time.Time `json:"cachedAt,omitempty" toml:"-"`
+}
+
 type RunImageMetadata struct {
 	TopLayer  string `json:"topLayer" toml:"top-layer"`
 	Reference string `json:"reference" toml:"reference"`
@@ -65,6 +92,21 @@ type StackRunImageMetadata struct {
 	Mirrors []string `toml:"mirrors" json:"mirrors,omitempty"`
 }
 
+// ImageConfigMetadata holds image config supplied by the platform. It is recorded alongside the layer metadata
+// so that it can be reapplied when the image is rebased.
+type ImageConfigMetadata struct {
+	Labels       map[string]string `json:"labels,omitempty" toml:"labels"`
+	Env          map[string]string `json:"env,omitempty" toml:"env"`
+	WorkingDir   string            `json:"workingDir,omitempty" toml:"working-dir"`
+	User         string            `json:"user,omitempty" toml:"user"`
+	ExposedPorts []string          `json:"exposedPorts,omitempty" toml:"exposed-ports"`
+}
+
+// IsZero reports whether the platform supplied no image config.
+func (c ImageConfigMetadata) IsZero() bool {
+	return len(c.Labels) == 0 && len(c.Env) == 0 && c.WorkingDir == "" && c.User == "" && len(c.ExposedPorts) == 0
+}
+
 func (m *LayersMetadata) MetadataForBuildpack(id string) BuildpackLayersMetadata {
 	for _, bpMd := range m.Buildpacks {
 		if bpMd.ID == id {
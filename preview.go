@@ -0,0 +1,261 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildpack/imgutil"
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/metadata"
+)
+
+const (
+	ChangeAdded   = "added"
+	ChangeChanged = "changed"
+	ChangeRemoved = "removed"
+)
+
+// ExportDiff describes how an export would change the previous image.
+type ExportDiff struct {
+	Name        string        `toml:"name"`
+	Layers      []LayerReport `toml:"layers"`
+	Labels      []ChangeDiff  `toml:"labels"`
+	Processes   []ChangeDiff  `toml:"processes"`
+	UploadBytes int64         `toml:"upload-bytes"`
+}
+
+// ChangeDiff describes a label or process, identified by key, that was added, changed or removed.
+type ChangeDiff struct {
+	Key      string `toml:"key"`
+	Status   string `toml:"status"`
+	Previous string `toml:"previous,omitempty"`
+	Current  string `toml:"current,omitempty"`
+}
+
+// Preview runs the same steps as Export against workingImage, including writing and hashing layers, but
+// never adds layers to the image or saves it. It returns how the result differs from previousImage, which
+// may be nil when there is no previous image.
+func (e *Exporter) Preview(
+	layersDir,
+	appDir string,
+	workingImage,
+	previousImage imgutil.Image,
+	origMetadata metadata.LayersMetadata,
+	launcherConfig LauncherConfig,
+	stack metadata.StackMetadata,
+) (ExportDiff, error) {
+	image := &dryRunImage{Image: workingImage, labels: map[string]string{}}
+	report, err := e.build(layersDir, appDir, image, origMetadata, launcherConfig, stack)
+	if err != nil {
+		return ExportDiff{}, err
+	}
+
+	diff := ExportDiff{Name: workingImage.Name(), Layers: report.Layers}
+	for _, l := range report.Layers {
+		if l.Status == LayerStatusAdded {
+			diff.UploadBytes += l.Size
+		}
+	}
+	diff.Layers = append(diff.Layers, removedLayers(origMetadata, report.Layers)...)
+
+	previousLabel := func(key string) (string, error) {
+		if previousImage == nil || !previousImage.Found() {
+			return "", nil
+		}
+		return previousImage.Label(key)
+	}
+
+	previous := map[string]string{}
+	if origMetadata.ImageConfig != nil {
+		for key := range origMetadata.ImageConfig.Labels {
+			previous[key] = ""
+		}
+	}
+	for key := range image.labels {
+		previous[key] = ""
+	}
+	for key := range previous {
+		if previous[key], err = previousLabel(key); err != nil {
+			return ExportDiff{}, errors.Wrapf(err, "read previous image label '%s'", key)
+		}
+	}
+	diff.Labels = changes(previous, image.labels)
+
+	previousBuildMD, err := previousLabel(metadata.BuildMetadataLabel)
+	if err != nil {
+		return ExportDiff{}, errors.Wrap(err, "read previous build metadata")
+	}
+	previousProcesses, err := processCommands(previousBuildMD)
+	if err != nil {
+		return ExportDiff{}, errors.Wrap(err, "parse previous build metadata")
+	}
+	processes, err := processCommands(image.labels[metadata.BuildMetadataLabel])
+	if err != nil {
+		return ExportDiff{}, errors.Wrap(err, "parse build metadata")
+	}
+	diff.Processes = changes(previousProcesses, processes)
+
+	e.printDiff(diff)
+	return diff, nil
+}
+
+func (e *Exporter) printDiff(diff ExportDiff) {
+	e.Out.Println("*** Layers:")
+	for _, l := range diff.Layers {
+		e.Out.Printf("      %s - %s\n", l.ID, l.Status)
+	}
+	e.Out.Println("*** Labels:")
+	for _, l := range diff.Labels {
+		e.Out.Printf("      %s - %s\n", l.Key, l.Status)
+	}
+	e.Out.Println("*** Processes:")
+	for _, p := range diff.Processes {
+		e.Out.Printf("      %s - %s\n", p.Key, p.Status)
+	}
+	e.Out.Printf("*** Upload size: %d bytes\n", diff.UploadBytes)
+}
+
+// removedLayers returns the layers of the previous image that are not part of the new image.
+func removedLayers(origMetadata metadata.LayersMetadata, layers []LayerReport) []LayerReport {
+	exported := map[string]bool{}
+	for _, l := range layers {
+		exported[l.ID] = true
+	}
+
+	previous := map[string]metadata.LayerMetadata{
+		"app":      origMetadata.App,
+		"config":   origMetadata.Config,
+		"launcher": origMetadata.Launcher,
+	}
+	for _, slice := range origMetadata.Slices {
+		previous[Slice{Paths: slice.Paths}.ID()] = slice.LayerMetadata
+	}
+	for _, bp := range origMetadata.Buildpacks {
+		for name, l := range bp.Layers {
+			if l.Launch {
+				previous[fmt.Sprintf("%s:%s", bp.ID, name)] = l.LayerMetadata
+			}
+		}
+	}
+
+	var removed []LayerReport
+	for _, id := range sortedLayerIDs(previous) {
+		if l := previous[id]; l.SHA != "" && !exported[id] {
+			removed = append(removed, LayerReport{ID: id, SHA: l.SHA, Size: l.Size, Status: LayerStatusRemoved})
+		}
+	}
+	return removed
+}
+
+func sortedLayerIDs(m map[string]metadata.LayerMetadata) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// changes compares two sets of values by key, ignoring empty values.
+func changes(previous, current map[string]string) []ChangeDiff {
+	keys := map[string]string{}
+	for k := range previous {
+		keys[k] = ""
+	}
+	for k := range current {
+		keys[k] = ""
+	}
+
+	var diffs []ChangeDiff
+	for _, key := range sortedKeys(keys) {
+		prev, cur := previous[key], current[key]
+		switch {
+		case prev == cur:
+			continue
+		case prev == "":
+			diffs = append(diffs, ChangeDiff{Key: key, Status: ChangeAdded, Current: cur})
+		case cur == "":
+			diffs = append(diffs, ChangeDiff{Key: key, Status: ChangeRemoved, Previous: prev})
+		default:
+			diffs = append(diffs, ChangeDiff{Key: key, Status: ChangeChanged, Previous: prev, Current: cur})
+		}
+	}
+	return diffs
+}
+
+func processCommands(buildMDLabel string) (map[string]string, error) {
+	commands := map[string]string{}
+	if buildMDLabel == "" {
+		return commands, nil
+	}
+	var buildMD metadata.BuildMetadata
+	if err := json.Unmarshal([]byte(buildMDLabel), &buildMD); err != nil {
+		return nil, err
+	}
+	for _, p := range buildMD.Processes {
+		commands[p.Type] = strings.Join(append([]string{p.Command}, p.Args...), " ")
+	}
+	return commands, nil
+}
+
+// dryRunImage records the labels set on an image without changing the image, adding layers to it or saving it.
+type dryRunImage struct {
+	imgutil.Image
+	labels map[string]string
+}
+
+func (i *dryRunImage) Label(key string) (string, error) {
+	if val, ok := i.labels[key]; ok {
+		return val, nil
+	}
+	return i.Image.Label(key)
+}
+
+func (i *dryRunImage) SetLabel(key, val string) error {
+	i.labels[key] = val
+	return nil
+}
+
+func (i *dryRunImage) SetEnv(string, string) error {
+	return nil
+}
+
+func (i *dryRunImage) SetEntrypoint(...string) error {
+	return nil
+}
+
+func (i *dryRunImage) SetWorkingDir(string) error {
+	return nil
+}
+
+func (i *dryRunImage) SetCmd(...string) error {
+	return nil
+}
+
+func (i *dryRunImage) SetUser(string) error {
+	return nil
+}
+
+func (i *dryRunImage) SetExposedPorts(...string) error {
+	return nil
+}
+
+func (i *dryRunImage) SetCreatedAt(time.Time) error {
+	return nil
+}
+
+func (i *dryRunImage) AddLayer(string) error {
+	return nil
+}
+
+func (i *dryRunImage) ReuseLayer(string) error {
+	return nil
+}
+
+func (i *dryRunImage) Save(...string) error {
+	return nil
+}
@@ -1,50 +1,112 @@
 package lifecycle
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"sync"
 
+	"github.com/buildpack/imgutil"
 	"github.com/pkg/errors"
 
 	"github.com/buildpack/lifecycle/archive"
+	"github.com/buildpack/lifecycle/cache"
 	"github.com/buildpack/lifecycle/metadata"
 )
 
+// Restorer restores the cached layers of the buildpacks in the group. Layers cached on another stack are not
+// restored, nor are layers cached by another version of a buildpack, unless the buildpack.toml of the buildpack
+// in BuildpacksDir opts in to them. Caches that do not record a stack or version are always restored.
+//
+// When PreviousImage is set, launch layers that are also cached but missing from the cache are restored from the
+// previous app image, so that losing the cache does not force them to be rebuilt. The previous image is only
+// used if it was built on the same stack and, when Verifier is set, has a valid signature.
 type Restorer struct {
-	LayersDir  string
-	Buildpacks []Buildpack
-	Out, Err   *log.Logger
-	UID        int
-	GID        int
+	LayersDir     string
+	BuildpacksDir string
+	Buildpacks    []Buildpack
+	StackID       string
+	Out, Err      *log.Logger
+	UID           int
+	GID           int
+	// Workers is the number of layers retrieved and extracted concurrently. It defaults to DefaultRestoreWorkers.
+	Workers int
+	// PreviousImage is the app image exported by the previous build, if any.
+	PreviousImage imgutil.Image
+	// Verifier, if set, verifies the signature of PreviousImage.
+	Verifier ImageVerifier
 }
 
-func (r *Restorer) Restore(cache Cache) error {
-	meta, err := cache.RetrieveMetadata()
+const DefaultRestoreWorkers = 4
+
+// restoreJob is a cached layer to restore, and the result of extracting its contents.
+type restoreJob struct {
+	bpLayer *bpLayer
+	bpMD    metadata.BuildpackLayersMetadata
+	layer   metadata.BuildpackLayerMetadata
+	// fromImage is set when the layer is restored from the previous image rather than the cache.
+	fromImage bool
+	err       error
+}
+
+func (r *Restorer) Restore(cacheStore Cache) error {
+	meta, err := cacheStore.RetrieveMetadata()
 	if err != nil {
 		return err
 	}
 
 	if len(meta.Buildpacks) == 0 {
-		r.Out.Printf("Cache '%s': metadata not found, nothing to restore", cache.Name())
-		return nil
+		r.Out.Printf("Cache '%s': metadata not found, nothing to restore", cacheStore.Name())
+	} else if meta.StackID != "" && r.StackID != "" && meta.StackID != r.StackID {
+		r.Out.Printf("Cache '%s': layers were cached on stack '%s', not restoring them on stack '%s'", cacheStore.Name(), meta.StackID, r.StackID)
+		meta = cache.Metadata{}
+	}
+
+	imageMD, err := r.previousImageMetadata()
+	if err != nil {
+		return err
 	}
 
+	var jobs []*restoreJob
 	for _, bp := range r.Buildpacks {
 		layersDir, err := readBuildpackLayersDir(r.LayersDir, bp)
 		if err != nil {
 			return err
 		}
-		bpMD := meta.MetadataForBuildpack(bp.ID)
-		for name, layer := range bpMD.Layers {
-			if !layer.Cache {
-				continue
-			}
 
-			if err := r.restoreLayer(name, bpMD, layer, layersDir, cache); err != nil {
-				return err
+		cacheJobs, err := r.layerJobs(bp, layersDir, meta.MetadataForBuildpack(bp.ID), false)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, cacheJobs...)
+
+		imageJobs, err := r.layerJobs(bp, layersDir, imageMD.MetadataForBuildpack(bp.ID), true)
+		if err != nil {
+			return err
+		}
+		restored := map[string]bool{}
+		for _, job := range cacheJobs {
+			restored[job.bpLayer.name()] = true
+		}
+		for _, job := range imageJobs {
+			if !restored[job.bpLayer.name()] {
+				jobs = append(jobs, job)
 			}
 		}
 	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	r.restoreAllContents(jobs, cacheStore)
+	for _, job := range jobs {
+		if err := r.finishLayer(job); err != nil {
+			return errors.Wrapf(err, "restoring layer '%s'", job.bpLayer.Identifier())
+		}
+	}
 
 	// if restorer is running as root it needs to fix the ownership of the layers dir
 	if current := os.Getuid(); current == -1 {
@@ -57,25 +119,197 @@ func (r *Restorer) Restore(cache Cache) error {
 	return nil
 }
 
-func (r *Restorer) restoreLayer(name string, bpMD metadata.BuildpackLayersMetadata, layer metadata.BuildpackLayerMetadata, layersDir bpLayersDir, cache Cache) error {
-	bpLayer := layersDir.newBPLayer(name)
+// layerJobs returns the layers of bpMD to restore into layersDir: the cached layers when restoring from the cache,
+// or the cached launch layers when restoring from the previous image.
+func (r *Restorer) layerJobs(bp Buildpack, layersDir bpLayersDir, bpMD metadata.BuildpackLayersMetadata, fromImage bool) ([]*restoreJob, error) {
+	if restore, err := r.restoresVersion(bp, bpMD.Version); err != nil {
+		return nil, err
+	} else if !restore {
+		if !fromImage {
+			r.Out.Printf("Not restoring cached layers of buildpack '%s': they were cached by version '%s'", bp, bpMD.Version)
+		}
+		return nil, nil
+	}
+
+	var jobs []*restoreJob
+	for _, name := range sortedLayerNames(bpMD.Layers) {
+		layer := bpMD.Layers[name]
+		if !layer.Cache || (fromImage && !layer.Launch) {
+			continue
+		}
+		jobs = append(jobs, &restoreJob{bpLayer: layersDir.newBPLayer(name), bpMD: bpMD, layer: layer, fromImage: fromImage})
+	}
+	return jobs, nil
+}
 
-	r.Out.Printf("Restoring cached layer '%s'", bpLayer.Identifier())
-	if err := bpLayer.writeMetadata(bpMD.Layers); err != nil {
+// previousImageMetadata returns the layer metadata of the previous image, or no metadata if there is none.
+func (r *Restorer) previousImageMetadata() (metadata.LayersMetadata, error) {
+	if r.PreviousImage == nil || !r.PreviousImage.Found() {
+		return metadata.LayersMetadata{}, nil
+	}
+	if !verifyImage(r.Verifier, r.PreviousImage, r.Out) {
+		return metadata.LayersMetadata{}, nil
+	}
+	stackID, err := r.PreviousImage.Label(metadata.StackIDLabel)
+	if err != nil {
+		return metadata.LayersMetadata{}, errors.Wrapf(err, "reading stack of previous image '%s'", r.PreviousImage.Name())
+	}
+	if stackID != "" && r.StackID != "" && stackID != r.StackID {
+		r.Out.Printf("Previous image '%s': built on stack '%s', not restoring its layers on stack '%s'", r.PreviousImage.Name(), stackID, r.StackID)
+		return metadata.LayersMetadata{}, nil
+	}
+	meta, err := metadata.GetLayersMetdata(r.PreviousImage)
+	if err != nil {
+		return metadata.LayersMetadata{}, errors.Wrapf(err, "reading metadata of previous image '%s'", r.PreviousImage.Name())
+	}
+	return meta, nil
+}
+
+// restoresVersion reports whether bp receives layers cached by version cachedVersion of the buildpack.
+func (r *Restorer) restoresVersion(bp Buildpack, cachedVersion string) (bool, error) {
+	if cachedVersion == "" || bp.Version == "" || cachedVersion == bp.Version {
+		return true, nil
+	}
+	if r.BuildpacksDir == "" {
+		return false, nil
+	}
+	bpTOML, err := bp.lookup(r.BuildpacksDir)
+	if err != nil {
+		return false, errors.Wrapf(err, "reading buildpack.toml of buildpack '%s'", bp)
+	}
+	return bpTOML.Buildpack.CacheAcrossVersions, nil
+}
+
+// restoreAllContents extracts the contents of the layers with a pool of workers. Layers are handed out in order,
+// and none are handed out once a layer fails, so the layers that were not extracted follow any that failed.
+func (r *Restorer) restoreAllContents(jobs []*restoreJob, cacheStore Cache) {
+	workers := r.Workers
+	if workers <= 0 {
+		workers = DefaultRestoreWorkers
+	}
+
+	queue := make(chan *restoreJob)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job.err = r.restoreContents(job, cacheStore)
+				if job.err != nil && !skipsLayer(job.err) {
+					failOnce.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, job := range jobs {
+		select {
+		case <-failed:
+			break dispatch
+		case queue <- job:
+			if job.fromImage {
+				r.Out.Printf("Restoring layer '%s' from previous image '%s'", job.bpLayer.Identifier(), r.PreviousImage.Name())
+			} else {
+				r.Out.Printf("Restoring cached layer '%s'", job.bpLayer.Identifier())
+			}
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// finishLayer writes the metadata of a layer once its contents are extracted, so that a layer found to be corrupt
+// while it is extracted can be removed and left for its buildpack to rebuild.
+func (r *Restorer) finishLayer(job *restoreJob) error {
+	if job.err != nil {
+		if !skipsLayer(job.err) {
+			return job.err
+		}
+		r.Out.Printf("Warning: not restoring layer '%s': %s", job.bpLayer.Identifier(), errors.Cause(job.err))
+		return job.bpLayer.remove()
+	}
+
+	if err := job.bpLayer.writeMetadata(job.bpMD.Layers); err != nil {
 		return err
 	}
 
-	if layer.Launch {
-		if err := bpLayer.writeSha(layer.SHA); err != nil {
+	if job.layer.Launch {
+		sha := job.layer.SHA
+		if job.layer.Relative {
+			sha = job.layer.LaunchSHA
+		}
+		if err := job.bpLayer.writeSha(sha); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	rc, err := cache.RetrieveLayer(layer.SHA)
-	if err != nil {
+// restoreContents extracts the contents of a layer. Layers of the previous image are verified against their
+// SHA, and a layer that cannot be read from the previous image is skipped.
+func (r *Restorer) restoreContents(job *restoreJob, cacheStore Cache) error {
+	bpLayer, layer := job.bpLayer, job.layer
+	var rc io.ReadCloser
+	var err error
+	if job.fromImage {
+		if rc, err = r.PreviousImage.GetLayer(layer.SHA); err != nil {
+			return &unavailableLayerError{sha: layer.SHA, err: err}
+		}
+		rc = cache.NewVerifyingReader(rc, layer.SHA)
+	} else if rc, err = cacheStore.RetrieveLayer(layer.SHA); err != nil {
 		return err
 	}
 	defer rc.Close()
 
-	return archive.Untar(rc, "/")
+	// layers of app images and layers cached by older lifecycles are archived by absolute path
+	dest := "/"
+	if layer.Relative {
+		dest = bpLayer.Path()
+		if err := os.MkdirAll(dest, 0777); err != nil {
+			return err
+		}
+	}
+	if err := archive.Untar(rc, dest); err != nil {
+		// a layer whose tar cannot be read is corrupt if the rest of it does not match its SHA either
+		if _, verifyErr := io.Copy(ioutil.Discard, rc); cache.IsCorruptLayer(verifyErr) {
+			return verifyErr
+		}
+		return err
+	}
+	// the end of a tar is reached before the end of the layer, which must be read for the layer to be verified
+	_, err = io.Copy(ioutil.Discard, rc)
+	return err
+}
+
+// unavailableLayerError is returned for a layer that cannot be read from the previous image.
+type unavailableLayerError struct {
+	sha string
+	err error
+}
+
+func (e *unavailableLayerError) Error() string {
+	return fmt.Sprintf("reading layer with SHA '%s' from the previous image: %s", e.sha, e.err)
+}
+
+// skipsLayer reports whether a layer that failed with err is left for its buildpack to rebuild, rather than
+// failing the restore.
+func skipsLayer(err error) bool {
+	if cache.IsCorruptLayer(err) {
+		return true
+	}
+	_, ok := errors.Cause(err).(*unavailableLayerError)
+	return ok
+}
+
+func sortedLayerNames(layers map[string]metadata.BuildpackLayerMetadata) []string {
+	var names []string
+	for name := range layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -1,20 +1,31 @@
 package lifecycle_test
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
-
+	"time"
+
+	"github.com/buildpack/imgutil"
+	"github.com/buildpack/imgutil/fakes"
+	"github.com/buildpack/imgutil/local"
+	"github.com/buildpack/imgutil/remote"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 
 	"github.com/buildpack/lifecycle"
 	"github.com/buildpack/lifecycle/archive"
 	"github.com/buildpack/lifecycle/cache"
+	"github.com/buildpack/lifecycle/metadata"
 	h "github.com/buildpack/lifecycle/testhelpers"
 )
 
@@ -68,9 +79,341 @@ func testRestorer(t *testing.T, when spec.G, it spec.S) {
 			})
 		})
 
+		when("the cache was written to from another layers directory", func() {
+			var (
+				buildLayersDir string
+				launchSHA      string
+			)
+
+			it.Before(func() {
+				var err error
+				buildLayersDir, err = ioutil.TempDir("", "lifecycle-build-layer-dir")
+				h.AssertNil(t, err)
+
+				h.RecursiveCopy(t, filepath.Join("testdata", "restorer"), buildLayersDir)
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(buildLayersDir, "buildpack.id", "cache-only.toml"), []byte("cache = true"), 0666))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(buildLayersDir, "buildpack.id", "cache-launch.toml"), []byte("cache = true\nlaunch = true"), 0666))
+				launchSHA = "sha256:" + h.ComputeSHA256ForPath(t, filepath.Join(buildLayersDir, "buildpack.id", "cache-launch"), 1234, 4321)
+
+				cacher := &lifecycle.Cacher{
+					Buildpacks: []lifecycle.Buildpack{{ID: "buildpack.id"}},
+					Out:        log.New(ioutil.Discard, "", 0),
+					UID:        1234,
+					GID:        4321,
+				}
+				h.AssertNil(t, cacher.Cache(buildLayersDir, testCache))
+
+				testCache, err = cache.NewVolumeCache(cacheDir)
+				h.AssertNil(t, err)
+			})
+
+			it.After(func() {
+				h.AssertNil(t, os.RemoveAll(buildLayersDir))
+			})
+
+			it("restores cached layers into the current layers directory", func() {
+				h.AssertNil(t, os.RemoveAll(filepath.Join(buildLayersDir, "buildpack.id")))
+
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				txt, err := ioutil.ReadFile(filepath.Join(layersDir, "buildpack.id", "cache-only", "file-from-cache-only-layer"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, strings.TrimSpace(string(txt)), "echo text from cache-only layer")
+
+				if _, err := os.Stat(filepath.Join(buildLayersDir, "buildpack.id")); !os.IsNotExist(err) {
+					t.Fatal("expected layers not to be restored to the directory they were cached from")
+				}
+			})
+
+			it("writes the app image SHA of launch layers", func() {
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				sha, err := ioutil.ReadFile(filepath.Join(layersDir, "buildpack.id", "cache-launch.sha"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, string(sha), launchSHA)
+			})
+		})
+
+		when("the cache records the stack and buildpack versions", func() {
+			var (
+				buildLayersDir string
+				buildpacksDir  string
+				restoredFile   string
+			)
+
+			var writeBuildpackTOML = func(version, extra string) {
+				t.Helper()
+				dir := filepath.Join(buildpacksDir, "buildpack.id", version)
+				h.AssertNil(t, os.MkdirAll(dir, 0777))
+				h.AssertNil(t, ioutil.WriteFile(
+					filepath.Join(dir, "buildpack.toml"),
+					[]byte(fmt.Sprintf("[buildpack]\nid = \"buildpack.id\"\nversion = \"%s\"\n%s", version, extra)),
+					0666,
+				))
+			}
+
+			var assertRestored = func(restored bool) {
+				t.Helper()
+				_, err := os.Stat(restoredFile)
+				if restored && err != nil {
+					t.Fatalf("expected cached layer to be restored: %s", err)
+				} else if !restored && !os.IsNotExist(err) {
+					t.Fatal("expected cached layer not to be restored")
+				}
+			}
+
+			it.Before(func() {
+				var err error
+				buildLayersDir, err = ioutil.TempDir("", "lifecycle-build-layer-dir")
+				h.AssertNil(t, err)
+				buildpacksDir, err = ioutil.TempDir("", "lifecycle-buildpacks-dir")
+				h.AssertNil(t, err)
+
+				h.RecursiveCopy(t, filepath.Join("testdata", "restorer"), buildLayersDir)
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(buildLayersDir, "buildpack.id", "cache-only.toml"), []byte("cache = true"), 0666))
+
+				cacher := &lifecycle.Cacher{
+					Buildpacks: []lifecycle.Buildpack{{ID: "buildpack.id", Version: "1.0.0"}},
+					StackID:    "some.stack.id",
+					Out:        log.New(ioutil.Discard, "", 0),
+					UID:        1234,
+					GID:        4321,
+				}
+				h.AssertNil(t, cacher.Cache(buildLayersDir, testCache))
+
+				testCache, err = cache.NewVolumeCache(cacheDir)
+				h.AssertNil(t, err)
+
+				restorer.Buildpacks = []lifecycle.Buildpack{{ID: "buildpack.id", Version: "1.0.0"}}
+				restorer.BuildpacksDir = buildpacksDir
+				restorer.StackID = "some.stack.id"
+				restoredFile = filepath.Join(layersDir, "buildpack.id", "cache-only", "file-from-cache-only-layer")
+			})
+
+			it.After(func() {
+				h.AssertNil(t, os.RemoveAll(buildLayersDir))
+				h.AssertNil(t, os.RemoveAll(buildpacksDir))
+			})
+
+			it("restores layers cached by the same buildpack version on the same stack", func() {
+				h.AssertNil(t, restorer.Restore(testCache))
+				assertRestored(true)
+			})
+
+			it("does not restore layers cached on another stack", func() {
+				restorer.StackID = "other.stack.id"
+
+				h.AssertNil(t, restorer.Restore(testCache))
+				assertRestored(false)
+			})
+
+			it("does not restore layers cached by another buildpack version", func() {
+				restorer.Buildpacks = []lifecycle.Buildpack{{ID: "buildpack.id", Version: "2.0.0"}}
+				writeBuildpackTOML("2.0.0", "")
+
+				h.AssertNil(t, restorer.Restore(testCache))
+				assertRestored(false)
+			})
+
+			it("restores layers cached by another version when the buildpack opts in", func() {
+				restorer.Buildpacks = []lifecycle.Buildpack{{ID: "buildpack.id", Version: "2.0.0"}}
+				writeBuildpackTOML("2.0.0", "cache-across-versions = true")
+
+				h.AssertNil(t, restorer.Restore(testCache))
+				assertRestored(true)
+			})
+		})
+
+		when("there is a previous image", func() {
+			var (
+				tarDir         string
+				previousImage  *fakes.Image
+				launchLayerSHA string
+			)
+
+			var addImageLayer = func(name string) string {
+				t.Helper()
+				sha, err := archive.WriteTarFile(
+					filepath.Join(layersDir, "buildpack.id", name),
+					filepath.Join(tarDir, name+".tar"),
+					1234, 4321, archive.NormalizedDateTime,
+				)
+				h.AssertNil(t, err)
+				h.AssertNil(t, previousImage.AddLayer(filepath.Join(tarDir, name+".tar")))
+				return sha
+			}
+
+			it.Before(func() {
+				var err error
+				tarDir, err = ioutil.TempDir("", "lifecycle-image-layers")
+				h.AssertNil(t, err)
+
+				h.RecursiveCopy(t, filepath.Join("testdata", "restorer"), layersDir)
+				previousImage = fakes.NewImage("previous-image", "", nil)
+				launchLayerSHA = addImageLayer("cache-launch")
+				launchOnlyLayerSHA := addImageLayer("cache-false")
+				h.AssertNil(t, os.RemoveAll(layersDir))
+				h.AssertNil(t, os.Mkdir(layersDir, 0777))
+
+				h.AssertNil(t, previousImage.SetLabel("io.buildpacks.lifecycle.metadata", fmt.Sprintf(`{
+				  "buildpacks": [{
+				    "key": "buildpack.id",
+				    "layers": {
+				      "cache-launch": {"sha": "%s", "launch": true, "cache": true, "data": {"cache-launch-key": "cache-launch-val"}},
+				      "cache-false": {"sha": "%s", "launch": true, "cache": false}
+				    }
+				  }]
+				}`, launchLayerSHA, launchOnlyLayerSHA)))
+				restorer.PreviousImage = previousImage
+			})
+
+			it.After(func() {
+				h.AssertNil(t, os.RemoveAll(tarDir))
+			})
+
+			it("restores cached launch layers missing from the cache", func() {
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				txt, err := ioutil.ReadFile(filepath.Join(layersDir, "buildpack.id", "cache-launch", "file-from-cache-launch-layer"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, strings.TrimSpace(string(txt)), "echo text from cache launch layer")
+				toml, err := ioutil.ReadFile(filepath.Join(layersDir, "buildpack.id", "cache-launch.toml"))
+				h.AssertNil(t, err)
+				if !strings.Contains(string(toml), `cache-launch-key = "cache-launch-val"`) {
+					t.Fatalf("expected '%s' to contain the layer metadata", toml)
+				}
+				sha, err := ioutil.ReadFile(filepath.Join(layersDir, "buildpack.id", "cache-launch.sha"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, string(sha), launchLayerSHA)
+			})
+
+			it("doesn't restore launch layers that are not cached", func() {
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", "cache-false")); !os.IsNotExist(err) {
+					t.Fatal("expected cache-false layer not to be restored")
+				}
+			})
+
+			assertLaunchLayerNotRestored := func() {
+				t.Helper()
+				for _, path := range []string{"cache-launch", "cache-launch.toml", "cache-launch.sha"} {
+					if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", path)); !os.IsNotExist(err) {
+						t.Fatalf("expected '%s' not to be restored", path)
+					}
+				}
+			}
+
+			it("doesn't restore layers from a previous image built on another stack", func() {
+				stdout := &bytes.Buffer{}
+				restorer.Out = log.New(stdout, "", 0)
+				restorer.StackID = "some.stack.id"
+				h.AssertNil(t, previousImage.SetLabel("io.buildpacks.stack.id", "other.stack.id"))
+
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				assertLaunchLayerNotRestored()
+				h.AssertStringContains(t, stdout.String(), "built on stack 'other.stack.id', not restoring its layers on stack 'some.stack.id'")
+			})
+
+			when("a signature verifier is set", func() {
+				var (
+					verifier *fakeVerifier
+					stdout   *bytes.Buffer
+					digest   = "sha256:c27a27006b74a056bed5d9edcebc394783880abe8691a8c87c78b7cffa6fa5ad"
+				)
+
+				it.Before(func() {
+					stdout = &bytes.Buffer{}
+					restorer.Out = log.New(stdout, "", 0)
+					verifier = &fakeVerifier{}
+					restorer.Verifier = verifier
+
+					digestRef, err := name.NewDigest("previous-image@" + digest)
+					h.AssertNil(t, err)
+					previousImage.SetIdentifier(remote.DigestIdentifier{Digest: digestRef})
+				})
+
+				it("verifies the previous image before restoring its layers", func() {
+					h.AssertNil(t, restorer.Restore(testCache))
+
+					h.AssertEq(t, verifier.verified, []string{"previous-image@" + digest})
+					_, err := os.Stat(filepath.Join(layersDir, "buildpack.id", "cache-launch.sha"))
+					h.AssertNil(t, err)
+				})
+
+				it("doesn't restore layers from a previous image with an invalid signature", func() {
+					verifier.err = errors.New("invalid signature")
+
+					h.AssertNil(t, restorer.Restore(testCache))
+
+					assertLaunchLayerNotRestored()
+					h.AssertStringContains(t, stdout.String(), "Warning: not reusing image 'previous-image', its signature could not be verified: invalid signature")
+				})
+
+				it("doesn't restore layers from a previous image without a digest", func() {
+					previousImage.SetIdentifier(local.IDIdentifier{ImageID: "s0m3D1g3sT"})
+
+					h.AssertNil(t, restorer.Restore(testCache))
+
+					assertLaunchLayerNotRestored()
+					h.AssertEq(t, len(verifier.verified), 0)
+				})
+			})
+
+			it("skips layers that cannot be read from the previous image", func() {
+				stdout := &bytes.Buffer{}
+				restorer.Out = log.New(stdout, "", 0)
+				restorer.PreviousImage = &layerImage{Image: previousImage, layers: map[string]func() (io.ReadCloser, error){
+					launchLayerSHA: func() (io.ReadCloser, error) { return nil, errors.New("some-error") },
+				}}
+
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				assertLaunchLayerNotRestored()
+				h.AssertStringContains(t, stdout.String(), "Warning: not restoring layer 'buildpack.id:cache-launch'")
+				h.AssertStringContains(t, stdout.String(), "some-error")
+			})
+
+			it("skips layers of the previous image whose contents do not match their SHA", func() {
+				otherTar := filepath.Join(tarDir, "other.tar")
+				h.AssertNil(t, os.MkdirAll(filepath.Join(tarDir, "other"), 0777))
+				h.AssertNil(t, ioutil.WriteFile(filepath.Join(tarDir, "other", "some-file"), []byte("some-contents"), 0666))
+				_, err := archive.WriteTarFile(filepath.Join(tarDir, "other"), otherTar, 1234, 4321, archive.NormalizedDateTime)
+				h.AssertNil(t, err)
+				restorer.PreviousImage = &layerImage{Image: previousImage, layers: map[string]func() (io.ReadCloser, error){
+					launchLayerSHA: func() (io.ReadCloser, error) { return os.Open(otherTar) },
+				}}
+
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				assertLaunchLayerNotRestored()
+			})
+
+			it("restores layers from the cache rather than the previous image", func() {
+				h.RecursiveCopy(t, filepath.Join("testdata", "restorer"), layersDir)
+				cachedSHA := addLayerFromPath(t, filepath.Join(layersDir, "buildpack.id", "cache-launch"), testCache)
+				h.AssertNil(t, testCache.SetMetadata(cache.Metadata{Buildpacks: []metadata.BuildpackLayersMetadata{{
+					ID: "buildpack.id",
+					Layers: map[string]metadata.BuildpackLayerMetadata{"cache-launch": {
+						LayerMetadata:              metadata.LayerMetadata{SHA: cachedSHA},
+						BuildpackLayerMetadataFile: metadata.BuildpackLayerMetadataFile{Launch: true, Cache: true},
+					}},
+				}}}))
+				h.AssertNil(t, testCache.Commit())
+				h.AssertNil(t, os.RemoveAll(layersDir))
+				h.AssertNil(t, os.Mkdir(layersDir, 0777))
+
+				h.AssertNil(t, restorer.Restore(testCache))
+
+				sha, err := ioutil.ReadFile(filepath.Join(layersDir, "buildpack.id", "cache-launch.sha"))
+				h.AssertNil(t, err)
+				h.AssertEq(t, string(sha), cachedSHA)
+			})
+		})
+
 		when("there is a cache", func() {
 			var (
-				tarTempDir          string
 				cacheOnlyLayerSHA   string
 				cacheLaunchLayerSHA string
 				noGroupLayerSHA     string
@@ -80,42 +423,33 @@ func testRestorer(t *testing.T, when spec.G, it spec.S) {
 
 			it.Before(func() {
 				h.RecursiveCopy(t, filepath.Join("testdata", "restorer"), layersDir)
-				var err error
-
-				tarTempDir, err = ioutil.TempDir("", "restorer-test-temp-layer")
-				h.AssertNil(t, err)
 
 				cacheOnlyLayerSHA = addLayerFromPath(
 					t,
-					tarTempDir,
 					filepath.Join(layersDir, "buildpack.id", "cache-only"),
 					testCache,
 				)
 
 				cacheFalseLayerSHA = addLayerFromPath(
 					t,
-					tarTempDir,
 					filepath.Join(layersDir, "buildpack.id", "cache-false"),
 					testCache,
 				)
 
 				cacheLaunchLayerSHA = addLayerFromPath(
 					t,
-					tarTempDir,
 					filepath.Join(layersDir, "buildpack.id", "cache-launch"),
 					testCache,
 				)
 
 				noGroupLayerSHA = addLayerFromPath(
 					t,
-					tarTempDir,
 					filepath.Join(layersDir, "nogroup.buildpack.id", "some-layer"),
 					testCache,
 				)
 
 				escapedLayerSHA = addLayerFromPath(
 					t,
-					tarTempDir,
 					filepath.Join(layersDir, "escaped_buildpack_id", "escaped-bp-layer"),
 					testCache,
 				)
@@ -178,7 +512,7 @@ func testRestorer(t *testing.T, when spec.G, it spec.S) {
 				  ]
 				}`, cacheOnlyLayerSHA, cacheFalseLayerSHA, cacheLaunchLayerSHA, noGroupLayerSHA, escapedLayerSHA)
 
-				err = ioutil.WriteFile(
+				err := ioutil.WriteFile(
 					filepath.Join(cacheDir, "committed", "io.buildpacks.lifecycle.cache.metadata"),
 					[]byte(contents),
 					0666,
@@ -186,10 +520,6 @@ func testRestorer(t *testing.T, when spec.G, it spec.S) {
 				h.AssertNil(t, err)
 			})
 
-			it.After(func() {
-				os.RemoveAll(tarTempDir)
-			})
-
 			it("restores cached layers", func() {
 				h.AssertNil(t, restorer.Restore(testCache))
 				expectedMetadata := `[metadata]
@@ -232,6 +562,81 @@ func testRestorer(t *testing.T, when spec.G, it spec.S) {
 				}
 			})
 
+			when("a cached layer is corrupt", func() {
+				it.Before(func() {
+					h.AssertNil(t, os.Truncate(filepath.Join(cacheDir, "committed", cacheLaunchLayerSHA+".tar"), 1024))
+				})
+
+				it("restores the other layers without it", func() {
+					h.AssertNil(t, restorer.Restore(testCache))
+
+					if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", "cache-only", "file-from-cache-only-layer")); err != nil {
+						t.Fatalf("expected cache-only layer to be restored: %s", err)
+					}
+					for _, path := range []string{"cache-launch", "cache-launch.toml", "cache-launch.sha"} {
+						if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", path)); !os.IsNotExist(err) {
+							t.Fatalf("expected '%s' of the corrupt layer not to be restored", path)
+						}
+					}
+				})
+			})
+
+			when("a cached layer has a corrupt tar header", func() {
+				it.Before(func() {
+					path := filepath.Join(cacheDir, "committed", cacheLaunchLayerSHA+".tar")
+					contents, err := ioutil.ReadFile(path)
+					h.AssertNil(t, err)
+					contents[0] ^= 0xff
+					h.AssertNil(t, ioutil.WriteFile(path, contents, 0666))
+				})
+
+				it("restores the other layers without it", func() {
+					h.AssertNil(t, restorer.Restore(testCache))
+
+					if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", "cache-only", "file-from-cache-only-layer")); err != nil {
+						t.Fatalf("expected cache-only layer to be restored: %s", err)
+					}
+					for _, path := range []string{"cache-launch", "cache-launch.toml", "cache-launch.sha"} {
+						if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", path)); !os.IsNotExist(err) {
+							t.Fatalf("expected '%s' of the corrupt layer not to be restored", path)
+						}
+					}
+				})
+			})
+
+			when("a cached layer cannot be retrieved", func() {
+				it.Before(func() {
+					h.AssertNil(t, os.Remove(filepath.Join(cacheDir, "committed", cacheLaunchLayerSHA+".tar")))
+				})
+
+				it("fails with the identifier of the layer", func() {
+					restorer.Workers = 1
+					h.AssertError(t, restorer.Restore(testCache), "restoring layer 'buildpack.id:cache-launch'")
+				})
+			})
+
+			when("layers are restored concurrently", func() {
+				it("retrieves no more layers at once than there are workers", func() {
+					counting := &concurrencyCache{Cache: testCache}
+					restorer.Workers = 2
+					h.AssertNil(t, restorer.Restore(counting))
+
+					h.AssertEq(t, counting.retrieved, 3)
+					if counting.max > 2 {
+						t.Fatalf("expected at most 2 layers to be retrieved at once, got %d", counting.max)
+					}
+					for _, path := range []string{
+						filepath.Join("buildpack.id", "cache-only.toml"),
+						filepath.Join("buildpack.id", "cache-launch.sha"),
+						filepath.Join("escaped_buildpack_id", "escaped-bp-layer.toml"),
+					} {
+						if _, err := os.Stat(filepath.Join(layersDir, path)); err != nil {
+							t.Fatalf("expected '%s' to be restored: %s", path, err)
+						}
+					}
+				})
+			})
+
 			it("doesn't restore cache false layers", func() {
 				h.AssertNil(t, restorer.Restore(testCache))
 				if _, err := os.Stat(filepath.Join(layersDir, "buildpack.id", "cache-false.toml")); !os.IsNotExist(err) {
@@ -287,11 +692,70 @@ func testRestorer(t *testing.T, when spec.G, it spec.S) {
 	})
 }
 
-func addLayerFromPath(t *testing.T, tarTempDir, layerPath string, c lifecycle.Cache) string {
+func addLayerFromPath(t *testing.T, layerPath string, c lifecycle.Cache) string {
 	t.Helper()
-	tarPath := filepath.Join(tarTempDir, h.RandString(10)+".tar")
-	sha, err := archive.WriteTarFile(layerPath, tarPath, 0, 0)
+	w, err := c.NewLayerWriter()
+	h.AssertNil(t, err)
+	defer w.Close()
+	sha, err := archive.WriteLayer(w, layerPath, 0, 0, archive.NormalizedDateTime, nil)
 	h.AssertNil(t, err)
-	h.AssertNil(t, c.AddLayerFile(sha, tarPath))
+	h.AssertNil(t, w.Commit(sha))
 	return sha
 }
+
+// concurrencyCache records how many layers are retrieved from a cache at once.
+type concurrencyCache struct {
+	lifecycle.Cache
+	mu        sync.Mutex
+	open      int
+	max       int
+	retrieved int
+}
+
+func (c *concurrencyCache) RetrieveLayer(sha string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	c.open++
+	c.retrieved++
+	if c.open > c.max {
+		c.max = c.open
+	}
+	c.mu.Unlock()
+
+	// keep the layer open long enough for other workers to retrieve theirs
+	time.Sleep(50 * time.Millisecond)
+	rc, err := c.Cache.RetrieveLayer(sha)
+	if err != nil {
+		c.closed()
+		return nil, err
+	}
+	return &closeNotifier{ReadCloser: rc, onClose: c.closed}, nil
+}
+
+func (c *concurrencyCache) closed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open--
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	onClose func()
+}
+
+func (n *closeNotifier) Close() error {
+	n.onClose()
+	return n.ReadCloser.Close()
+}
+
+// layerImage returns the given contents for some of the layers of an image.
+type layerImage struct {
+	imgutil.Image
+	layers map[string]func() (io.ReadCloser, error)
+}
+
+func (i *layerImage) GetLayer(sha string) (io.ReadCloser, error) {
+	if open, ok := i.layers[sha]; ok {
+		return open()
+	}
+	return i.Image.GetLayer(sha)
+}
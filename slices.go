@@ -0,0 +1,144 @@
+package lifecycle
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/buildpack/lifecycle/archive"
+)
+
+// Slice selects the files of the app directory that are exported as a separate layer.
+// Paths are globs relative to the app directory; a matching directory includes all of its contents.
+type Slice struct {
+	Paths []string `toml:"paths"`
+}
+
+// ID identifies the slice layer by the set of its paths, so that it is matched with the previous image's slice
+// layer exported from the same paths regardless of the order of the slices or of their paths. The paths are
+// hashed separated by NUL, which cannot occur in a path, so that different sets of paths never share an ID.
+func (s Slice) ID() string {
+	paths := append([]string(nil), s.Paths...)
+	sort.Strings(paths)
+	var unique []string
+	for i, p := range paths {
+		if i == 0 || p != paths[i-1] {
+			unique = append(unique, p)
+		}
+	}
+	return fmt.Sprintf("slice:%x", sha256.Sum256([]byte(strings.Join(unique, "\x00"))))
+}
+
+func (s Slice) matches(rel string) bool {
+	for _, pattern := range s.Paths {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sliceLayer is a layer containing only the files of its directory accepted by its filter.
+type sliceLayer struct {
+	layer
+	include archive.Filter
+}
+
+func (l *sliceLayer) Filter() archive.Filter {
+	return l.include
+}
+
+type filteredLayer interface {
+	Filter() archive.Filter
+}
+
+// appSlices divides appDir between the given slices. Each path belongs to the first slice with a matching
+// glob; the returned app layer contains every path that no slice claims. Directories leading to a claimed
+// path are written to both the app layer and the slice layer so that each layer is complete on its own.
+func appSlices(appDir string, slices []Slice) (*sliceLayer, []*sliceLayer, error) {
+	ids := map[string]bool{}
+	for _, slice := range slices {
+		for _, pattern := range slice.Paths {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid slice path '%s'", pattern)
+			}
+		}
+		if ids[slice.ID()] {
+			return nil, nil, fmt.Errorf("duplicate slice with paths '%s'", strings.Join(slice.Paths, "', '"))
+		}
+		ids[slice.ID()] = true
+	}
+
+	appDir = filepath.Clean(appDir)
+	owners := map[string]int{}
+	parents := make([]map[string]bool, len(slices))
+	for i := range parents {
+		parents[i] = map[string]bool{}
+	}
+	err := filepath.Walk(appDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == appDir {
+			return nil
+		}
+		rel, err := filepath.Rel(appDir, file)
+		if err != nil {
+			return err
+		}
+		for i, slice := range slices {
+			if !slice.matches(rel) {
+				continue
+			}
+			owners[file] = i
+			for dir := filepath.Dir(file); dir != appDir; dir = filepath.Dir(dir) {
+				parents[i][dir] = true
+			}
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "matching slices")
+	}
+
+	owner := func(file string) (int, bool) {
+		for ; file != appDir && file != filepath.Dir(file); file = filepath.Dir(file) {
+			if i, ok := owners[file]; ok {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	app := &sliceLayer{
+		layer: layer{path: appDir, identifier: "app"},
+		include: func(file string, _ os.FileInfo) bool {
+			_, claimed := owner(file)
+			return !claimed
+		},
+	}
+	var sliceLayers []*sliceLayer
+	for i := range slices {
+		i := i
+		sliceLayers = append(sliceLayers, &sliceLayer{
+			layer: layer{path: appDir, identifier: slices[i].ID()},
+			include: func(file string, _ os.FileInfo) bool {
+				if file == appDir || parents[i][file] {
+					return true
+				}
+				o, claimed := owner(file)
+				return claimed && o == i
+			},
+		})
+	}
+	return app, sliceLayers, nil
+}
@@ -36,20 +36,6 @@ func (m *MockCache) EXPECT() *MockCacheMockRecorder {
 	return m.recorder
 }
 
-// AddLayerFile mocks base method
-func (m *MockCache) AddLayerFile(arg0, arg1 string) error {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddLayerFile", arg0, arg1)
-	ret0, _ := ret[0].(error)
-	return ret0
-}
-
-// AddLayerFile indicates an expected call of AddLayerFile
-func (mr *MockCacheMockRecorder) AddLayerFile(arg0, arg1 interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddLayerFile", reflect.TypeOf((*MockCache)(nil).AddLayerFile), arg0, arg1)
-}
-
 // Commit mocks base method
 func (m *MockCache) Commit() error {
 	m.ctrl.T.Helper()
@@ -78,6 +64,21 @@ func (mr *MockCacheMockRecorder) Name() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Name", reflect.TypeOf((*MockCache)(nil).Name))
 }
 
+// NewLayerWriter mocks base method
+func (m *MockCache) NewLayerWriter() (cache.LayerWriter, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewLayerWriter")
+	ret0, _ := ret[0].(cache.LayerWriter)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NewLayerWriter indicates an expected call of NewLayerWriter
+func (mr *MockCacheMockRecorder) NewLayerWriter() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewLayerWriter", reflect.TypeOf((*MockCache)(nil).NewLayerWriter))
+}
+
 // RetrieveLayer mocks base method
 func (m *MockCache) RetrieveLayer(arg0 string) (io.ReadCloser, error) {
 	m.ctrl.T.Helper()